@@ -2,10 +2,19 @@ import * as THREE from "three";
 import fragmentShader from "./glsl/fragment_shader";
 import vertexShader from "./glsl/vertex_shader";
 import { OrbitControls } from "three/examples/jsm/controls/OrbitControls";
-import { Annotation, Camera, LASHeaders, SphereMarker } from "./my_types";
+import {
+    Annotation,
+    Camera,
+    ContourLine,
+    Dimensions,
+    LASHeaders,
+    ShapeSegment,
+    SphereMarker,
+} from "./my_types";
 import Socket from "./socket";
 import { cleanUp, Colors } from "./utils";
 import defaultOptions from "./options";
+import { connectStream } from "./stream";
 
 declare global {
     interface Window {
@@ -19,8 +28,6 @@ declare global {
         headers: LASHeaders;
         animationId: number;
         highLodMaterial: THREE.ShaderMaterial;
-        medLodMaterial: THREE.ShaderMaterial;
-        lowLodMaterial: THREE.ShaderMaterial;
         camera: THREE.Camera;
         markerSphereMeshes: SphereMarker[];
         annotations: Annotation[];
@@ -105,9 +112,36 @@ function addPlane(
     scene.add(plane);
 }
 
-function loadPoints(points: number[], header: LASHeaders) {
+// Each LOD level gathers its chunks in a group, drawn as they arrive.
+const lodLevels: Map<
+    string,
+    {
+        group: THREE.Group;
+        material: THREE.ShaderMaterial;
+        renderDistance: number;
+    }
+> = new Map();
+
+// LOD points are drawn larger the further away their level shows, so a
+// level shown from 200 units is twice the size of the full detail.
+const lodScale = (renderDistance: number) => renderDistance / 100;
+
+// setDimensions keeps each of the points' extra dimensions as a geometry
+// attribute of its name.
+function setDimensions(geometry: THREE.BufferGeometry, dimensions: Dimensions) {
+    Object.entries(dimensions).forEach(([name, values]) => {
+        geometry.setAttribute(name, new THREE.Float32BufferAttribute(values, 1));
+    });
+}
+
+function loadPoints(
+    points: number[],
+    header: LASHeaders,
+    dimensions: Dimensions = {}
+) {
     console.log(header);
     cleanUp();
+    lodLevels.clear();
 
     const vertices = [];
     const colors = [];
@@ -141,6 +175,8 @@ function loadPoints(points: number[], header: LASHeaders) {
         new THREE.Int32BufferAttribute(classification, 1)
     )
 
+    setDimensions(geometry, dimensions);
+
     positionCamera(header);
 
     const pointThree = new THREE.Points(geometry, material);
@@ -159,10 +195,11 @@ function loadPoints(points: number[], header: LASHeaders) {
     animate();
 }
 
-function processPoints(points: number[]): {
-    points: THREE.Points;
-    material: THREE.ShaderMaterial;
-} {
+function processPoints(
+    points: number[],
+    material: THREE.ShaderMaterial,
+    dimensions: Dimensions
+): THREE.Points {
     const vertices = [];
     const colors = [];
     const classification = [];
@@ -196,8 +233,14 @@ function processPoints(points: number[]): {
         new THREE.Int32BufferAttribute(classification, 1)
     )
 
+    setDimensions(geometry, dimensions);
+
     window["geometry"].push(geometry);
 
+    return new THREE.Points(geometry, material);
+}
+
+function createLodMaterial(renderDist: number) {
     const material = new THREE.ShaderMaterial({
         vertexColors: true,
         vertexShader: vertexShader,
@@ -205,10 +248,10 @@ function processPoints(points: number[]): {
         transparent: true,
         uniforms: {
             size: {
-                value: 400.0,
+                value: window["highLodMaterial"].uniforms.size.value * lodScale(renderDist),
             },
             zexag: {
-                value: 0,
+                value: defaultOptions.zExag,
             },
             colormap: {
                 value: Array.from(Object.values(Colors).map(d => new THREE.Vector3(d.r, d.g, d.b))),
@@ -220,20 +263,28 @@ function processPoints(points: number[]): {
 
     window["material"].push(material);
 
-    const pointThree = new THREE.Points(geometry, material);
-
-    return { points: pointThree, material: material };
+    return material;
 }
 
-function loadLODPoints(lod: number[], renderDist: number, label: string) {
-    const { points, material } = processPoints(lod);
-    window["lod"].addLevel(points, renderDist);
-
-    if (label === "medium") {
-        window["medLodMaterial"] = material;
-    } else {
-        window["lowLodMaterial"] = material;
+function loadLODPoints(
+    lod: number[],
+    dimensions: Dimensions,
+    renderDist: number,
+    label: string
+) {
+    let level = lodLevels.get(label);
+
+    if (!level) {
+        level = {
+            group: new THREE.Group(),
+            material: createLodMaterial(renderDist),
+            renderDistance: renderDist,
+        };
+        lodLevels.set(label, level);
+        window["lod"].addLevel(level.group, renderDist);
     }
+
+    level.group.add(processPoints(lod, level.material, dimensions));
 }
 
 function positionCamera(header: LASHeaders) {
@@ -304,6 +355,7 @@ function render() {
 window.addEventListener("lod-points", (e: CustomEventInit) => {
     loadLODPoints(
         e.detail["Points"],
+        e.detail["Dimensions"],
         e.detail["RenderDistance"],
         e.detail["Label"]
     );
@@ -311,20 +363,175 @@ window.addEventListener("lod-points", (e: CustomEventInit) => {
     scene.add(window["lod"]);
 });
 
-document.getElementById("point-size")?.addEventListener("input", (e) => {
-    const value: number = parseFloat((e!.target as HTMLInputElement).value);
+// Streamed nodes are drawn with the full detail material, each as the
+// chunks that have arrived for it.
+const streamGroup = new THREE.Group();
+const streamedNodes: Map<string, THREE.Points[]> = new Map();
+
+function removeStreamedNode(nodeId: string) {
+    (streamedNodes.get(nodeId) ?? []).forEach((points) => {
+        streamGroup.remove(points);
+        points.geometry.dispose();
+        window["geometry"] = window["geometry"].filter(
+            (g) => g !== points.geometry
+        );
+    });
 
-    window["highLodMaterial"].uniforms.size.value = value;
+    streamedNodes.delete(nodeId);
+}
+
+window.addEventListener("stream-start", () => {
+    cleanUp();
+    lodLevels.clear();
+    Array.from(streamedNodes.keys()).forEach(removeStreamedNode);
+
+    if (window["points"]) {
+        scene.remove(window["points"]);
+    }
+
+    scene.add(streamGroup);
+    animate();
+});
+
+window.addEventListener("node-points", (e: CustomEventInit) => {
+    const nodeId: string = e.detail["NodeId"];
+    const points = processPoints(
+        e.detail["Points"],
+        window["highLodMaterial"],
+        e.detail["Dimensions"] ?? {}
+    );
+
+    streamGroup.add(points);
+    streamedNodes.set(nodeId, [...(streamedNodes.get(nodeId) ?? []), points]);
+});
+
+window.addEventListener("node-cancel", (e: CustomEventInit) => {
+    (e.detail["NodeIds"] as string[]).forEach(removeStreamedNode);
+});
 
-    if (window["medLodMaterial"]) {
-        window["medLodMaterial"].uniforms.size.value = value * 2;
+// Contours arrive in chunks at the start of a job, and index contours are
+// drawn brighter.
+const contourGroup = new THREE.Group();
+const contourMaterial = new THREE.LineBasicMaterial({ color: 0xc8a060 });
+const indexContourMaterial = new THREE.LineBasicMaterial({ color: 0xffe0a0 });
+scene.add(contourGroup);
+
+window.addEventListener("contours", (e: CustomEventInit) => {
+    if (e.detail["Chunk"] === 0) {
+        contourGroup.children.forEach((line) =>
+            (line as THREE.Line).geometry.dispose()
+        );
+        contourGroup.clear();
+    }
+
+    (e.detail["Lines"] as ContourLine[]).forEach((line) => {
+        const geometry = new THREE.BufferGeometry();
+        geometry.setAttribute(
+            "position",
+            new THREE.Float32BufferAttribute(line.Points, 3)
+        );
+
+        const material = line.Index ? indexContourMaterial : contourMaterial;
+        contourGroup.add(
+            line.Closed
+                ? new THREE.LineLoop(geometry, material)
+                : new THREE.Line(geometry, material)
+        );
+    });
+});
+
+// Shapes are drawn as their inliers, which index the points of the full
+// cloud, coloured by label, with an outline of spheres and cylinders.
+const shapeGroup = new THREE.Group();
+const shapeColors: { [label: string]: number } = {
+    wall: 0xe06040,
+    floor: 0x40a0e0,
+    ceiling: 0xa040e0,
+    plane: 0xe0e040,
+    cylinder: 0x40e080,
+    sphere: 0xe040a0,
+};
+scene.add(shapeGroup);
+
+window.addEventListener("shape", (e: CustomEventInit) => {
+    if (e.detail["Index"] === 0) {
+        shapeGroup.children.forEach((child) => {
+            const object = child as THREE.Points | THREE.Mesh;
+            object.geometry.dispose();
+            (object.material as THREE.Material).dispose();
+        });
+        shapeGroup.clear();
+    }
+
+    const segment: ShapeSegment = e.detail["Segment"];
+    const color = shapeColors[segment.Label] ?? 0xffffff;
+
+    if (window["points"]) {
+        const source = window["points"].geometry.getAttribute("position");
+        const vertices: number[] = [];
+        segment.Inliers.forEach((i) => {
+            if (i < source.count) {
+                vertices.push(source.getX(i), source.getY(i), source.getZ(i));
+            }
+        });
+
+        const geometry = new THREE.BufferGeometry();
+        geometry.setAttribute(
+            "position",
+            new THREE.Float32BufferAttribute(vertices, 3)
+        );
+        shapeGroup.add(
+            new THREE.Points(
+                geometry,
+                new THREE.PointsMaterial({ color, size: 2, sizeAttenuation: false })
+            )
+        );
     }
 
-    if (window["lowLodMaterial"]) {
-        window["lowLodMaterial"].uniforms.size.value = value * 4;
+    const centre = new THREE.Vector3().fromArray(segment.Centre);
+    let outline: THREE.BufferGeometry | undefined;
+
+    if (segment.Type === "sphere") {
+        outline = new THREE.SphereGeometry(segment.Radius, 16, 12);
+    } else if (segment.Type === "cylinder" && segment.Axis) {
+        outline = new THREE.CylinderGeometry(
+            segment.Radius,
+            segment.Radius,
+            segment.Length,
+            24,
+            1,
+            true
+        );
+    }
+
+    if (outline) {
+        const mesh = new THREE.Mesh(
+            outline,
+            new THREE.MeshBasicMaterial({ color, wireframe: true })
+        );
+        mesh.position.copy(centre);
+
+        if (segment.Axis) {
+            mesh.quaternion.setFromUnitVectors(
+                new THREE.Vector3(0, 1, 0),
+                new THREE.Vector3().fromArray(segment.Axis)
+            );
+        }
+
+        shapeGroup.add(mesh);
     }
 });
 
+document.getElementById("point-size")?.addEventListener("input", (e) => {
+    const value: number = parseFloat((e!.target as HTMLInputElement).value);
+
+    window["highLodMaterial"].uniforms.size.value = value;
+
+    lodLevels.forEach(({ material, renderDistance }) => {
+        material.uniforms.size.value = value * lodScale(renderDistance);
+    });
+});
+
 document.getElementById("camera-fov")?.addEventListener("input", (e) => {
     const value: number = parseFloat((e!.target as HTMLInputElement).value);
     defaultOptions["fov"] = value;
@@ -357,13 +564,9 @@ document.getElementById("z-exaggeration")?.addEventListener("input", (e) => {
 
     window["plane"].position.y = value;
     window["highLodMaterial"].uniforms.zexag.value = value;
-    if (window["medLodMaterial"]) {
-        window["medLodMaterial"].uniforms.zexag.value = value;
-    }
-
-    if (window["lowLodMaterial"]) {
-        window["lowLodMaterial"].uniforms.zexag.value = value;
-    }
+    lodLevels.forEach(({ material }) => {
+        material.uniforms.zexag.value = value;
+    });
 });
 
 document.querySelectorAll("input[type='color']").forEach((d, i) => {
@@ -376,13 +579,9 @@ document.querySelectorAll("input[type='color']").forEach((d, i) => {
         const updateColorMap = Array.from(Object.values(Colors).map(d => new THREE.Vector3(d.r, d.g, d.b)));
 
         window["highLodMaterial"].uniforms.colormap.value = updateColorMap;
-        if (window["medLodMaterial"]) {
-            window["medLodMaterial"].uniforms.colormap.value = updateColorMap;
-        }
-
-        if (window["lowLodMaterial"]) {
-            window["lowLodMaterial"].uniforms.colormap.value = updateColorMap;
-        }
+        lodLevels.forEach(({ material }) => {
+            material.uniforms.colormap.value = updateColorMap;
+        });
     })
 })
 
@@ -424,7 +623,9 @@ window.addEventListener("update-camera", () => {
     animate();
 });
 
-new Socket("ws://localhost:8080/ws").connect(loadPoints);
+const socket = new Socket("ws://localhost:8080/ws");
+socket.connect(loadPoints);
+connectStream(socket);
 
 Promise.all([
     fetch("http://localhost:8080/test").then((d) => d.json()),
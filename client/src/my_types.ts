@@ -10,6 +10,35 @@ export interface LASHeaders {
     MaximumBounds: number[];
 }
 
+// Dimensions are extra values of each point, such as normals, by name.
+export type Dimensions = { [name: string]: number[] };
+
+export interface DimensionRange {
+    Dimension: string;
+    Min: number;
+    Max: number;
+}
+
+export interface ContourLine {
+    Elevation: number;
+    Index: boolean;
+    Closed: boolean;
+    Points: number[];
+}
+
+export interface ShapeSegment {
+    Id: number;
+    Type: string;
+    Label: string;
+    Centre: number[];
+    Normal?: number[];
+    Axis?: number[];
+    Radius?: number;
+    Length?: number;
+    Rms: number;
+    Inliers: number[];
+}
+
 // export const dummyLASHeader: LASHeaders = {
 //     pointOffset: 0,
 //     formatID: 0,
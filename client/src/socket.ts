@@ -1,4 +1,4 @@
-import { LASHeaders } from "./my_types";
+import { Dimensions, LASHeaders } from "./my_types";
 import { hideProgressBar, showProgressBar, updateProgressBar } from "./ui";
 
 class Socket {
@@ -7,7 +7,10 @@ class Socket {
     private url: string | undefined;
     private header: LASHeaders | undefined;
     private chunks: number[];
+    private dimensions: Dimensions = {};
     private chunkCount: number = 0;
+    private lodLevels: Set<string> = new Set();
+    private lodEvents: any[] = [];
 
     constructor(url: string) {
         this.ws = new WebSocket(url);
@@ -16,7 +19,7 @@ class Socket {
         this.chunks = [];
     }
 
-    connect(callback: (points: number[], header: LASHeaders) => void) {
+    connect(callback: (points: number[], header: LASHeaders, dimensions: Dimensions) => void) {
         if (!this.ws) return;
 
         const socket = this.ws;
@@ -39,15 +42,18 @@ class Socket {
             } else if (data["Event"] === "progress") {
                 showProgressBar();
                 updateProgressBar(0, data["Message"]);
-            } else if (data["Event"] === "lod-points") {
+            } else if (data["Event"] === "lod-points" || data["Event"] === "lod-done") {
+                o.lodEventHandler(data);
+            } else if (
+                data["Event"] === "file-ready" ||
+                data["Event"] === "dataset" ||
+                data["Event"] === "node-points" ||
+                data["Event"] === "node-cancel" ||
+                data["Event"] === "contours" ||
+                data["Event"] === "shape"
+            ) {
                 window.dispatchEvent(
-                    new CustomEvent("lod-points", {
-                        detail: data,
-                    })
-                );
-            } else if (data["Event"] === "file-ready") {
-                window.dispatchEvent(
-                    new CustomEvent("file-ready", {
+                    new CustomEvent(data["Event"], {
                         detail: data,
                     })
                 );
@@ -78,6 +84,13 @@ class Socket {
 
         this.chunks.push(...data["Points"]);
 
+        Object.entries((data["Dimensions"] ?? {}) as Dimensions).forEach(
+            ([name, values]) => {
+                this.dimensions[name] = this.dimensions[name] ?? [];
+                this.dimensions[name].push(...values);
+            }
+        );
+
         this.chunkCount++;
 
         const downloadProg = Math.ceil(
@@ -86,19 +99,80 @@ class Socket {
         updateProgressBar(downloadProg, `Processing... (${downloadProg}%)`);
     }
 
+    // Loading the full cloud clears the scene, so levels that start before
+    // it is done wait for it.
+    lodEventHandler(data: any) {
+        if (this.header) {
+            this.lodEvents.push(data);
+            return;
+        }
+
+        if (data["Event"] === "lod-points") {
+            this.lodChunkHandler(data);
+        } else {
+            this.lodDoneHandler(data);
+        }
+    }
+
+    lodChunkHandler(data: any) {
+        const label: string = data["Label"];
+
+        if (!this.lodLevels.has(label)) {
+            this.lodLevels.add(label);
+            showProgressBar();
+        }
+
+        const sequence: number = data["Sequence"] + 1;
+        const lodProg = Math.ceil((sequence / data["TotalChunks"]) * 100);
+        updateProgressBar(
+            lodProg,
+            `Loading ${label} detail... (${sequence}/${data["TotalChunks"]})`
+        );
+
+        window.dispatchEvent(
+            new CustomEvent("lod-points", {
+                detail: {
+                    Points: data["Points"],
+                    Dimensions: data["Dimensions"] ?? {},
+                    RenderDistance: data["RenderDistance"],
+                    Label: label,
+                },
+            })
+        );
+    }
+
+    lodDoneHandler(data: any) {
+        this.lodLevels.delete(data["Label"]);
+
+        if (!this.lodLevels.size) {
+            hideProgressBar();
+        }
+    }
+
     doneEventHandler(
-        callback: (points: number[], header: LASHeaders) => void
+        callback: (points: number[], header: LASHeaders, dimensions: Dimensions) => void
     ) {
         if (this.header) {
             console.log("CHUNKS DONE");
-            callback(this.chunks, this.header);
+            callback(this.chunks, this.header, this.dimensions);
             hideProgressBar();
             this.clearPointData();
+
+            const lodEvents = this.lodEvents;
+            this.lodEvents = [];
+            lodEvents.forEach((data) => this.lodEventHandler(data));
+        }
+    }
+
+    send(data: object) {
+        if (this.ws?.readyState === WebSocket.OPEN) {
+            this.ws.send(JSON.stringify(data));
         }
     }
 
     clearPointData() {
         this.chunks = [];
+        this.dimensions = {};
         this.header = undefined;
         this.chunkCount = 0;
     }
@@ -0,0 +1,114 @@
+import * as THREE from "three";
+import { DimensionRange } from "./my_types";
+import Socket from "./socket";
+import defaultOptions from "./options";
+
+// While a dataset streams, the camera is sent this often in milliseconds if
+// it has moved, so the server can send the nodes in view.
+const cameraInterval = 250;
+
+const datasetInput = document.getElementById("dataset-id") as HTMLInputElement;
+const filterDimension = document.getElementById(
+    "filter-dimension"
+) as HTMLSelectElement;
+const filterMin = document.getElementById("filter-min") as HTMLInputElement;
+const filterMax = document.getElementById("filter-max") as HTMLInputElement;
+
+let streaming = false;
+let lastCamera = "";
+
+const cameraEvent = () => {
+    const camera = window["camera"];
+    camera.updateMatrixWorld();
+
+    const frustum = new THREE.Frustum().setFromProjectionMatrix(
+        new THREE.Matrix4().multiplyMatrices(
+            camera.projectionMatrix,
+            camera.matrixWorldInverse
+        )
+    );
+
+    return {
+        Event: "camera",
+        Position: camera.position.toArray(),
+        Frustum: frustum.planes.map((plane) => [
+            plane.normal.x,
+            plane.normal.y,
+            plane.normal.z,
+            plane.constant,
+        ]),
+        ScreenHeight: window.innerHeight,
+        Fov:
+            camera instanceof THREE.PerspectiveCamera
+                ? camera.fov
+                : defaultOptions.fov,
+    };
+};
+
+const sendFilter = (socket: Socket, ranges: DimensionRange[]) => {
+    socket.send({
+        Event: "filter",
+        Ranges: ranges,
+    });
+};
+
+export const connectStream = (socket: Socket) => {
+    window.addEventListener("dataset", (e: CustomEventInit) => {
+        datasetInput.value = e.detail["DatasetId"];
+    });
+
+    // Streamed points can be filtered on any dimension they carry.
+    window.addEventListener("node-points", (e: CustomEventInit) => {
+        Object.keys(e.detail["Dimensions"] ?? {}).forEach((name) => {
+            if (
+                !Array.from(filterDimension.options).some(
+                    (option) => option.value === name
+                )
+            ) {
+                filterDimension.add(new Option(name, name));
+            }
+        });
+    });
+
+    document.getElementById("stream-dataset")?.addEventListener("click", () => {
+        if (!datasetInput.value) return;
+
+        window.dispatchEvent(new Event("stream-start"));
+        socket.send({
+            Event: "stream",
+            DatasetId: datasetInput.value,
+        });
+
+        streaming = true;
+        lastCamera = "";
+    });
+
+    document.getElementById("apply-filter")?.addEventListener("click", () => {
+        const min = parseFloat(filterMin.value);
+        const max = parseFloat(filterMax.value);
+        if (!filterDimension.value || isNaN(min) || isNaN(max)) return;
+
+        sendFilter(socket, [
+            {
+                Dimension: filterDimension.value,
+                Min: min,
+                Max: max,
+            },
+        ]);
+    });
+
+    document.getElementById("clear-filter")?.addEventListener("click", () => {
+        sendFilter(socket, []);
+    });
+
+    setInterval(() => {
+        if (!streaming) return;
+
+        const event = cameraEvent();
+        const key = JSON.stringify(event);
+        if (key === lastCamera) return;
+
+        lastCamera = key;
+        socket.send(event);
+    }, cameraInterval);
+};
@@ -2,4 +2,84 @@ package constants
 
 const SocketChunkSize int = 1296;
 
-const PointOffset int = 8;
\ No newline at end of file
+const PointOffset int = 8;
+
+const WorkingDirectory string = "./work";
+
+const SpillThreshold int = 65536;
+
+const OutOfCoreBatchSize int = 4194304;
+
+const DatasetDirectory string = "./datasets";
+
+const StreamPointBudget int = 2000000;
+
+const ScreenSpaceErrorThreshold float64 = 2;
+
+const MaxClusters int = 32;
+
+const SilhouetteSampleSize int = 500;
+
+const VoxelPointsPerCell int = 8;
+
+const MiniBatchThreshold int = 20000;
+
+const MiniBatchSize int = 1024;
+
+const MiniBatchIterations int = 100;
+
+const OutlierNeighbours int = 8;
+
+const OutlierStdDev float64 = 2;
+
+const OutlierMinNeighbours int = 2;
+
+const OutlierRadius float64 = 1;
+
+const GroundCellSize float64 = 1;
+
+const GroundSlope float64 = 0.3;
+
+const GroundMaxWindow float64 = 20;
+
+const GroundThreshold float64 = 0.5;
+
+const GroundMaxThreshold float64 = 3;
+
+const RasterResolution float64 = 1;
+
+const RasterIdwNeighbours int = 8;
+
+const RasterNoData float64 = -9999;
+
+const ContourInterval float64 = 1;
+
+const ContourIndexEvery int = 5;
+
+const VolumeCellSize float64 = 0.5;
+
+const VolumeMargin int = 5;
+
+const ProfileWidth float64 = 2;
+
+const NormalNeighbours int = 10;
+
+const ShapeTolerance float64 = 0.05;
+
+const ShapeMinSupport int = 200;
+
+const ShapeNormalDeviation float64 = 20;
+
+const ShapeCandidates int = 200;
+
+const ShapeScoreSample int = 5000;
+
+const ShapeSampleNeighbours int = 32;
+
+const ShapeMaxFailures int = 5;
+
+const ShapeRefits int = 3;
+
+const ShapeConnectivity float64 = 0.5;
+
+const ShapeBatchPoints int = 200000;
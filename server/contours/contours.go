@@ -0,0 +1,402 @@
+package contours
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	c "lidar/constants"
+	"lidar/raster"
+	"lidar/structs"
+	"lidar/vector"
+)
+
+// Config sets the contour levels for a job. Levels fall on multiples of
+// Interval in real-world elevation, and every IndexEvery-th level is an index
+// contour. Smoothing is the number of Chaikin corner cutting passes. Formats
+// are any of "geojson", "shapefile" and "dxf".
+type Config struct {
+	Interval float64
+	IndexEvery int
+	Smoothing int
+	Formats []string
+}
+
+// FromOptions returns nil when the job asked for no contours.
+func FromOptions(options *structs.ProcessingOptions) *Config {
+	enabled, _ := strconv.ParseBool(options.Contours)
+	if !enabled {
+		return nil
+	}
+
+	config := &Config{
+		Interval: c.ContourInterval,
+		IndexEvery: c.ContourIndexEvery,
+		Formats: []string{},
+	}
+
+	interval, err := strconv.ParseFloat(options.ContourInterval, 64)
+	if err == nil && interval > 0 {
+		config.Interval = interval
+	}
+
+	indexEvery, err := strconv.Atoi(options.ContourIndex)
+	if err == nil && indexEvery > 0 {
+		config.IndexEvery = indexEvery
+	}
+
+	smoothing, err := strconv.Atoi(options.ContourSmoothing)
+	if err == nil && smoothing > 0 {
+		config.Smoothing = smoothing
+	}
+
+	for _, format := range strings.Split(options.ContourFormats, ",") {
+		format = strings.TrimSpace(format)
+		switch format {
+		case "geojson", "shapefile", "dxf":
+			config.Formats = append(config.Formats, format)
+		}
+	}
+
+	if len(config.Formats) == 0 {
+		config.Formats = []string{"geojson", "shapefile", "dxf"}
+	}
+
+	return config
+}
+
+// Line is one contour in point coordinates: Points holds x and north pairs
+// and Elevation is the level as a point elevation.
+type Line struct {
+	Elevation float64
+	Index bool
+	Closed bool
+	Points [][2]float64
+}
+
+// Generate traces the contours of a surface by marching squares over its
+// cell centres. offset is the header's Z offset, so that levels fall on
+// round real-world elevations. Cells with an empty corner are skipped.
+func (config *Config) Generate(g *raster.Grid, offset float64) []Line {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, v := range g.Values {
+		if !math.IsNaN(v) {
+			low = math.Min(low, v + offset)
+			high = math.Max(high, v + offset)
+		}
+	}
+
+	lines := []Line{}
+	if math.IsInf(low, 1) {
+		return lines
+	}
+
+	for step := math.Ceil(low / config.Interval); step * config.Interval <= high; step++ {
+		level := step * config.Interval - offset
+		index := int64(step) % int64(config.IndexEvery) == 0
+
+		for _, points := range trace(g, level) {
+			line := Line{
+				Elevation: level,
+				Index: index,
+				Points: points,
+			}
+
+			last := len(points) - 1
+			if last > 1 && points[0] == points[last] {
+				line.Closed = true
+				line.Points = points[:last]
+			}
+
+			for i := 0; i < config.Smoothing; i++ {
+				line.Points = chaikin(line.Points, line.Closed)
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// Cell edges are numbered so that neighbouring cells agree on the edges they
+// share: 2i is the edge from centre i to the centre on its right, 2i + 1 the
+// edge to the centre above it.
+func horizontalEdge(g *raster.Grid, col, row int) int {
+	return 2 * (row * g.Columns + col)
+}
+
+func verticalEdge(g *raster.Grid, col, row int) int {
+	return 2 * (row * g.Columns + col) + 1
+}
+
+// crossing is where a level crosses an edge, interpolated between the
+// centres at its ends.
+func crossing(g *raster.Grid, edge int, level float64) [2]float64 {
+	i := edge / 2
+	col, row := i % g.Columns, i / g.Columns
+	j := i + 1
+	if edge % 2 == 1 {
+		j = i + g.Columns
+	}
+
+	a, b := g.Values[i], g.Values[j]
+	t := 0.5
+	if a != b {
+		t = (level - a) / (b - a)
+	}
+
+	x, z := g.Centre(col, row)
+	if edge % 2 == 0 {
+		return [2]float64{x + t * g.CellSize, z}
+	}
+
+	return [2]float64{x, z + t * g.CellSize}
+}
+
+// trace returns the polylines of one level, with closed ones ending where
+// they began.
+func trace(g *raster.Grid, level float64) [][][2]float64 {
+	segments := [][2]int{}
+
+	for row := 0; row < g.Rows - 1; row++ {
+		for col := 0; col < g.Columns - 1; col++ {
+			bl := g.Values[row * g.Columns + col]
+			br := g.Values[row * g.Columns + col + 1]
+			tr := g.Values[(row + 1) * g.Columns + col + 1]
+			tl := g.Values[(row + 1) * g.Columns + col]
+			if math.IsNaN(bl) || math.IsNaN(br) || math.IsNaN(tr) || math.IsNaN(tl) {
+				continue
+			}
+
+			bottom := horizontalEdge(g, col, row)
+			top := horizontalEdge(g, col, row + 1)
+			left := verticalEdge(g, col, row)
+			right := verticalEdge(g, col + 1, row)
+
+			state := 0
+			if bl >= level {
+				state |= 1
+			}
+			if br >= level {
+				state |= 2
+			}
+			if tr >= level {
+				state |= 4
+			}
+			if tl >= level {
+				state |= 8
+			}
+
+			// Saddles are resolved by the mean of the four corners.
+			centreAbove := (bl + br + tr + tl) / 4 >= level
+
+			switch state {
+			case 1, 14:
+				segments = append(segments, [2]int{left, bottom})
+			case 2, 13:
+				segments = append(segments, [2]int{bottom, right})
+			case 3, 12:
+				segments = append(segments, [2]int{left, right})
+			case 4, 11:
+				segments = append(segments, [2]int{right, top})
+			case 6, 9:
+				segments = append(segments, [2]int{bottom, top})
+			case 7, 8:
+				segments = append(segments, [2]int{left, top})
+			case 5:
+				if centreAbove {
+					segments = append(segments, [2]int{left, top}, [2]int{bottom, right})
+				} else {
+					segments = append(segments, [2]int{left, bottom}, [2]int{right, top})
+				}
+			case 10:
+				if centreAbove {
+					segments = append(segments, [2]int{left, bottom}, [2]int{right, top})
+				} else {
+					segments = append(segments, [2]int{left, top}, [2]int{bottom, right})
+				}
+			}
+		}
+	}
+
+	byEdge := map[int][]int{}
+	for i, s := range segments {
+		byEdge[s[0]] = append(byEdge[s[0]], i)
+		byEdge[s[1]] = append(byEdge[s[1]], i)
+	}
+
+	used := make([]bool, len(segments))
+
+	// follow walks from edge away from segment i, returning the edges passed.
+	follow := func(i, edge int) []int {
+		edges := []int{}
+		for {
+			next := -1
+			for _, j := range byEdge[edge] {
+				if j != i && !used[j] {
+					next = j
+					break
+				}
+			}
+			if next == -1 {
+				return edges
+			}
+
+			used[next] = true
+			i = next
+			if segments[next][0] == edge {
+				edge = segments[next][1]
+			} else {
+				edge = segments[next][0]
+			}
+			edges = append(edges, edge)
+		}
+	}
+
+	lines := [][][2]float64{}
+
+	for i, s := range segments {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+
+		forward := follow(i, s[1])
+		backward := []int{}
+		if len(forward) == 0 || forward[len(forward) - 1] != s[0] {
+			backward = follow(i, s[0])
+		}
+
+		edges := []int{}
+		for k := len(backward) - 1; k >= 0; k-- {
+			edges = append(edges, backward[k])
+		}
+		edges = append(edges, s[0], s[1])
+		edges = append(edges, forward...)
+
+		points := make([][2]float64, len(edges))
+		for k, edge := range edges {
+			points[k] = crossing(g, edge, level)
+		}
+
+		lines = append(lines, points)
+	}
+
+	return lines
+}
+
+// chaikin cuts each corner of a line, replacing every segment with points a
+// quarter and three quarters along it. Open lines keep their ends.
+func chaikin(points [][2]float64, closed bool) [][2]float64 {
+	if len(points) < 3 {
+		return points
+	}
+
+	cut := func(a, b [2]float64) ([2]float64, [2]float64) {
+		return [2]float64{0.75 * a[0] + 0.25 * b[0], 0.75 * a[1] + 0.25 * b[1]},
+			[2]float64{0.25 * a[0] + 0.75 * b[0], 0.25 * a[1] + 0.75 * b[1]}
+	}
+
+	res := [][2]float64{}
+	if closed {
+		for i := range points {
+			q, r := cut(points[i], points[(i + 1) % len(points)])
+			res = append(res, q, r)
+		}
+
+		return res
+	}
+
+	res = append(res, points[0])
+	for i := 0; i < len(points) - 1; i++ {
+		q, r := cut(points[i], points[i + 1])
+		if i > 0 {
+			res = append(res, q)
+		}
+		if i < len(points) - 2 {
+			res = append(res, r)
+		}
+	}
+
+	return append(res, points[len(points) - 1])
+}
+
+// Collection places lines in real-world coordinates for writing, with index
+// contours on their own layer.
+func Collection(lines []Line, headers *structs.LASHeaders) *vector.Collection {
+	collection := &vector.Collection{
+		Fields: []string{"elevation", "index"},
+		Lines: []vector.Polyline{},
+	}
+
+	for _, line := range lines {
+		polyline := vector.Polyline{
+			Layer: "CONTOUR",
+			Closed: line.Closed,
+			Points: make([][3]float64, len(line.Points)),
+			Properties: map[string]float64{
+				"elevation": line.Elevation + headers.Offset[2],
+				"index": 0,
+			},
+		}
+
+		if line.Index {
+			polyline.Layer = "CONTOUR_INDEX"
+			polyline.Properties["index"] = 1
+		}
+
+		for i, p := range line.Points {
+			polyline.Points[i] = [3]float64{p[0] + headers.Offset[0], p[1] + headers.Offset[1], line.Elevation + headers.Offset[2]}
+		}
+
+		collection.Lines = append(collection.Lines, polyline)
+	}
+
+	return collection
+}
+
+// Send streams lines to the client as 3D polylines in its coordinate space,
+// in chunks of about SocketChunkSize values.
+func Send(socket *structs.ConcurrentSocket, lines []Line, m *structs.LASMetaData) {
+	chunks := [][]structs.ContourLine{}
+	chunk := []structs.ContourLine{}
+	size := 0
+
+	for _, line := range lines {
+		points := make([]float64, 0, len(line.Points) * 3)
+		for _, p := range line.Points {
+			points = append(points, p[0] + m.OffsetX, line.Elevation + m.OffsetZ, p[1] + m.OffsetY)
+		}
+
+		chunk = append(chunk, structs.ContourLine{
+			Elevation: line.Elevation + m.OffsetZ,
+			Index: line.Index,
+			Closed: line.Closed,
+			Points: points,
+		})
+		size += len(points)
+
+		if size >= c.SocketChunkSize {
+			chunks = append(chunks, chunk)
+			chunk = []structs.ContourLine{}
+			size = 0
+		}
+	}
+
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	socket.Lock.Lock()
+	defer socket.Lock.Unlock()
+
+	for i, lines := range chunks {
+		socket.Conn.WriteJSON(structs.ContourChunk{
+			Event: "contours",
+			Lines: lines,
+			Chunk: i,
+			TotalChunks: len(chunks),
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package contours
+
+import (
+	"math"
+	"testing"
+
+	"lidar/raster"
+)
+
+// cone is a grid whose values are the distance from its middle.
+func cone() *raster.Grid {
+	g := raster.NewGrid(0, 0, 20, 20, 1)
+	for row := 0; row < g.Rows; row++ {
+		for col := 0; col < g.Columns; col++ {
+			x, z := g.Centre(col, row)
+			g.Values[row * g.Columns + col] = math.Hypot(x - 10.5, z - 10.5)
+		}
+	}
+
+	return g
+}
+
+func TestTraceClosesRings(t *testing.T) {
+	lines := trace(cone(), 5)
+	if len(lines) != 1 {
+		t.Fatalf("traced %d lines, want one ring", len(lines))
+	}
+
+	ring := lines[0]
+	if ring[0] != ring[len(ring) - 1] {
+		t.Fatal("ring does not end where it began")
+	}
+
+	for _, p := range ring {
+		// Crossings are interpolated linearly between cell centres, which
+		// cuts the circle's corners a little.
+		r := math.Hypot(p[0] - 10.5, p[1] - 10.5)
+		if math.Abs(r - 5) > 0.1 {
+			t.Fatalf("ring point %v is %f from the middle, want 5", p, r)
+		}
+	}
+}
+
+func TestTraceFollowsSlope(t *testing.T) {
+	g := raster.NewGrid(0, 0, 10, 10, 1)
+	for row := 0; row < g.Rows; row++ {
+		for col := 0; col < g.Columns; col++ {
+			x, _ := g.Centre(col, row)
+			g.Values[row * g.Columns + col] = x
+		}
+	}
+
+	lines := trace(g, 4.25)
+	if len(lines) != 1 {
+		t.Fatalf("traced %d lines, want one", len(lines))
+	}
+
+	line := lines[0]
+	if len(line) != g.Rows {
+		t.Fatalf("line has %d points, want one per row", len(line))
+	}
+	for _, p := range line {
+		if math.Abs(p[0] - 4.25) > 1e-9 {
+			t.Fatalf("line point %v is off x = 4.25", p)
+		}
+	}
+}
+
+func TestTraceSkipsEmptyCells(t *testing.T) {
+	g := cone()
+	// Empty a column across the ring, which cuts it into two open lines.
+	for row := 0; row < g.Rows; row++ {
+		g.Values[row * g.Columns + 10] = math.NaN()
+	}
+
+	lines := trace(g, 5)
+	if len(lines) != 2 {
+		t.Fatalf("traced %d lines, want two", len(lines))
+	}
+	for _, line := range lines {
+		if line[0] == line[len(line) - 1] {
+			t.Fatal("a cut ring is still closed")
+		}
+	}
+}
+
+func TestGenerateMarksIndexContours(t *testing.T) {
+	config := &Config{
+		Interval: 1,
+		IndexEvery: 5,
+	}
+
+	// The offset raises the cone by 100, so levels fall on 101 to 114.
+	lines := config.Generate(cone(), 100)
+
+	indexed := map[float64]bool{}
+	for _, line := range lines {
+		if !line.Closed {
+			continue
+		}
+		indexed[line.Elevation] = line.Index
+	}
+
+	if !indexed[5] || !indexed[10] || indexed[4] || indexed[6] {
+		t.Fatalf("index contours are %v, want those at 105 and 110", indexed)
+	}
+}
@@ -0,0 +1,594 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"lidar/octree"
+	"lidar/spill"
+	"lidar/structs"
+
+	"github.com/google/uuid"
+)
+
+const infoFile = "info.json"
+
+const artifactDir = "artifacts"
+
+// Store keeps processed datasets on disk, one directory per dataset ID.
+type Store struct {
+	Dir string
+}
+
+// Segment locates one node's points within a level file.
+type Segment struct {
+	Offset int64
+	Length int
+}
+
+type Level struct {
+	Label string
+	RenderDistance float64
+	GeometricError float64
+	Order []string
+	Segments map[string]Segment
+	// Dimensions locates each node's values of each extra dimension, by
+	// dimension name then node ID.
+	Dimensions map[string]map[string]Segment `json:",omitempty"`
+}
+
+type Node struct {
+	Id string
+	X1 float64
+	X2 float64
+	Y1 float64
+	Y2 float64
+	Z1 float64
+	Z2 float64
+}
+
+type DatasetInfo struct {
+	Id string
+	Name string
+	Created time.Time
+	PointCount int
+	Headers structs.LASHeaders
+	Metadata structs.LASMetaData
+	Nodes []Node
+	Levels []*Level
+	Dimensions []string `json:",omitempty"`
+}
+
+type DatasetSummary struct {
+	Id string
+	Name string
+	Created time.Time
+	PointCount int
+	Levels []string
+	Dimensions []string `json:",omitempty"`
+}
+
+type Dataset struct {
+	Info DatasetInfo
+	Dir string
+	Mutex sync.Mutex
+	nodeIndex map[string]bool
+}
+
+func NewStore(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		Dir: dir,
+	}, nil
+}
+
+func (s *Store) Create(name string, headers *structs.LASHeaders, metadata *structs.LASMetaData) (*Dataset, error) {
+	id := uuid.NewString()
+	dir := filepath.Join(s.Dir, id)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Dataset{
+		Info: DatasetInfo{
+			Id: id,
+			Name: name,
+			Created: time.Now(),
+			Headers: *headers,
+			Metadata: *metadata,
+			Nodes: []Node{},
+			Levels: []*Level{},
+		},
+		Dir: dir,
+	}, nil
+}
+
+func (s *Store) Open(id string) (*Dataset, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, errors.New("invalid dataset id")
+	}
+
+	dir := filepath.Join(s.Dir, id)
+	buf, err := os.ReadFile(filepath.Join(dir, infoFile))
+	if err != nil {
+		return nil, err
+	}
+
+	dataset := &Dataset{
+		Dir: dir,
+	}
+
+	err = json.Unmarshal(buf, &dataset.Info)
+	if err != nil {
+		return nil, err
+	}
+
+	return dataset, nil
+}
+
+func (s *Store) List() ([]DatasetSummary, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []DatasetSummary{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dataset, err := s.Open(entry.Name())
+		if err != nil {
+			// Datasets still being written have no info file yet.
+			continue
+		}
+
+		res = append(res, dataset.Summary())
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.After(res[j].Created)
+	})
+
+	return res, nil
+}
+
+func (d *Dataset) Summary() DatasetSummary {
+	levels := []string{}
+	for _, level := range d.Info.Levels {
+		levels = append(levels, level.Label)
+	}
+
+	return DatasetSummary{
+		Id: d.Info.Id,
+		Name: d.Info.Name,
+		Created: d.Info.Created,
+		PointCount: d.Info.PointCount,
+		Levels: levels,
+		Dimensions: d.Info.Dimensions,
+	}
+}
+
+func (d *Dataset) levelPath(label string) string {
+	return filepath.Join(d.Dir, label + ".bin")
+}
+
+// WriteLevel writes the points of nodes to the level's file, recording where
+// each node's points live so they can be read back individually.
+func (d *Dataset) WriteLevel(label string, renderDistance, geometricError float64, nodes []*octree.OctreeNode, read func(*octree.OctreeNode) ([]float64, error)) error {
+	f, err := os.Create(d.levelPath(label))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	level := &Level{
+		Label: label,
+		RenderDistance: renderDistance,
+		GeometricError: geometricError,
+		Order: []string{},
+		Segments: map[string]Segment{},
+	}
+
+	var offset int64 = 0
+
+	for _, node := range nodes {
+		points, err := read(node)
+		if err != nil {
+			return err
+		}
+
+		err = spill.WritePoints(w, points)
+		if err != nil {
+			return err
+		}
+
+		level.Order = append(level.Order, node.Id)
+		level.Segments[node.Id] = Segment{
+			Offset: offset,
+			Length: len(points),
+		}
+		offset += int64(len(points) * 8)
+
+		d.addNode(node)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	for i, existing := range d.Info.Levels {
+		if existing.Label == label {
+			d.Info.Levels[i] = level
+			return nil
+		}
+	}
+
+	d.Info.Levels = append(d.Info.Levels, level)
+
+	return nil
+}
+
+func (d *Dataset) addNode(node *octree.OctreeNode) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	if d.nodeIndex == nil {
+		d.nodeIndex = map[string]bool{}
+		for _, existing := range d.Info.Nodes {
+			d.nodeIndex[existing.Id] = true
+		}
+	}
+
+	if d.nodeIndex[node.Id] {
+		return
+	}
+
+	d.nodeIndex[node.Id] = true
+	d.Info.Nodes = append(d.Info.Nodes, Node{
+		Id: node.Id,
+		X1: node.X1,
+		X2: node.X2,
+		Y1: node.Y1,
+		Y2: node.Y2,
+		Z1: node.Z1,
+		Z2: node.Z2,
+	})
+}
+
+func (d *Dataset) Level(label string) *Level {
+	for _, level := range d.Info.Levels {
+		if level.Label == label {
+			return level
+		}
+	}
+
+	return nil
+}
+
+func (d *Dataset) ReadSegment(label, nodeId string) ([]float64, error) {
+	level := d.Level(label)
+	if level == nil {
+		return nil, errors.New("unknown level " + label)
+	}
+
+	segment, ok := level.Segments[nodeId]
+	if !ok {
+		return []float64{}, nil
+	}
+
+	f, err := os.Open(d.levelPath(label))
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, segment.Length * 8)
+	_, err = f.ReadAt(buf, segment.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return spill.DecodePoints(buf), nil
+}
+
+// EachSegment reads a level back one node at a time, in the order it was written.
+func (d *Dataset) EachSegment(label string, fn func(nodeId string, points []float64)) error {
+	level := d.Level(label)
+	if level == nil {
+		return errors.New("unknown level " + label)
+	}
+
+	for _, nodeId := range level.Order {
+		points, err := d.ReadSegment(label, nodeId)
+		if err != nil {
+			return err
+		}
+
+		fn(nodeId, points)
+	}
+
+	return nil
+}
+
+// EachSegmentWithin is EachSegment limited to the nodes whose bounds meet
+// the box from min to max, in real-world easting and northing.
+func (d *Dataset) EachSegmentWithin(label string, min, max [2]float64, fn func(nodeId string, points []float64)) error {
+	level := d.Level(label)
+	if level == nil {
+		return errors.New("unknown level " + label)
+	}
+
+	bounds := make(map[string]Node, len(d.Info.Nodes))
+	for _, node := range d.Info.Nodes {
+		bounds[node.Id] = node
+	}
+
+	offset := d.Info.Headers.Offset
+
+	for _, nodeId := range level.Order {
+		node, ok := bounds[nodeId]
+		if ok && (node.X2 + offset[0] < min[0] || node.X1 + offset[0] > max[0] ||
+		node.Z2 + offset[1] < min[1] || node.Z1 + offset[1] > max[1]) {
+			continue
+		}
+
+		points, err := d.ReadSegment(label, nodeId)
+		if err != nil {
+			return err
+		}
+
+		fn(nodeId, points)
+	}
+
+	return nil
+}
+
+// ToRealWorld converts client vertices, x, y up and z, to easting and
+// northing pairs.
+func (d *Dataset) ToRealWorld(vertices [][]float64) ([][2]float64, error) {
+	m := d.Info.Metadata
+	offset := d.Info.Headers.Offset
+	res := make([][2]float64, len(vertices))
+
+	for i, v := range vertices {
+		if len(v) < 3 {
+			return nil, errors.New("vertices need x, y and z")
+		}
+
+		res[i] = [2]float64{v[0] - m.OffsetX + offset[0], v[2] - m.OffsetY + offset[1]}
+	}
+
+	return res, nil
+}
+
+func (d *Dataset) dimensionPath(label, name string) string {
+	return filepath.Join(d.Dir, label + "." + name + ".bin")
+}
+
+// WriteDimensions computes extra dimensions for every node of a stored
+// level, one node at a time, and writes each dimension's values beside the
+// level. compute returns the values of every named dimension for a node.
+func (d *Dataset) WriteDimensions(label string, names []string, compute func(nodeId string, points []float64) map[string][]float64) error {
+	level := d.Level(label)
+	if level == nil {
+		return errors.New("unknown level " + label)
+	}
+
+	writers := make([]*bufio.Writer, len(names))
+	for i, name := range names {
+		f, err := os.Create(d.dimensionPath(label, name))
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		writers[i] = bufio.NewWriter(f)
+	}
+
+	segments := make([]map[string]Segment, len(names))
+	offsets := make([]int64, len(names))
+	for i := range segments {
+		segments[i] = map[string]Segment{}
+	}
+
+	var err error
+	walkErr := d.EachSegment(label, func(nodeId string, points []float64) {
+		if err != nil {
+			return
+		}
+
+		values := compute(nodeId, points)
+		for i, name := range names {
+			err = spill.WritePoints(writers[i], values[name])
+			if err != nil {
+				return
+			}
+
+			segments[i][nodeId] = Segment{
+				Offset: offsets[i],
+				Length: len(values[name]),
+			}
+			offsets[i] += int64(len(values[name]) * 8)
+		}
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, w := range writers {
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	if level.Dimensions == nil {
+		level.Dimensions = map[string]map[string]Segment{}
+	}
+
+	for i, name := range names {
+		level.Dimensions[name] = segments[i]
+
+		known := false
+		for _, existing := range d.Info.Dimensions {
+			if existing == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			d.Info.Dimensions = append(d.Info.Dimensions, name)
+		}
+	}
+
+	return nil
+}
+
+// ReadDimensions returns a node's values of every dimension stored for a
+// level, or nil when the level has none.
+func (d *Dataset) ReadDimensions(label, nodeId string) (map[string][]float64, error) {
+	level := d.Level(label)
+	if level == nil {
+		return nil, errors.New("unknown level " + label)
+	}
+
+	if len(level.Dimensions) == 0 {
+		return nil, nil
+	}
+
+	values := make(map[string][]float64, len(level.Dimensions))
+
+	for name, segments := range level.Dimensions {
+		segment, ok := segments[nodeId]
+		if !ok {
+			values[name] = []float64{}
+			continue
+		}
+
+		f, err := os.Open(d.dimensionPath(label, name))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, segment.Length * 8)
+		_, err = f.ReadAt(buf, segment.Offset)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		values[name] = spill.DecodePoints(buf)
+	}
+
+	return values, nil
+}
+
+func (d *Dataset) Save() error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	buf, err := json.Marshal(d.Info)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(d.Dir, infoFile), buf, 0644)
+}
+
+// WriteJSON stores a JSON document alongside the dataset, such as a report.
+func (d *Dataset) WriteJSON(name string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(d.Dir, name), buf, 0644)
+}
+
+func (d *Dataset) ReadFile(name string) ([]byte, error) {
+	if filepath.Base(name) != name {
+		return nil, errors.New("invalid file name")
+	}
+
+	return os.ReadFile(filepath.Join(d.Dir, name))
+}
+
+// WriteArtifact stores a downloadable product of the job, such as a raster,
+// passing write the file to fill.
+func (d *Dataset) WriteArtifact(name string, write func(w io.Writer) error) error {
+	path, err := d.ArtifactPath(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return write(f)
+}
+
+func (d *Dataset) ArtifactPath(name string) (string, error) {
+	if name == "" || filepath.Base(name) != name {
+		return "", errors.New("invalid artifact name")
+	}
+
+	return filepath.Join(d.Dir, artifactDir, name), nil
+}
+
+// Artifacts lists the names of the dataset's artifacts.
+func (d *Dataset) Artifacts() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(d.Dir, artifactDir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			res = append(res, entry.Name())
+		}
+	}
+
+	return res, nil
+}
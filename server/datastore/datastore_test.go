@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"testing"
+
+	"lidar/octree"
+	"lidar/structs"
+)
+
+// corners stores one point in each of two far apart leaves.
+func corners(t *testing.T) *Dataset {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := &structs.LASHeaders{Offset: []float64{1000, 2000, 0}}
+	metadata := &structs.LASMetaData{OffsetX: -10, OffsetY: -20}
+	dataset, err := store.Create("corners", headers, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := octree.GenerateOctree(&octree.OctreeDimensions{
+		X1: 0, X2: 80,
+		Y1: 0, Y2: 80,
+		Z1: 0, Z2: 80,
+		Granularity: 3,
+	})
+	octree.AddPoint(1, 1, 1, 0, 0, 0, 0, 2, 0, o.Granularity, o.Root, o)
+	octree.AddPoint(75, 1, 75, 0, 0, 0, 0, 2, 0, o.Granularity, o.Root, o)
+
+	err = dataset.WriteLevel("leaf", 0, 0, o.Leaves, o.ReadPoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dataset
+}
+
+func TestEachSegmentWithinSkipsDistantNodes(t *testing.T) {
+	dataset := corners(t)
+
+	read := 0
+	points := 0
+	err := dataset.EachSegmentWithin("leaf", [2]float64{1000, 2000}, [2]float64{1005, 2005}, func(nodeId string, p []float64) {
+		read++
+		points += len(p) / 8
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read != 1 || points != 1 {
+		t.Fatalf("read %d nodes with %d points, want the 1 node holding 1 point", read, points)
+	}
+}
+
+func TestToRealWorld(t *testing.T) {
+	dataset := corners(t)
+
+	// Client coordinates add the metadata offsets to the stored points, and
+	// real-world ones add the header's.
+	line, err := dataset.ToRealWorld([][]float64{{-9, 0, -19}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line[0] != [2]float64{1001, 2001} {
+		t.Fatalf("got %v, want [1001 2001]", line[0])
+	}
+
+	_, err = dataset.ToRealWorld([][]float64{{1, 2}})
+	if err == nil {
+		t.Fatal("expected an error for a vertex without z")
+	}
+}
@@ -0,0 +1,192 @@
+package diagnostics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"lidar/metrics"
+	"lidar/octree"
+	"lidar/structs"
+
+	"github.com/puzpuzpuz/xsync"
+)
+
+// Tracker collects point counts and timings for the stages of one job.
+// Timings is handed to the job's clustering so concurrent jobs keep their
+// times apart.
+type Tracker struct {
+	Mutex sync.Mutex
+	Timings *xsync.Map
+	stages []structs.StageReport
+	structure *structs.OctreeReport
+	simplification *structs.SimplificationReport
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		Timings: xsync.NewMap(),
+		stages: []structs.StageReport{},
+	}
+}
+
+// Stage records how many points went into and came out of a stage, and how
+// long it has taken since start.
+func (t *Tracker) Stage(name string, pointsIn, pointsOut int, start time.Time) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	t.stages = append(t.stages, structs.StageReport{
+		Name: name,
+		PointsIn: pointsIn,
+		PointsOut: pointsOut,
+		Milliseconds: time.Since(start).Milliseconds(),
+	})
+}
+
+// Count records a figure of a stage other than its points in and out, such
+// as how many points it classified as ground.
+func (t *Tracker) Count(stage, name string, value int) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	for i := len(t.stages) - 1; i >= 0; i-- {
+		if t.stages[i].Name != stage {
+			continue
+		}
+
+		if t.stages[i].Counts == nil {
+			t.stages[i].Counts = map[string]int{}
+		}
+		t.stages[i].Counts[name] = value
+		return
+	}
+}
+
+// Octree snapshots the spatial structure of a tree. It should be called once
+// the points have been inserted, before clustering replaces them.
+func (t *Tracker) Octree(o *octree.Octree) {
+	levels := make([]int, o.Granularity + 1)
+	countNodes(o.Root, 0, levels)
+
+	counts := make([]int, len(o.Leaves))
+	for i, leaf := range o.Leaves {
+		counts[i] = o.PointCount(leaf)
+	}
+	sort.Ints(counts)
+
+	report := &structs.OctreeReport{
+		Depth: o.Granularity,
+		NodesPerLevel: levels,
+		LeafCount: len(o.Leaves),
+		LeafOccupancy: occupancyHistogram(counts),
+		EmptySpaceRatio: 1 - float64(len(o.Leaves)) / math.Pow(8, float64(o.Granularity)),
+	}
+
+	if len(counts) > 0 {
+		report.MinPointsPerLeaf = counts[0]
+		report.MedianPointsPerLeaf = counts[len(counts) / 2]
+		report.MaxPointsPerLeaf = counts[len(counts) - 1]
+	}
+
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	t.structure = report
+}
+
+// Simplification records the error the clustering stage introduced, overall
+// and per leaf.
+func (t *Tracker) Simplification(collector *metrics.Collector) {
+	job := collector.Summary()
+	leaves := collector.Nodes()
+
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	if t.simplification == nil {
+		t.simplification = &structs.SimplificationReport{
+			Levels: []structs.LevelError{},
+		}
+	}
+	t.simplification.Job = job
+	t.simplification.Leaves = leaves
+}
+
+// Level records the error of one LOD level against the level below it.
+func (t *Tracker) Level(label string, collector *metrics.Collector) {
+	summary := collector.Summary()
+
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	if t.simplification == nil {
+		t.simplification = &structs.SimplificationReport{
+			Levels: []structs.LevelError{},
+		}
+	}
+	t.simplification.Levels = append(t.simplification.Levels, structs.LevelError{
+		Label: label,
+		ErrorMetrics: summary,
+	})
+}
+
+func (t *Tracker) Report(datasetId string) structs.DiagnosticsReport {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	timings := map[string]int64{}
+	t.Timings.Range(func(key string, value interface{}) bool {
+		timings[key] = value.(int64)
+		return true
+	})
+
+	stages := make([]structs.StageReport, len(t.stages))
+	copy(stages, t.stages)
+
+	return structs.DiagnosticsReport{
+		Event: "diagnostics",
+		DatasetId: datasetId,
+		Octree: t.structure,
+		Stages: stages,
+		ClusteringTimings: timings,
+		Simplification: t.simplification,
+	}
+}
+
+func countNodes(node *octree.OctreeNode, depth int, levels []int) {
+	if node == nil || depth >= len(levels) {
+		return
+	}
+
+	levels[depth]++
+
+	for _, child := range node.Children {
+		if child.Active {
+			countNodes(child, depth + 1, levels)
+		}
+	}
+}
+
+// occupancyHistogram buckets sorted leaf point counts into powers of two.
+func occupancyHistogram(counts []int) []structs.HistogramBucket {
+	buckets := []structs.HistogramBucket{}
+
+	for _, count := range counts {
+		if len(buckets) == 0 || count > buckets[len(buckets) - 1].Max {
+			min, max := 0, 0
+			for max < count {
+				min = max + 1
+				max = max * 2 + 1
+			}
+			buckets = append(buckets, structs.HistogramBucket{
+				Min: min,
+				Max: max,
+			})
+		}
+
+		buckets[len(buckets) - 1].Count++
+	}
+
+	return buckets
+}
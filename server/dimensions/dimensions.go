@@ -0,0 +1,265 @@
+package dimensions
+
+import (
+	"math"
+	"sync"
+
+	c "lidar/constants"
+	"lidar/raster"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+const HeightAboveGround string = "HeightAboveGround"
+
+// Dimension is an extra value for every point, carried alongside the points
+// rather than inside them so the point layout stays the same. Compute gets
+// a node's points and the points around them, neither of which it may
+// modify, and returns one value per point of the node. around holds the
+// points of the neighbouring nodes when the dimension asks for Context, and
+// may be nil otherwise.
+type Dimension struct {
+	Name string
+	Compute func(points, around []float64) []float64
+	Group *Group
+	Context bool
+}
+
+// Group computes several dimensions that come from the same work, such as
+// the parts of a normal, returning their values by name. A group that looks
+// at context can also offer Prepare, which does the shared work once over
+// every point of a level, such as building a search tree, and returns how to
+// compute any node's values from it without the points around them.
+type Group struct {
+	Compute func(points, around []float64) map[string][]float64
+	Prepare func(all []float64) func(points []float64) map[string][]float64
+	Context bool
+}
+
+// Grouped returns a dimension for each name that group computes. Each one
+// can be computed alone, but a set computes their group once for all of
+// them.
+func Grouped(names []string, group *Group) []Dimension {
+	res := make([]Dimension, len(names))
+	for i, name := range names {
+		name := name
+		res[i] = Dimension{
+			Name: name,
+			Compute: func(points, around []float64) []float64 {
+				return group.Compute(points, around)[name]
+			},
+			Group: group,
+			Context: group.Context,
+		}
+	}
+
+	return res
+}
+
+type Set []Dimension
+
+// Compute returns every dimension's values for points, or nil for an empty
+// set so that chunks without dimensions leave them out.
+func (s Set) Compute(points, around []float64) map[string][]float64 {
+	if len(s) == 0 {
+		return nil
+	}
+
+	values := make(map[string][]float64, len(s))
+	groups := map[*Group]map[string][]float64{}
+	for _, d := range s {
+		if d.Group == nil {
+			values[d.Name] = d.Compute(points, around)
+			continue
+		}
+
+		grouped, ok := groups[d.Group]
+		if !ok {
+			grouped = d.Group.Compute(points, around)
+			groups[d.Group] = grouped
+		}
+		values[d.Name] = grouped[d.Name]
+	}
+
+	return values
+}
+
+// Prepare returns the set with every group that offers it prepared over all,
+// which must hold the points of every node the set will compute along with
+// any points around them. all must not change while the set is in use.
+func (s Set) Prepare(all []float64) Set {
+	res := make(Set, len(s))
+	prepared := map[*Group]*Group{}
+
+	for i, d := range s {
+		res[i] = d
+		if d.Group == nil || d.Group.Prepare == nil {
+			continue
+		}
+
+		group, ok := prepared[d.Group]
+		if !ok {
+			compute := d.Group.Prepare(all)
+			group = &Group{
+				Compute: func(points, around []float64) map[string][]float64 {
+					return compute(points)
+				},
+			}
+			prepared[d.Group] = group
+		}
+
+		name := d.Name
+		res[i] = Dimension{
+			Name: name,
+			Compute: func(points, around []float64) []float64 {
+				return group.Compute(points, around)[name]
+			},
+			Group: group,
+		}
+	}
+
+	return res
+}
+
+// Context reports whether any of the set's dimensions look at the points
+// around a node's.
+func (s Set) Context() bool {
+	for _, d := range s {
+		if d.Context {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s Set) Names() []string {
+	names := make([]string, len(s))
+	for i, d := range s {
+		names[i] = d.Name
+	}
+
+	return names
+}
+
+// HeightAboveGroundOf measures each point's elevation above a ground surface
+// such as a DTM, sampled between cell centres.
+func HeightAboveGroundOf(surface *raster.Grid) Dimension {
+	return Dimension{
+		Name: HeightAboveGround,
+		Compute: func(points, around []float64) []float64 {
+			res := make([]float64, len(points) / pointOffset)
+			for i := range res {
+				p := points[i * pointOffset:]
+				ground := surface.Sample(p[0], p[2])
+				if math.IsNaN(ground) {
+					ground = p[1]
+				}
+				res[i] = p[1] - ground
+			}
+
+			return res
+		},
+	}
+}
+
+// Cache keeps the values computed for each node of each level, so that
+// points sent as they are computed can be stored without computing them
+// again.
+type Cache struct {
+	Mutex sync.Mutex
+	values map[string]map[string]map[string][]float64
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		values: map[string]map[string]map[string][]float64{},
+	}
+}
+
+func (c *Cache) Store(label, nodeId string, values map[string][]float64) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if c.values[label] == nil {
+		c.values[label] = map[string]map[string][]float64{}
+	}
+	c.values[label][nodeId] = values
+}
+
+func (c *Cache) Load(label, nodeId string) (map[string][]float64, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	values, ok := c.values[label][nodeId]
+	return values, ok
+}
+
+// Slice returns the values of the points from index from up to to.
+func Slice(values map[string][]float64, from, to int) map[string][]float64 {
+	if values == nil {
+		return nil
+	}
+
+	res := make(map[string][]float64, len(values))
+	for name, v := range values {
+		res[name] = v[from:to]
+	}
+
+	return res
+}
+
+// Append adds src's values to the end of dst's, returning the result.
+func Append(dst, src map[string][]float64) map[string][]float64 {
+	if src == nil {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string][]float64, len(src))
+	}
+
+	for name, v := range src {
+		dst[name] = append(dst[name], v...)
+	}
+
+	return dst
+}
+
+// Filter keeps the points whose values lie within every range. A range on
+// a dimension the points don't have keeps nothing. points and values are
+// never modified.
+func Filter(points []float64, values map[string][]float64, ranges []structs.DimensionRange) ([]float64, map[string][]float64) {
+	if len(ranges) == 0 {
+		return points, values
+	}
+
+	n := len(points) / pointOffset
+	kept := []float64{}
+	keptValues := map[string][]float64{}
+	for name := range values {
+		keptValues[name] = []float64{}
+	}
+
+	for i := 0; i < n; i++ {
+		keep := true
+		for _, r := range ranges {
+			v, ok := values[r.Dimension]
+			if !ok || v[i] < r.Min || v[i] > r.Max {
+				keep = false
+				break
+			}
+		}
+
+		if !keep {
+			continue
+		}
+
+		kept = append(kept, points[i * pointOffset : (i + 1) * pointOffset]...)
+		for name, v := range values {
+			keptValues[name] = append(keptValues[name], v[i])
+		}
+	}
+
+	return kept, keptValues
+}
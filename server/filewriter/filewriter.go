@@ -1,6 +1,7 @@
 package filewriter
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"lidar/octree"
@@ -12,13 +13,9 @@ import (
 	"github.com/google/uuid"
 )
 
-func CreateOptimisedFile(socket *structs.ConcurrentSocket, parts []*structs.FilePart, nodes []*octree.OctreeNode, header *structs.LASHeaders) {
-	points := []float64{}
-
-	for _, node := range nodes {
-		points = append(points, node.Points...)
-	}
-
+// CreateOptimisedFile writes the octree's leaves out as a LAS file and returns
+// the number of points written.
+func CreateOptimisedFile(socket *structs.ConcurrentSocket, parts []*structs.FilePart, o *octree.Octree, header *structs.LASHeaders) int {
 	byteParts := make([]byte, header.PointOffset)
 	var total int64 = 0 
 
@@ -42,64 +39,95 @@ func CreateOptimisedFile(socket *structs.ConcurrentSocket, parts []*structs.File
 
 	defer f.Close()
 
+	// A short write leaves a LAS file whose header doesn't match its points,
+	// so the file is removed rather than offered for download.
+	fail := func(err error) int {
+		log.Println(err)
+		os.Remove("." + path)
+		return 0
+	}
+
 	headerBuff := byteParts
 
 	pointCountOffset := 32 * 3 + 11
 
 	structSize := int(header.StructSize)
-	pointBuff := []byte{}
 
 	scaleX, scaleY, scaleZ := header.Scale[0], header.Scale[1], header.Scale[2]
 
-	fmt.Println("POINTS LENGTH = ", len(points) / c.PointOffset)
-
-	for i := 0; i < len(points); i += c.PointOffset {
-		if points[i] < header.MinimumBounds[0] ||
-		points[i + 1] < header.MinimumBounds[2] ||
-		points[i + 2] < header.MinimumBounds[1] {
-			continue
-		}
-
-		x, y, z, intensity := 
-		int32ToBytes(int32(points[i] / scaleX)), 
-		int32ToBytes(int32(points[i + 1] / scaleY)), 
-		int32ToBytes(int32(points[i + 2] / scaleZ)), 
-		uint16ToBytes(uint16(points[i + 6]))
-
-		pointChunk := make([]byte, structSize)
-
-		pointChunk[0] = x[0]
-		pointChunk[1] = x[1]
-		pointChunk[2] = x[2]
-		pointChunk[3] = x[3]
-
-		pointChunk[4] = z[0]
-		pointChunk[5] = z[1]
-		pointChunk[6] = z[2]
-		pointChunk[7] = z[3]
-
-		pointChunk[8] = y[0]
-		pointChunk[9] = y[1]
-		pointChunk[10] = y[2]
-		pointChunk[11] = y[3]
+	// Points are streamed leaf by leaf so that out-of-core trees never have to
+	// be held in memory; the point count is patched into the header at the end.
+	w := bufio.NewWriter(f)
+	_, err = w.Write(headerBuff)
+	if err != nil {
+		return fail(err)
+	}
 
-		pointChunk[12] = intensity[0]
-		pointChunk[13] = intensity[1]
+	pointChunk := make([]byte, structSize)
+	pointCount := 0
 
-		pointChunk[15] = 2
+	for _, node := range o.Leaves {
+		points, err := o.ReadPoints(node)
+		if err != nil {
+			return fail(err)
+		}
 
-		pointBuff = append(pointBuff, pointChunk...)
+		for i := 0; i < len(points); i += c.PointOffset {
+			if points[i] + header.Offset[0] < header.MinimumBounds[0] ||
+			points[i + 1] + header.Offset[2] < header.MinimumBounds[2] ||
+			points[i + 2] + header.Offset[1] < header.MinimumBounds[1] {
+				continue
+			}
+
+			x, y, z, intensity := 
+			int32ToBytes(int32(points[i] / scaleX)), 
+			int32ToBytes(int32(points[i + 1] / scaleY)), 
+			int32ToBytes(int32(points[i + 2] / scaleZ)), 
+			uint16ToBytes(uint16(points[i + 6]))
+
+			for j := range pointChunk {
+				pointChunk[j] = 0
+			}
+
+			pointChunk[0] = x[0]
+			pointChunk[1] = x[1]
+			pointChunk[2] = x[2]
+			pointChunk[3] = x[3]
+
+			pointChunk[4] = z[0]
+			pointChunk[5] = z[1]
+			pointChunk[6] = z[2]
+			pointChunk[7] = z[3]
+
+			pointChunk[8] = y[0]
+			pointChunk[9] = y[1]
+			pointChunk[10] = y[2]
+			pointChunk[11] = y[3]
+
+			pointChunk[12] = intensity[0]
+			pointChunk[13] = intensity[1]
+
+			pointChunk[15] = uint8(points[i + 7])
+
+			_, err = w.Write(pointChunk)
+			if err != nil {
+				return fail(err)
+			}
+			pointCount++
+		}
 	}
 
-	pointCountBytes := uint32ToBytes(uint32(len(pointBuff) / structSize))
-	headerBuff[pointCountOffset] = pointCountBytes[0]
-	headerBuff[pointCountOffset + 1] = pointCountBytes[1]
-	headerBuff[pointCountOffset + 2] = pointCountBytes[2]
-	headerBuff[pointCountOffset + 3] = pointCountBytes[3]
+	fmt.Println("POINTS LENGTH = ", pointCount)
 
-	headerBuff = append(headerBuff, pointBuff...)
+	err = w.Flush()
+	if err != nil {
+		return fail(err)
+	}
 
-	f.Write(headerBuff)
+	_, err = f.WriteAt(uint32ToBytes(uint32(pointCount)), int64(pointCountOffset))
+	if err != nil {
+		return fail(err)
+	}
 
 	socket.Lock.Lock()
 	socket.Conn.WriteJSON(structs.FileReadyEvent{
@@ -107,6 +135,8 @@ func CreateOptimisedFile(socket *structs.ConcurrentSocket, parts []*structs.File
 		FilePath: "http://localhost:8080" + path,
 	})
 	socket.Lock.Unlock()
+
+	return pointCount
 } 
 
 func maxInt32(a, b int32) int32 {
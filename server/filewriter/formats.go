@@ -0,0 +1,127 @@
+package filewriter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	c "lidar/constants"
+	"lidar/structs"
+)
+
+// Source visits a cloud a node at a time, passing each node's points with
+// their values of every extra dimension.
+type Source func(visit func(points []float64, values map[string][]float64)) error
+
+// WriteCSV writes one row per point in real-world coordinates, followed by a
+// column for each named dimension.
+func WriteCSV(w io.Writer, source Source, names []string, header *structs.LASHeaders) error {
+	bw := bufio.NewWriter(w)
+
+	columns := append([]string{"x", "y", "z", "red", "green", "blue", "intensity", "classification"}, names...)
+	fmt.Fprintln(bw, strings.Join(columns, ","))
+
+	row := make([]string, len(columns))
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	err := source(func(points []float64, values map[string][]float64) {
+		for i := 0; i < len(points) / c.PointOffset; i++ {
+			p := points[i * c.PointOffset:]
+			row[0] = format(p[0] + header.Offset[0])
+			row[1] = format(p[2] + header.Offset[1])
+			row[2] = format(p[1] + header.Offset[2])
+			for j := 3; j < c.PointOffset; j++ {
+				row[j] = format(p[j])
+			}
+
+			for j, name := range names {
+				v, ok := values[name]
+				if ok && i < len(v) {
+					row[c.PointOffset + j] = format(v[i])
+				} else {
+					row[c.PointOffset + j] = ""
+				}
+			}
+
+			fmt.Fprintln(bw, strings.Join(row, ","))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// WritePLY writes count points as binary little endian PLY vertices in
+// real-world coordinates, with a float property for each named dimension.
+// Points without a value of a dimension get NaN.
+func WritePLY(w io.Writer, source Source, count int, names []string, header *structs.LASHeaders) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "ply")
+	fmt.Fprintln(bw, "format binary_little_endian 1.0")
+	fmt.Fprintf(bw, "element vertex %d\n", count)
+	fmt.Fprintln(bw, "property double x")
+	fmt.Fprintln(bw, "property double y")
+	fmt.Fprintln(bw, "property double z")
+	fmt.Fprintln(bw, "property uchar red")
+	fmt.Fprintln(bw, "property uchar green")
+	fmt.Fprintln(bw, "property uchar blue")
+	fmt.Fprintln(bw, "property ushort intensity")
+	fmt.Fprintln(bw, "property uchar classification")
+	for _, name := range names {
+		fmt.Fprintf(bw, "property float %s\n", name)
+	}
+	fmt.Fprintln(bw, "end_header")
+
+	colour := func(v float64) byte {
+		return byte(math.Max(0, math.Min(255, math.Round(v * 255))))
+	}
+
+	written := 0
+	buf := make([]byte, 8)
+
+	err := source(func(points []float64, values map[string][]float64) {
+		for i := 0; i < len(points) / c.PointOffset && written < count; i++ {
+			p := points[i * c.PointOffset:]
+
+			for _, v := range []float64{p[0] + header.Offset[0], p[2] + header.Offset[1], p[1] + header.Offset[2]} {
+				binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+				bw.Write(buf)
+			}
+
+			bw.Write([]byte{colour(p[3]), colour(p[4]), colour(p[5])})
+			bw.Write(uint16ToBytes(uint16(p[6])))
+			bw.WriteByte(byte(p[7]))
+
+			for _, name := range names {
+				value := math.NaN()
+				v, ok := values[name]
+				if ok && i < len(v) {
+					value = v[i]
+				}
+
+				binary.LittleEndian.PutUint32(buf, math.Float32bits(float32(value)))
+				bw.Write(buf[:4])
+			}
+
+			written++
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if written < count {
+		return fmt.Errorf("wrote %d of %d points", written, count)
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,128 @@
+package geometry
+
+import (
+	"math"
+
+	c "lidar/constants"
+)
+
+var pointOffset int = c.PointOffset
+
+// Covariance returns the mean position of points and their 3x3 covariance.
+func Covariance(points []float64) ([3]float64, [3][3]float64) {
+	var mean [3]float64
+	var cov [3][3]float64
+
+	n := float64(len(points) / pointOffset)
+	if n == 0 {
+		return mean, cov
+	}
+
+	for i := 0; i < len(points); i += pointOffset {
+		mean[0] += points[i]
+		mean[1] += points[i + 1]
+		mean[2] += points[i + 2]
+	}
+
+	for i := 0; i < 3; i++ {
+		mean[i] /= n
+	}
+
+	for i := 0; i < len(points); i += pointOffset {
+		d := [3]float64{points[i] - mean[0], points[i + 1] - mean[1], points[i + 2] - mean[2]}
+		for j := 0; j < 3; j++ {
+			for k := j; k < 3; k++ {
+				cov[j][k] += d[j] * d[k]
+			}
+		}
+	}
+
+	for j := 0; j < 3; j++ {
+		for k := j; k < 3; k++ {
+			cov[j][k] /= n
+			cov[k][j] = cov[j][k]
+		}
+	}
+
+	return mean, cov
+}
+
+// SymmetricEigen decomposes a symmetric 3x3 matrix with Jacobi rotations.
+// Eigenvalues are returned in ascending order, with the matching unit
+// eigenvectors as the rows of vectors.
+func SymmetricEigen(m [3][3]float64) ([3]float64, [3][3]float64) {
+	a := m
+	v := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+	for sweep := 0; sweep < 50; sweep++ {
+		off := a[0][1] * a[0][1] + a[0][2] * a[0][2] + a[1][2] * a[1][2]
+		if off < 1e-30 {
+			break
+		}
+
+		for p := 0; p < 2; p++ {
+			for q := p + 1; q < 3; q++ {
+				if math.Abs(a[p][q]) < 1e-300 {
+					continue
+				}
+
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := 1 / (math.Abs(theta) + math.Sqrt(theta * theta + 1))
+				if theta < 0 {
+					t = -t
+				}
+				cs := 1 / math.Sqrt(t * t + 1)
+				sn := t * cs
+
+				for k := 0; k < 3; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p] = cs * akp - sn * akq
+					a[k][q] = sn * akp + cs * akq
+				}
+				for k := 0; k < 3; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k] = cs * apk - sn * aqk
+					a[q][k] = sn * apk + cs * aqk
+				}
+				for k := 0; k < 3; k++ {
+					vkp, vkq := v[k][p], v[k][q]
+					v[k][p] = cs * vkp - sn * vkq
+					v[k][q] = sn * vkp + cs * vkq
+				}
+			}
+		}
+	}
+
+	values := [3]float64{a[0][0], a[1][1], a[2][2]}
+	order := [3]int{0, 1, 2}
+	for i := 0; i < 3; i++ {
+		for j := i + 1; j < 3; j++ {
+			if values[order[j]] < values[order[i]] {
+				order[i], order[j] = order[j], order[i]
+			}
+		}
+	}
+
+	var sortedValues [3]float64
+	var vectors [3][3]float64
+	for i, k := range order {
+		sortedValues[i] = values[k]
+		vectors[i] = [3]float64{v[0][k], v[1][k], v[2][k]}
+	}
+
+	return sortedValues, vectors
+}
+
+// SurfaceVariation is the share of variance off the best fitting plane: zero
+// for flat patches, up to a third for scattered points.
+func SurfaceVariation(points []float64) float64 {
+	_, cov := Covariance(points)
+	values, _ := SymmetricEigen(cov)
+
+	total := values[0] + values[1] + values[2]
+	if total <= 0 {
+		return 0
+	}
+
+	return math.Max(values[0], 0) / total
+}
@@ -0,0 +1,93 @@
+package geometry
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSymmetricEigenDecomposes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for trial := 0; trial < 100; trial++ {
+		var m [3][3]float64
+		for a := 0; a < 3; a++ {
+			for b := a; b < 3; b++ {
+				m[a][b] = rng.NormFloat64()
+				m[b][a] = m[a][b]
+			}
+		}
+
+		values, vectors := SymmetricEigen(m)
+
+		for i := 0; i < 3; i++ {
+			if i > 0 && values[i] < values[i - 1] {
+				t.Fatalf("eigenvalues %v are not ascending", values)
+			}
+
+			// m v = λ v for each pair.
+			for a := 0; a < 3; a++ {
+				mv := 0.0
+				for b := 0; b < 3; b++ {
+					mv += m[a][b] * vectors[i][b]
+				}
+				if math.Abs(mv - values[i] * vectors[i][a]) > 1e-9 {
+					t.Fatalf("vector %v is not an eigenvector of %v for %f", vectors[i], m, values[i])
+				}
+			}
+
+			// The vectors are orthonormal.
+			for j := 0; j < 3; j++ {
+				d := 0.0
+				for a := 0; a < 3; a++ {
+					d += vectors[i][a] * vectors[j][a]
+				}
+
+				want := 0.0
+				if i == j {
+					want = 1
+				}
+				if math.Abs(d - want) > 1e-9 {
+					t.Fatalf("vectors %d and %d have a dot product of %f", i, j, d)
+				}
+			}
+		}
+	}
+}
+
+func TestSymmetricEigenOfDiagonal(t *testing.T) {
+	values, vectors := SymmetricEigen([3][3]float64{{3, 0, 0}, {0, 1, 0}, {0, 0, 2}})
+
+	if values != [3]float64{1, 2, 3} {
+		t.Fatalf("got eigenvalues %v, want [1 2 3]", values)
+	}
+	if math.Abs(vectors[0][1]) != 1 || math.Abs(vectors[2][0]) != 1 {
+		t.Fatalf("got eigenvectors %v, want the axes in order of value", vectors)
+	}
+}
+
+func TestCovarianceOfPlaneHasNormalFirst(t *testing.T) {
+	points := []float64{}
+	for x := 0.0; x < 10; x++ {
+		for z := 0.0; z < 10; z++ {
+			// The plane y = x / 2, whose normal is along (-1, 2, 0).
+			points = append(points, x, x / 2, z, 0, 0, 0, 0, 0)
+		}
+	}
+
+	_, cov := Covariance(points)
+	values, vectors := SymmetricEigen(cov)
+
+	if math.Abs(values[0]) > 1e-9 {
+		t.Fatalf("smallest eigenvalue is %f, want 0 for a plane", values[0])
+	}
+
+	normal := vectors[0]
+	cosine := math.Abs(-normal[0] + 2 * normal[1]) / math.Sqrt(5)
+	if math.Abs(cosine - 1) > 1e-9 {
+		t.Fatalf("normal %v is not along (-1, 2, 0)", normal)
+	}
+	if SurfaceVariation(points) > 1e-9 {
+		t.Fatalf("surface variation of a plane is %f", SurfaceVariation(points))
+	}
+}
@@ -0,0 +1,284 @@
+package ground
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	c "lidar/constants"
+	utils "lidar/loader_utils"
+	"lidar/octree"
+	"lidar/raster"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+const (
+	GroundClass float64 = 2
+	UnclassifiedClass float64 = 1
+	NeverClassified float64 = 0
+)
+
+// Config tunes the progressive morphological filter (Zhang et al., 2003).
+// The lowest point in each CellSize square forms a surface that is opened
+// with square windows growing up to MaxWindow across. A cell sticking up
+// from the opened surface by more than the threshold for that window is an
+// object, not terrain. Thresholds start at Threshold and grow with Slope
+// times the change in window size, up to MaxThreshold. Points within
+// Threshold of the final surface, above or below it, are ground. Only
+// never classified (0) and unclassified (1) points are relabelled unless
+// Overwrite is set.
+type Config struct {
+	CellSize float64
+	Slope float64
+	MaxWindow float64
+	Threshold float64
+	MaxThreshold float64
+	Overwrite bool
+}
+
+// FromOptions returns nil when the job has no ground classification.
+func FromOptions(options *structs.ProcessingOptions) *Config {
+	if options.Ground != "pmf" {
+		return nil
+	}
+
+	config := &Config{
+		CellSize: c.GroundCellSize,
+		Slope: c.GroundSlope,
+		MaxWindow: c.GroundMaxWindow,
+		Threshold: c.GroundThreshold,
+		MaxThreshold: c.GroundMaxThreshold,
+	}
+
+	parse := func(value string, field *float64) {
+		v, err := strconv.ParseFloat(value, 64)
+		if err == nil && v > 0 {
+			*field = v
+		}
+	}
+
+	parse(options.GroundCellSize, &config.CellSize)
+	parse(options.GroundSlope, &config.Slope)
+	parse(options.GroundMaxWindow, &config.MaxWindow)
+	parse(options.GroundThreshold, &config.Threshold)
+	parse(options.GroundMaxThreshold, &config.MaxThreshold)
+	config.Overwrite, _ = strconv.ParseBool(options.GroundOverwrite)
+
+	return config
+}
+
+// Classify marks the points in the tree as ground or not, reading and
+// rewriting one leaf at a time so out-of-core trees stay on disk. Colours
+// taken from the old classification are updated to match the new one.
+// It returns the number of ground points, counting those already labelled
+// ground that were left alone.
+func (config *Config) Classify(o *octree.Octree) int {
+	surface := config.Surface(o)
+	if surface == nil {
+		return 0
+	}
+
+	groundPoints := 0
+
+	for _, leaf := range o.Leaves {
+		points, err := o.ReadPoints(leaf)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		res := make([]float64, len(points))
+		copy(res, points)
+
+		for i := 0; i < len(res); i += pointOffset {
+			old := res[i + pointOffset - 1]
+			if !config.Overwrite && old != NeverClassified && old != UnclassifiedClass {
+				if old == GroundClass {
+					groundPoints++
+				}
+				continue
+			}
+
+			class := UnclassifiedClass
+			if math.Abs(res[i + 1] - surface.At(res[i], res[i + 2])) <= config.Threshold {
+				class = GroundClass
+				groundPoints++
+			}
+
+			recolour(res[i:], class)
+			res[i + pointOffset - 1] = class
+		}
+
+		o.ReplacePoints(leaf, res)
+	}
+
+	return groundPoints
+}
+
+// Surface returns the filtered bare earth surface of the tree's points, or
+// nil for an empty tree.
+func (config *Config) Surface(o *octree.Octree) *raster.Grid {
+	minimums := config.minimumGrid(o)
+	if minimums == nil {
+		return nil
+	}
+
+	fillEmpty(minimums)
+
+	surface := minimums.Values
+	opened := make([]float64, len(surface))
+	scratch := make([]float64, len(surface))
+
+	previous := 0.0
+	for k := 1; ; k++ {
+		window := float64(2 * k + 1) * config.CellSize
+		if window > config.MaxWindow && k > 1 {
+			break
+		}
+
+		threshold := config.Threshold
+		if k > 1 {
+			threshold = math.Min(config.Slope * (window - previous) + config.Threshold, config.MaxThreshold)
+		}
+		previous = window
+
+		copy(opened, surface)
+		filter(opened, scratch, minimums.Columns, minimums.Rows, k, math.Min)
+		filter(opened, scratch, minimums.Columns, minimums.Rows, k, math.Max)
+
+		// Cells that rise above the opening by more than the threshold are
+		// objects, so they take the opened elevation for the next window.
+		for i := range surface {
+			if surface[i] - opened[i] > threshold {
+				surface[i] = opened[i]
+			}
+		}
+	}
+
+	return minimums
+}
+
+// minimumGrid holds the lowest elevation in each cell, with NaN for cells
+// without points.
+func (config *Config) minimumGrid(o *octree.Octree) *raster.Grid {
+	minX, minZ := math.Inf(1), math.Inf(1)
+	maxX, maxZ := math.Inf(-1), math.Inf(-1)
+
+	for _, leaf := range o.Leaves {
+		points, err := o.ReadPoints(leaf)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		for i := 0; i < len(points); i += pointOffset {
+			minX, maxX = math.Min(minX, points[i]), math.Max(maxX, points[i])
+			minZ, maxZ = math.Min(minZ, points[i + 2]), math.Max(maxZ, points[i + 2])
+		}
+	}
+
+	if math.IsInf(minX, 1) {
+		return nil
+	}
+
+	g := raster.NewGrid(minX, minZ, maxX, maxZ, config.CellSize)
+	g.Elevation = true
+
+	for _, leaf := range o.Leaves {
+		points, err := o.ReadPoints(leaf)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		for i := 0; i < len(points); i += pointOffset {
+			j := g.Index(points[i], points[i + 2])
+			if math.IsNaN(g.Values[j]) || points[i + 1] < g.Values[j] {
+				g.Values[j] = points[i + 1]
+			}
+		}
+	}
+
+	return g
+}
+
+// fillEmpty gives each empty cell the value of its nearest filled cell,
+// spreading outwards from the filled cells a ring at a time.
+func fillEmpty(g *raster.Grid) {
+	queue := []int{}
+	for i, v := range g.Values {
+		if !math.IsNaN(v) {
+			queue = append(queue, i)
+		}
+	}
+
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		col, row := i % g.Columns, i / g.Columns
+
+		for _, d := range [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			c, r := col + d[0], row + d[1]
+			if c < 0 || r < 0 || c >= g.Columns || r >= g.Rows {
+				continue
+			}
+
+			j := r * g.Columns + c
+			if math.IsNaN(g.Values[j]) {
+				g.Values[j] = g.Values[i]
+				queue = append(queue, j)
+			}
+		}
+	}
+}
+
+// filter replaces each cell with op over the square of cells within radius
+// of it, in separate row and column passes.
+func filter(values, scratch []float64, columns, rows, radius int, op func(float64, float64) float64) {
+	for row := 0; row < rows; row++ {
+		for col := 0; col < columns; col++ {
+			v := values[row * columns + col]
+			for c := clamp(col - radius, 0, columns - 1); c <= clamp(col + radius, 0, columns - 1); c++ {
+				v = op(v, values[row * columns + c])
+			}
+			scratch[row * columns + col] = v
+		}
+	}
+
+	for row := 0; row < rows; row++ {
+		for col := 0; col < columns; col++ {
+			v := scratch[row * columns + col]
+			for r := clamp(row - radius, 0, rows - 1); r <= clamp(row + radius, 0, rows - 1); r++ {
+				v = op(v, scratch[r * columns + col])
+			}
+			values[row * columns + col] = v
+		}
+	}
+}
+
+// recolour swaps a point's colour for its new class's when the colour came
+// from the old classification rather than the file.
+func recolour(point []float64, class float64) {
+	old := uint8(point[pointOffset - 1])
+	for idx := 0; idx < 3; idx++ {
+		if point[3 + idx] != utils.DetermineColor(0, old, idx) {
+			return
+		}
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		point[3 + idx] = utils.DetermineColor(0, uint8(class), idx)
+	}
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
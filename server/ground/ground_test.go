@@ -0,0 +1,91 @@
+package ground
+
+import (
+	"testing"
+
+	"lidar/octree"
+)
+
+// site is flat ground with a 4 unit cube of building on it and one point of
+// the ground already labelled as building (6).
+func site(class float64) *octree.Octree {
+	o := octree.GenerateOctree(&octree.OctreeDimensions{
+		X1: 0, X2: 32,
+		Y1: 0, Y2: 32,
+		Z1: 0, Z2: 32,
+		Granularity: 3,
+	})
+
+	for x := 0.25; x < 32; x += 0.5 {
+		for z := 0.25; z < 32; z += 0.5 {
+			y := 1.0
+			if x > 14 && x < 18 && z > 14 && z < 18 {
+				y = 5
+			}
+			octree.AddPoint(x, y, z, 0, 0, 0, 0, class, 0, o.Granularity, o.Root, o)
+		}
+	}
+
+	octree.AddPoint(4.1, 1, 4.1, 0, 0, 0, 0, 6, 0, o.Granularity, o.Root, o)
+
+	return o
+}
+
+// classes counts the points of each class, and returns the class of the
+// point first labelled 6.
+func classes(o *octree.Octree) (map[float64]int, float64) {
+	counts := map[float64]int{}
+	marked := -1.0
+
+	for _, leaf := range o.Leaves {
+		points, _ := o.ReadPoints(leaf)
+		for i := 0; i < len(points); i += pointOffset {
+			class := points[i + pointOffset - 1]
+			counts[class]++
+			if points[i] == 4.1 && points[i + 2] == 4.1 {
+				marked = class
+			}
+		}
+	}
+
+	return counts, marked
+}
+
+func config() *Config {
+	return &Config{
+		CellSize: 1,
+		Slope: 0.3,
+		MaxWindow: 20,
+		Threshold: 0.5,
+		MaxThreshold: 3,
+	}
+}
+
+func TestClassifySeparatesGroundFromBuilding(t *testing.T) {
+	for _, class := range []float64{NeverClassified, UnclassifiedClass} {
+		o := site(class)
+		ground := config().Classify(o)
+
+		counts, marked := classes(o)
+		if counts[UnclassifiedClass] != 64 {
+			t.Errorf("starting from class %v, %d points are unclassified, want the building's 64", class, counts[UnclassifiedClass])
+		}
+		if ground != 64 * 64 - 64 || counts[GroundClass] != ground {
+			t.Errorf("starting from class %v, %d points are ground and %d counted, want %d", class, counts[GroundClass], ground, 64 * 64 - 64)
+		}
+		if marked != 6 {
+			t.Errorf("starting from class %v, the point labelled 6 became %v", class, marked)
+		}
+	}
+}
+
+func TestClassifyOverwrite(t *testing.T) {
+	o := site(UnclassifiedClass)
+	c := config()
+	c.Overwrite = true
+	c.Classify(o)
+
+	if _, marked := classes(o); marked != GroundClass {
+		t.Fatalf("the point labelled 6 became %v, want ground", marked)
+	}
+}
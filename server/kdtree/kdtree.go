@@ -18,7 +18,7 @@ type KDTreeNode struct {
 	WgtCenter []float64
 	RealCentroid []float64
 	Size int
-	CandidateSet []*MeansInstance
+	Payload interface{}
 }
 
 type MeansInstance struct {
@@ -27,17 +27,14 @@ type MeansInstance struct {
 	Count int
 }
 
+// InitMeansInstance starts an empty cluster around the candidate centroid
+// points. Filter compares candidates by points and gathers the points
+// assigned to each into WgtCenter and Count.
 func InitMeansInstance(dimension int, points []float64) *MeansInstance {
-	wgtCenter := make([]float64, dimension)
-
-	if points != nil && len(points) == dimension {
-		copy(wgtCenter, points)
-	}
-
 	return &MeansInstance{
-		WgtCenter: wgtCenter,
+		WgtCenter: make([]float64, dimension),
 		Data: points,
-		Count: 1,
+		Count: 0,
 	}
 }
 
@@ -49,9 +46,24 @@ func (ms *MeansInstance) AddTree(kd *KDTreeNode) {
 	ms.Count += kd.Count
 }
 
+func (ms *MeansInstance) AddPoint(point []float64) {
+	for i := 0; i < len(ms.WgtCenter); i++ {
+		ms.WgtCenter[i] += point[i]
+	}
+
+	ms.Count++
+}
+
+// GetRealPoints returns the mean of the points assigned to the candidate,
+// or the candidate itself when none were.
 func (ms *MeansInstance) GetRealPoints() []float64 {
 	res := make([]float64, len(ms.WgtCenter))
 
+	if ms.Count == 0 {
+		copy(res, ms.Data)
+		return res
+	}
+
 	for i := 0; i < len(res); i++ {
 		res[i] = ms.WgtCenter[i] / float64(ms.Count)
 	}
@@ -75,7 +87,7 @@ func (ms *MeansInstance) IsFurther(otherCentroid *MeansInstance, cells []*KDTree
 	}
 
 	candProd, boxProd := 0.0, 0.0
-	z, zStar := ms.GetRealPoints(), otherCentroid.GetRealPoints()
+	z, zStar := ms.Data, otherCentroid.Data
 	for i := 0; i < 3; i++ {
 		candCompare := z[i] - zStar[i]
 		candProd += candCompare * candCompare
@@ -179,21 +191,88 @@ func closestCandidate(medoidSet []*MeansInstance, meanTuple []float64) *MeansIns
 	return closest
 }
 
+// ConstructTree builds a balanced tree over points, splitting on axis at the
+// root. Nodes refer to the points in place rather than copying them, so
+// points must not change while the tree is in use.
 func ConstructTree(points []float64, axis int) (int, *KDTreeNode) {
-	if len(points) == 0 {		
-		return 0, nil
+	order := make([]int, len(points) / pointOffset)
+	for i := range order {
+		order[i] = i
+	}
+
+	return len(order), build(points, order, axis, nil)
+}
+
+// build selects the median of order along axis in place and recurses on the
+// halves either side, so each level costs linear time and the whole build
+// O(n log n), with no allocation beyond the nodes.
+func build(points []float64, order []int, axis int, payloads []interface{}) *KDTreeNode {
+	if len(order) == 0 {
+		return nil
 	}
-	points = mergeSort(points, func(i, j []float64) bool {
-		return i[axis] < j[axis]
-	})
 
-	next_axis := (axis + 1) % 3  
-	median := (len(points) / (2 * pointOffset)) * pointOffset
-	loc := points[median : median + pointOffset]
-	leftCount, left := ConstructTree(points[:median], next_axis)
-	rightCount, right := ConstructTree(points[median + pointOffset:], next_axis)
+	median := len(order) / 2
+	selectNth(points, order, axis, median)
+
+	next_axis := (axis + 1) % 3
+	i := order[median]
+	left := build(points, order[:median], next_axis, payloads)
+	right := build(points, order[median + 1:], next_axis, payloads)
 
-	return (leftCount + rightCount + 1), Init(loc, left, right, next_axis, leftCount + rightCount + 1)
+	node := Init(points[i * pointOffset : (i + 1) * pointOffset], left, right, axis, len(order))
+	if payloads != nil {
+		node.Payload = payloads[i]
+	}
+
+	return node
+}
+
+// selectNth reorders order so that the point at position nth has the value
+// along axis it would have if order were sorted, with no larger values
+// before it and no smaller ones after. Partitioning three ways keeps runs
+// of equal coordinates, common in quantised LAS data, from degrading it.
+func selectNth(points []float64, order []int, axis, nth int) {
+	key := func(i int) float64 {
+		return points[order[i] * pointOffset + axis]
+	}
+
+	lo, hi := 0, len(order) - 1
+	for lo < hi {
+		// Median of three keeps sorted input from hitting the worst case.
+		mid := lo + (hi - lo) / 2
+		a, b, c := key(lo), key(mid), key(hi)
+		pivot := b
+		if (a <= b) == (b <= c) {
+			pivot = b
+		} else if (b <= a) == (a <= c) {
+			pivot = a
+		} else {
+			pivot = c
+		}
+
+		lt, i, gt := lo, lo, hi
+		for i <= gt {
+			v := key(i)
+			if v < pivot {
+				order[lt], order[i] = order[i], order[lt]
+				lt++
+				i++
+			} else if v > pivot {
+				order[i], order[gt] = order[gt], order[i]
+				gt--
+			} else {
+				i++
+			}
+		}
+
+		if nth < lt {
+			hi = lt - 1
+		} else if nth > gt {
+			lo = gt + 1
+		} else {
+			return
+		}
+	}
 }
 
 func (kd *KDTreeNode) CopyTree() *KDTreeNode {
@@ -228,14 +307,15 @@ func InitKDStack(size, maxIter int) *KDStack {
 	}
 }
 
+// Push adds node to the top of the stack while it is below capacity.
 func (stack *KDStack) Push(node *KDTreeNode) {
-	if len(*stack.arr) >= stack.size {
+	if stack.size >= len(*stack.arr) {
 		return 
 	}
 
+	(*stack.arr)[stack.ptr] = node
 	stack.size++
 	stack.ptr++
-	(*stack.arr)[stack.ptr] = node
 }
 
 func (stack *KDStack) Pop() *KDTreeNode {
@@ -246,6 +326,7 @@ func (stack *KDStack) Pop() *KDTreeNode {
 	stack.size--
 	stack.ptr--
 	popped := (*stack.arr)[stack.ptr]
+	(*stack.arr)[stack.ptr] = nil
 	return popped
 }
 
@@ -253,10 +334,17 @@ func (stack *KDStack) IsEmpty() bool {
 	return stack.size == 0
 }
 
+// Filter assigns the tree's points to the nearest candidate centroids. The
+// candidates considered at each node are kept by the call rather than on the
+// nodes, so one tree can be filtered by many candidate sets at once.
 func (root *KDTreeNode) Filter(candidateCentroids []*MeansInstance) {
-	stack := InitKDStack(root.Size, 50)
+	// Every node is pushed at most once, so the tree's size bounds both the
+	// stack and the number of iterations.
+	stack := InitKDStack(root.Size, root.Size)
 	stack.Push(root)
-	root.CandidateSet = candidateCentroids
+	candidateSets := map[*KDTreeNode][]*MeansInstance{
+		root: candidateCentroids,
+	}
 
 	helper := func() {
 		for !stack.IsEmpty() && stack.curIter < stack.maxIter {
@@ -266,15 +354,13 @@ func (root *KDTreeNode) Filter(candidateCentroids []*MeansInstance) {
 			stack.mutex.Unlock()
 	
 			if kd.IsLeaf() {
-				zStar := closestCandidate(kd.CandidateSet, kd.RealCentroid)
+				zStar := closestCandidate(candidateSets[kd], kd.RealCentroid)
 				zStar.AddTree(kd)
-				kd.CandidateSet = []*MeansInstance{zStar}
-				// kd.CandidateCenters.Store(strconv.Itoa(threadID), []*MeansInstance{zStar})
 			} else {
-				zStar := closestCandidate(kd.CandidateSet, kd.RealCentroid)
+				zStar := closestCandidate(candidateSets[kd], kd.RealCentroid)
 				newCandidates := []*MeansInstance{}
 		
-				for _, z := range kd.CandidateSet {
+				for _, z := range candidateSets[kd] {
 					if !z.IsFurther(zStar, kd.GetChildNodes()) {
 						newCandidates = append(newCandidates, z)
 					}
@@ -283,17 +369,18 @@ func (root *KDTreeNode) Filter(candidateCentroids []*MeansInstance) {
 				if len(newCandidates) == 1 {
 					zStar.AddTree(kd)
 				} else {
+					// The node's own point is not in either child.
+					closestCandidate(newCandidates, kd.Data).AddPoint(kd.Data)
+
 					stack.mutex.Lock()
 					if kd.Left != nil {
-						// newCandidates
-						kd.Left.CandidateSet = newCandidates
+						candidateSets[kd.Left] = newCandidates
 						stack.Push(kd.Left)
 					}
 		
 					if kd.Right != nil {
-						kd.Right.CandidateSet = newCandidates
+						candidateSets[kd.Right] = newCandidates
 						stack.Push(kd.Right)
-						// kd.Right.Filter(newCandidates)
 					}
 					stack.mutex.Unlock()
 				}
@@ -301,78 +388,6 @@ func (root *KDTreeNode) Filter(candidateCentroids []*MeansInstance) {
 		}
 	}
 
-	go helper()
-	go helper()
-	go helper()
-	go helper()
-	go helper()
-}
-
-func mergeSort(items []float64, lambda func([]float64, []float64) bool) []float64 {
-    points := len(items) / pointOffset
-	
-    if points == 1 {
-        return items
-    }
-	
-    mid := (points / 2) * pointOffset
-	
-    return merge(mergeSort(items[:mid], lambda), mergeSort(items[mid:], lambda), lambda)
+	// A single pass keeps the traversal order, and so the result, repeatable.
+	helper()
 }
-
-func merge(left, right []float64, lambda func([]float64, []float64) bool) (result []float64) {
-    result = make([]float64, len(left) + len(right))
-
-    i, l, r := 0, 0, 0
-    for l < len(left) && r < len(right) {
-        if lambda(left[l : l + pointOffset], right[r : r + pointOffset]) {
-            result[i] = left[l]
-			result[i + 1] = left[l + 1]
-			result[i + 2] = left[l + 2]
-			result[i + 3] = left[l + 3]
-			result[i + 4] = left[l + 4]
-			result[i + 5] = left[l + 5]
-			result[i + 6] = left[l + 6]
-			result[i + 7] = left[l + 7]
-			l += pointOffset
-        } else {
-            result[i] = right[r]
-			result[i + 1] = right[r + 1]
-			result[i + 2] = right[r + 2]
-			result[i + 3] = right[r + 3]
-			result[i + 4] = right[r + 4]
-			result[i + 5] = right[r + 5]
-			result[i + 6] = right[r + 6]
-			result[i + 7] = right[r + 7]
-			r += pointOffset
-		}
-        i += pointOffset
-    }
-
-    for l < len(left) {
-		result[i] = left[l]
-		result[i + 1] = left[l + 1]
-		result[i + 2] = left[l + 2]
-		result[i + 3] = left[l + 3]
-		result[i + 4] = left[l + 4]
-		result[i + 5] = left[l + 5]
-		result[i + 6] = left[l + 6]
-		result[i + 7] = left[l + 7]
-        i += pointOffset
-		l += pointOffset
-    }
-
-	for r < len(right) {
-		result[i] = right[r]
-		result[i + 1] = right[r + 1]
-		result[i + 2] = right[r + 2]
-		result[i + 3] = right[r + 3]
-		result[i + 4] = right[r + 4]
-		result[i + 5] = right[r + 5]
-		result[i + 6] = right[r + 6]
-		result[i + 7] = right[r + 7]
-        i += pointOffset
-		r += pointOffset
-    }
-    return
-}
\ No newline at end of file
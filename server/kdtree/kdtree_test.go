@@ -0,0 +1,143 @@
+package kdtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// blobs returns n points scattered around each centre.
+func blobs(centres [][3]float64, n int, rng *rand.Rand) []float64 {
+	points := []float64{}
+	for _, centre := range centres {
+		for i := 0; i < n; i++ {
+			point := make([]float64, pointOffset)
+			for j := 0; j < 3; j++ {
+				point[j] = centre[j] + rng.NormFloat64()
+			}
+			points = append(points, point...)
+		}
+	}
+
+	return points
+}
+
+// lloyd assigns every point to its nearest centroid by brute force and
+// returns the mean of each cluster, keeping empty clusters where they were.
+func lloyd(points, centroids []float64) []float64 {
+	k := len(centroids) / pointOffset
+	sums := make([]float64, len(centroids))
+	counts := make([]int, k)
+
+	for i := 0; i < len(points); i += pointOffset {
+		best, bestDistance := 0, math.Inf(1)
+		for j := 0; j < k; j++ {
+			d := 0.0
+			for a := 0; a < 3; a++ {
+				diff := points[i + a] - centroids[j * pointOffset + a]
+				d += diff * diff
+			}
+			if d < bestDistance {
+				best, bestDistance = j, d
+			}
+		}
+
+		counts[best]++
+		for a := 0; a < pointOffset; a++ {
+			sums[best * pointOffset + a] += points[i + a]
+		}
+	}
+
+	res := make([]float64, len(centroids))
+	for j := 0; j < k; j++ {
+		for a := 0; a < pointOffset; a++ {
+			if counts[j] == 0 {
+				res[j * pointOffset + a] = centroids[j * pointOffset + a]
+			} else {
+				res[j * pointOffset + a] = sums[j * pointOffset + a] / float64(counts[j])
+			}
+		}
+	}
+
+	return res
+}
+
+func filter(tree *KDTreeNode, centroids []float64) []float64 {
+	candidates := []*MeansInstance{}
+	for i := 0; i < len(centroids); i += pointOffset {
+		candidates = append(candidates, InitMeansInstance(pointOffset, centroids[i : i + pointOffset]))
+	}
+
+	tree.Filter(candidates)
+
+	res := []float64{}
+	for _, candidate := range candidates {
+		res = append(res, candidate.GetRealPoints()...)
+	}
+
+	return res
+}
+
+func TestFilterMatchesLloyd(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := blobs([][3]float64{{0, 0, 0}, {10, 0, 0}, {0, 10, 5}, {8, 8, 8}}, 75, rng)
+	_, tree := ConstructTree(points, 0)
+
+	for _, k := range []int{1, 2, 4, 7} {
+		seeds := []float64{}
+		for _, i := range rng.Perm(len(points) / pointOffset)[:k] {
+			seeds = append(seeds, points[i * pointOffset : (i + 1) * pointOffset]...)
+		}
+
+		want, got := seeds, seeds
+		for iteration := 0; iteration < 10; iteration++ {
+			want, got = lloyd(points, want), filter(tree, got)
+
+			for i := range want {
+				if math.Abs(want[i] - got[i]) > 1e-9 {
+					t.Fatalf("k = %d, iteration %d: centroid value %d is %v, want %v", k, iteration, i, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestFilterCountsEveryPoint(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	points := blobs([][3]float64{{0, 0, 0}, {5, 5, 5}}, 200, rng)
+	_, tree := ConstructTree(points, 0)
+
+	candidates := []*MeansInstance{
+		InitMeansInstance(pointOffset, points[:pointOffset]),
+		InitMeansInstance(pointOffset, points[len(points) - pointOffset:]),
+	}
+	tree.Filter(candidates)
+
+	total := 0
+	for _, candidate := range candidates {
+		total += candidate.Count
+	}
+
+	if total != len(points) / pointOffset {
+		t.Fatalf("filter assigned %d points, want %d", total, len(points) / pointOffset)
+	}
+}
+
+func TestKDStack(t *testing.T) {
+	nodes := []*KDTreeNode{{Size: 1}, {Size: 2}, {Size: 3}}
+	stack := InitKDStack(2, 10)
+
+	for _, node := range nodes {
+		stack.Push(node)
+	}
+
+	if got := stack.Pop(); got != nodes[1] {
+		t.Fatalf("popped %v, want the last node pushed within capacity", got)
+	}
+	if got := stack.Pop(); got != nodes[0] {
+		t.Fatalf("popped %v, want the first node", got)
+	}
+	if !stack.IsEmpty() || stack.Pop() != nil {
+		t.Fatal("stack should be empty")
+	}
+}
@@ -0,0 +1,160 @@
+package kdtree
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// Neighbour is a point found by a search, with its squared distance from the
+// query and the payload it was stored with, if any.
+type Neighbour struct {
+	Point []float64
+	DistanceSquared float64
+	Payload interface{}
+}
+
+// ConstructTreeWithPayloads builds a tree like ConstructTree, storing
+// payloads[i] alongside the i-th point so searches can return attributes or
+// indices that are not part of the point record.
+func ConstructTreeWithPayloads(points []float64, payloads []interface{}) *KDTreeNode {
+	order := make([]int, len(points) / pointOffset)
+	for i := range order {
+		order[i] = i
+	}
+
+	return build(points, order, 0, payloads)
+}
+
+// Nearest returns the point in the tree closest to p, comparing positions
+// only. It reports false for an empty tree.
+func (kd *KDTreeNode) Nearest(p []float64) (Neighbour, bool) {
+	best := Neighbour{
+		DistanceSquared: math.Inf(1),
+	}
+
+	kd.nearest(p, &best)
+
+	return best, best.Point != nil
+}
+
+func (kd *KDTreeNode) nearest(p []float64, best *Neighbour) {
+	if kd == nil {
+		return
+	}
+
+	d := kd.distanceSquared(p)
+	if d < best.DistanceSquared {
+		best.Point, best.DistanceSquared, best.Payload = kd.Data, d, kd.Payload
+	}
+
+	near, far, diff := kd.split(p)
+	near.nearest(p, best)
+	if diff * diff < best.DistanceSquared {
+		far.nearest(p, best)
+	}
+}
+
+// KNearest returns up to k points closest to p, nearest first. A bounded
+// max-heap holds the best candidates, so subtrees further away than the
+// current k-th neighbour are skipped.
+func (kd *KDTreeNode) KNearest(p []float64, k int) []Neighbour {
+	if k <= 0 {
+		return []Neighbour{}
+	}
+
+	candidates := &neighbourHeap{}
+	kd.kNearest(p, k, candidates)
+
+	res := make([]Neighbour, candidates.Len())
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = heap.Pop(candidates).(Neighbour)
+	}
+
+	return res
+}
+
+func (kd *KDTreeNode) kNearest(p []float64, k int, candidates *neighbourHeap) {
+	if kd == nil {
+		return
+	}
+
+	d := kd.distanceSquared(p)
+	if candidates.Len() < k {
+		heap.Push(candidates, Neighbour{Point: kd.Data, DistanceSquared: d, Payload: kd.Payload})
+	} else if d < (*candidates)[0].DistanceSquared {
+		(*candidates)[0] = Neighbour{Point: kd.Data, DistanceSquared: d, Payload: kd.Payload}
+		heap.Fix(candidates, 0)
+	}
+
+	near, far, diff := kd.split(p)
+	near.kNearest(p, k, candidates)
+	if candidates.Len() < k || diff * diff < (*candidates)[0].DistanceSquared {
+		far.kNearest(p, k, candidates)
+	}
+}
+
+// Radius returns every point within radius of p, nearest first.
+func (kd *KDTreeNode) Radius(p []float64, radius float64) []Neighbour {
+	res := []Neighbour{}
+	kd.radius(p, radius * radius, &res)
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].DistanceSquared < res[j].DistanceSquared
+	})
+
+	return res
+}
+
+func (kd *KDTreeNode) radius(p []float64, radiusSquared float64, res *[]Neighbour) {
+	if kd == nil {
+		return
+	}
+
+	d := kd.distanceSquared(p)
+	if d <= radiusSquared {
+		*res = append(*res, Neighbour{Point: kd.Data, DistanceSquared: d, Payload: kd.Payload})
+	}
+
+	near, far, diff := kd.split(p)
+	near.radius(p, radiusSquared, res)
+	if diff * diff <= radiusSquared {
+		far.radius(p, radiusSquared, res)
+	}
+}
+
+func (kd *KDTreeNode) distanceSquared(p []float64) float64 {
+	dx, dy, dz := p[0] - kd.Data[0], p[1] - kd.Data[1], p[2] - kd.Data[2]
+	return dx * dx + dy * dy + dz * dz
+}
+
+// split orders the children by which side of the splitting plane p is on,
+// returning p's signed distance from the plane.
+func (kd *KDTreeNode) split(p []float64) (*KDTreeNode, *KDTreeNode, float64) {
+	diff := p[kd.Axis] - kd.Data[kd.Axis]
+	if diff >= 0 {
+		return kd.Right, kd.Left, diff
+	}
+
+	return kd.Left, kd.Right, diff
+}
+
+// neighbourHeap is a max-heap on distance, so the furthest candidate is
+// first in line to be replaced.
+type neighbourHeap []Neighbour
+
+func (h neighbourHeap) Len() int { return len(h) }
+func (h neighbourHeap) Less(i, j int) bool { return h[i].DistanceSquared > h[j].DistanceSquared }
+func (h neighbourHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *neighbourHeap) Push(x interface{}) {
+	*h = append(*h, x.(Neighbour))
+}
+
+func (h *neighbourHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n - 1]
+	*h = old[:n - 1]
+	return item
+}
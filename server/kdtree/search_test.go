@@ -0,0 +1,101 @@
+package kdtree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// bruteForce returns the squared distances from p to every point, nearest
+// first.
+func bruteForce(points, p []float64) []float64 {
+	res := []float64{}
+	for i := 0; i < len(points); i += pointOffset {
+		d := 0.0
+		for a := 0; a < 3; a++ {
+			diff := points[i + a] - p[a]
+			d += diff * diff
+		}
+		res = append(res, d)
+	}
+
+	sort.Float64s(res)
+
+	return res
+}
+
+func scatter(n int, rng *rand.Rand) []float64 {
+	points := make([]float64, n * pointOffset)
+	for i := 0; i < n; i++ {
+		for a := 0; a < 3; a++ {
+			points[i * pointOffset + a] = rng.Float64() * 100
+		}
+	}
+
+	return points
+}
+
+func TestKNearestMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := scatter(2000, rng)
+	_, tree := ConstructTree(points, 0)
+
+	for q := 0; q < 50; q++ {
+		p := scatter(1, rng)
+		want := bruteForce(points, p)
+
+		for _, k := range []int{1, 10, 100} {
+			got := tree.KNearest(p, k)
+			if len(got) != k {
+				t.Fatalf("got %d neighbours, want %d", len(got), k)
+			}
+
+			for i, neighbour := range got {
+				if neighbour.DistanceSquared != want[i] {
+					t.Fatalf("neighbour %d of %d is at %f, want %f", i, k, neighbour.DistanceSquared, want[i])
+				}
+			}
+		}
+
+		nearest, ok := tree.Nearest(p)
+		if !ok || nearest.DistanceSquared != want[0] {
+			t.Fatalf("nearest is at %f, want %f", nearest.DistanceSquared, want[0])
+		}
+	}
+}
+
+func TestKNearestReturnsEveryPointWhenKIsLarge(t *testing.T) {
+	points := scatter(20, rand.New(rand.NewSource(2)))
+	_, tree := ConstructTree(points, 0)
+
+	got := tree.KNearest([]float64{50, 50, 50}, 100)
+	if len(got) != 20 {
+		t.Fatalf("got %d neighbours, want all 20", len(got))
+	}
+}
+
+func TestRadiusMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	points := scatter(2000, rng)
+	_, tree := ConstructTree(points, 0)
+
+	for q := 0; q < 50; q++ {
+		p := scatter(1, rng)
+		want := 0
+		for _, d := range bruteForce(points, p) {
+			if d <= 100 {
+				want++
+			}
+		}
+
+		got := tree.Radius(p, 10)
+		if len(got) != want {
+			t.Fatalf("got %d points within 10, want %d", len(got), want)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].DistanceSquared < got[i - 1].DistanceSquared {
+				t.Fatal("points within the radius are not nearest first")
+			}
+		}
+	}
+}
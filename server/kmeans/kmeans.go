@@ -3,6 +3,9 @@ package kmeans
 import (
 	// "fmt"
 	"math"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 
 	utils "lidar/loader_utils"
@@ -12,6 +15,7 @@ import (
 	"github.com/puzpuzpuz/xsync"
 	"golang.org/x/exp/rand"
 	"lidar/kdtree"
+	"lidar/structs"
 	// "gonum.org/v1/gonum/spatial/kdtree"
 )
 
@@ -31,34 +35,112 @@ type ClusterResult struct {
 	cost float64
 }
 
-func randomBetween(min, max int) int {
-	if min == max {
-		return min
+// Config holds the per-job clustering options. With Seeded set, every
+// random choice is drawn from a generator derived from Seed and the points
+// being clustered, so the same input always clusters the same way no matter
+// which order leaves are processed in. KSelection picks how the number of
+// clusters is chosen when no target is given: "elbow", "density", "xmeans"
+// or "silhouette". They try up to half as many clusters as points, capped
+// at MaxK, which defaults to MaxClusters so each leaf costs a bounded number
+// of clustering runs. ByClass clusters each
+// classification separately, and the colour and intensity weights add those
+// attributes to the distance. Timings, when set, collects the job's time
+// spent in each step; otherwise it goes to GlobalTimetracker.
+type Config struct {
+	Seed uint64
+	Seeded bool
+	Init string
+	KSelection string
+	MaxK int
+	TargetDensity float64
+	Workers int
+	MiniBatchThreshold int
+	ByClass bool
+	ColourWeight float64
+	IntensityWeight float64
+	Timings *xsync.Map
+}
+
+var DefaultConfig = &Config{
+	Init: "kmeans++",
+	KSelection: "elbow",
+	MaxK: c.MaxClusters,
+	Workers: runtime.NumCPU(),
+}
+
+func ConfigFromOptions(options *structs.ProcessingOptions) *Config {
+	config := &Config{
+		Init: "kmeans++",
+		KSelection: "elbow",
+		MaxK: c.MaxClusters,
+		Workers: runtime.NumCPU(),
+	}
+
+	if options.KMeansInit == "random" {
+		config.Init = "random"
+	}
+
+	switch options.KSelection {
+	case "density", "xmeans", "silhouette":
+		config.KSelection = options.KSelection
+	}
+
+	maxK, err := strconv.Atoi(options.MaxK)
+	if err == nil && maxK > 0 {
+		config.MaxK = maxK
+	}
+
+	workers, err := strconv.Atoi(options.ClusterWorkers)
+	if err == nil && workers > 0 {
+		config.Workers = workers
+	}
+
+	config.TargetDensity, _ = strconv.ParseFloat(options.TargetDensity, 64)
+	config.MiniBatchThreshold, _ = strconv.Atoi(options.MiniBatchThreshold)
+	config.ByClass, _ = strconv.ParseBool(options.ClusterByClass)
+	config.ColourWeight, _ = strconv.ParseFloat(options.ColourWeight, 64)
+	config.IntensityWeight, _ = strconv.ParseFloat(options.IntensityWeight, 64)
+
+	seed, err := strconv.ParseUint(options.Seed, 10, 64)
+	if err == nil {
+		config.Seed = seed
+		config.Seeded = true
+	}
+
+	return config
+}
+
+// newRand returns the generator for one clustering run over points; salt
+// separates runs over the same points, such as each k tried.
+func (config *Config) newRand(points []float64, salt uint64) *rand.Rand {
+	if !config.Seeded {
+		return rand.New(rand.NewSource(uint64(time.Now().UnixNano()) ^ salt))
 	}
 
-	return rand.Intn(max - min) + min
+	return utils.PointsRand(config.Seed ^ salt * 0x9e3779b97f4a7c15, points)
 }
 
-func generateKRandNums(min, max, k int, arr *[]int) {
-	if len(*arr) == k || min > max {
-		return
+// track adds the time since start to the step's total for the job.
+func (config *Config) track(start time.Time, name string) {
+	timings := config.Timings
+	if timings == nil {
+		timings = GlobalTimetracker
 	}
 
-	num := randomBetween(min, max)
-	*arr = append(*arr, num)
-	generateKRandNums(min, num - 1, k, arr)
-	generateKRandNums(num + 1, max, k, arr)
+	utils.TimeTrackMap(start, name, timings)
 }
 
-func getRandomCentroids(points []float64, k int) []float64 {
-	defer utils.TimeTrackMap(time.Now(), "getRandomCentroids", GlobalTimetracker)
+// getRandomCentroids picks k distinct points as initial centroids.
+func getRandomCentroids(points []float64, k int, config *Config, rng *rand.Rand) []float64 {
+	defer config.track(time.Now(), "getRandomCentroids")
 
 	numSamples := len(points) / pointOffset;
-	centroidIndexes := []int{}
-	generateKRandNums(0, numSamples, k, &centroidIndexes)
+	if k > numSamples {
+		k = numSamples
+	}
 
-	centroids := [] float64{}
-	for _, idx := range centroidIndexes {
+	centroids := make([]float64, 0, k * pointOffset)
+	for _, idx := range rng.Perm(numSamples)[:k] {
 		centroids = append(centroids,
 			points[idx * pointOffset : (idx + 1) * pointOffset]...
 		)
@@ -67,8 +149,72 @@ func getRandomCentroids(points []float64, k int) []float64 {
 	return centroids;
 } 
 
-func shouldStop(oldCentroids, centroids []float64, iterations int) bool {
-	defer utils.TimeTrackMap(time.Now(), "shouldStop", GlobalTimetracker)
+// getKMeansPlusPlusCentroids picks the first centroid uniformly and each
+// following one with probability proportional to its squared distance from
+// the nearest centroid so far, spreading the initial centroids out.
+func getKMeansPlusPlusCentroids(points []float64, k int, config *Config, rng *rand.Rand) []float64 {
+	defer config.track(time.Now(), "getKMeansPlusPlusCentroids")
+
+	numSamples := len(points) / pointOffset;
+	if k > numSamples {
+		k = numSamples
+	}
+
+	centroids := make([]float64, 0, k * pointOffset)
+	if k == 0 {
+		return centroids
+	}
+
+	first := rng.Intn(numSamples) * pointOffset
+	centroids = append(centroids, points[first : first + pointOffset]...)
+
+	distances := make([]float64, numSamples)
+	for i := range distances {
+		distances[i] = math.Inf(1)
+	}
+
+	for len(centroids) < k * pointOffset {
+		last := len(centroids) - pointOffset
+		total := 0.0
+
+		for i := 0; i < numSamples; i++ {
+			j := i * pointOffset
+			d := config.distance(points[j:], centroids[last:])
+			distances[i] = math.Min(distances[i], d)
+			total += distances[i]
+		}
+
+		// Every remaining point coincides with a centroid.
+		if total == 0 {
+			break
+		}
+
+		target := rng.Float64() * total
+		next := numSamples - 1
+		for i := 0; i < numSamples; i++ {
+			target -= distances[i]
+			if target < 0 {
+				next = i
+				break
+			}
+		}
+
+		centroids = append(centroids, points[next * pointOffset : (next + 1) * pointOffset]...)
+	}
+
+	return centroids
+}
+
+func (config *Config) getInitialCentroids(points []float64, k int, rng *rand.Rand) []float64 {
+	if config.Init == "random" {
+		return getRandomCentroids(points, k, config, rng)
+	}
+
+	return getKMeansPlusPlusCentroids(points, k, config, rng)
+}
+
+func shouldStop(oldCentroids, centroids []float64, iterations int, config *Config) bool {
+	defer config.track(time.Now(), "shouldStop")
 
 	if iterations > maxIterations {
 		return true
@@ -96,8 +242,30 @@ func getDistanceSquared(x1, y1, z1, x2, y2, z2 float64) float64 {
 	return xDiff * xDiff + yDiff * yDiff + zDiff * zDiff
 }
 
-func getLabels(points, centroids []float64) map[int]*ClusterLabels {
-	defer utils.TimeTrackMap(time.Now(), "getLabels", GlobalTimetracker)
+// distance compares two points by position, plus their colour and intensity
+// when the config weights them in.
+func (config *Config) distance(p, q []float64) float64 {
+	d := getDistanceSquared(p[0], p[1], p[2], q[0], q[1], q[2])
+
+	if config.ColourWeight > 0 {
+		dr, dg, db := p[3] - q[3], p[4] - q[4], p[5] - q[5]
+		d += config.ColourWeight * config.ColourWeight * (dr * dr + dg * dg + db * db)
+	}
+
+	if config.IntensityWeight > 0 {
+		di := p[6] - q[6]
+		d += config.IntensityWeight * config.IntensityWeight * di * di
+	}
+
+	return d
+}
+
+func (config *Config) weighted() bool {
+	return config.ColourWeight > 0 || config.IntensityWeight > 0
+}
+
+func getLabels(points, centroids []float64, config *Config) map[int]*ClusterLabels {
+	defer config.track(time.Now(), "getLabels")
 	labels := make(map[int]*ClusterLabels)
 
 	for i := 0; i < len(centroids); i += pointOffset {
@@ -108,33 +276,21 @@ func getLabels(points, centroids []float64) map[int]*ClusterLabels {
 	}
 	
 	for i := 0; i < len(points); i += pointOffset {
-		x1, y1, z1, r1, g1, b1, alpha1, classification1 := points[i], points[i + 1], points[i + 2], points[i + 3], points[i + 4], points[i + 5], points[i + 6], points[i + 7];
-		closestCentroidX, closestCentroidY, closestCentroidZ, closestCentroidIndex, prevDistance := 0.0, 0.0, 0.0, 0 ,0.0;
-		
-		for j := 0; j < len(centroids); j += pointOffset {
-			if j == 0 {
-				closestCentroidX, closestCentroidY, closestCentroidZ, closestCentroidIndex = centroids[j], centroids[j + 1], centroids[j + 2], j;
-				prevDistance = getDistanceSquared(x1, y1, z1, closestCentroidX, closestCentroidY, closestCentroidZ);
-			} else {
-				distance := getDistanceSquared(x1, y1, z1, centroids[j], centroids[j + 1], centroids[j + 2]);
-				if distance < prevDistance {
-					prevDistance = distance
-					closestCentroidX, closestCentroidY, closestCentroidZ = centroids[j], centroids[j + 1], centroids[j + 2];
-					closestCentroidIndex = j
-				}
-			}
-		}
-		labels[closestCentroidIndex].points = append(labels[closestCentroidIndex].points, x1, y1, z1, r1, g1, b1, alpha1, classification1)
+		closestCentroidIndex := config.nearestCentroid(points[i:], centroids) * pointOffset
+		labels[closestCentroidIndex].points = append(labels[closestCentroidIndex].points, points[i : i + pointOffset]...)
 	}
 
 	return labels;
 }
 
-func getPointsMean(points []float64) []float64 {
-	defer utils.TimeTrackMap(time.Now(), "getPointsMean", GlobalTimetracker)
+// getPointsMean averages positions, colours and intensities, and takes the
+// most common classification so centroids keep a real class code.
+func getPointsMean(points []float64, config *Config) []float64 {
+	defer config.track(time.Now(), "getPointsMean")
 
 	totalPoints := float64(len(points) / pointOffset);
-	means := []float64{0, 0, 0, 0, 0, 0, 0}
+	means := make([]float64, pointOffset)
+	classes := map[float64]int{}
 
 	for i := 0; i < len(points); i += pointOffset {
 		means[0] = means[0] + points[i] / totalPoints;
@@ -143,22 +299,46 @@ func getPointsMean(points []float64) []float64 {
 		means[3] = means[3] + points[i + 3] / totalPoints;
 		means[4] = means[4] + points[i + 4] / totalPoints;
 		means[5] = means[5] + points[i + 5] / totalPoints;
-		means[6] = math.Max(means[6], points[i + 6]);
-		means[7] = means[7] + points[i + 7] / totalPoints
+		means[6] = means[6] + points[i + 6] / totalPoints;
+		classes[points[i + 7]]++
 	}
 
+	means[7] = majority(classes)
+
 	return means;
 }
 
-func recalculateCentroids(points []float64, labels map[int]*ClusterLabels) []float64 {
-	defer utils.TimeTrackMap(time.Now(), "recalculateCentroids", GlobalTimetracker)
+// majority returns the most common value, preferring the smallest on ties.
+func majority(counts map[float64]int) float64 {
+	best, bestCount := 0.0, -1
+	for value, count := range counts {
+		if count > bestCount || (count == bestCount && value < best) {
+			best, bestCount = value, count
+		}
+	}
+
+	return best
+}
+
+func recalculateCentroids(points []float64, labels map[int]*ClusterLabels, config *Config, rng *rand.Rand) []float64 {
+	defer config.track(time.Now(), "recalculateCentroids")
 	newCentroidList := []float64{};
 	newCentroid := []float64{}
-	for _, group := range labels {
+
+	// Keep centroids in a stable order so runs are repeatable and
+	// shouldStop can compare them position by position.
+	keys := make([]int, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+
+	for _, key := range keys {
+		group := labels[key]
 		if len(group.points) > 0 {
-			newCentroid = getPointsMean(group.points);
+			newCentroid = getPointsMean(group.points, config);
 		} else {
-			newCentroid = getRandomCentroids(points, 1)[:pointOffset];
+			newCentroid = getRandomCentroids(points, 1, config, rng)[:pointOffset];
 		}
 
 		newCentroidList = append(newCentroidList, newCentroid...);
@@ -167,25 +347,16 @@ func recalculateCentroids(points []float64, labels map[int]*ClusterLabels) []flo
 	return newCentroidList
 }
 
-func kMeansHelper(points []float64, k int) *ClusterResult {
-	defer utils.TimeTrackMap(time.Now(), "kMeansHelper", GlobalTimetracker)
+func kMeansHelper(points []float64, k int, config *Config, rng *rand.Rand) *ClusterResult {
+	defer config.track(time.Now(), "kMeansHelper")
 	if len(points) != 0 && len(points) > k {
-		iterations := 0;
-		labels := make(map[int]*ClusterLabels)
-		centroids := getRandomCentroids(points, k)
-		oldCentroids := make([]float64, k * pointOffset)
-		for !shouldStop(oldCentroids, centroids, iterations) {
-			iterations++;
-			labels = getLabels(points, centroids);
-			oldCentroids = centroids
-			centroids = recalculateCentroids(points, labels);
+		n := len(points) / pointOffset
+		if config.useMiniBatch(n) {
+			sample := samplePoints(points, c.MiniBatchSize * 10, rng)
+			return miniBatchKMeans(points, config.getInitialCentroids(sample, k, rng), config, rng)
 		}
 
-		return &ClusterResult{
-			labels,
-			centroids,
-			elbowCostFunction(labels),
-		}
+		return kMeansFrom(points, config.getInitialCentroids(points, k, rng), config, rng)
 	}
 
 	return &ClusterResult{
@@ -195,24 +366,44 @@ func kMeansHelper(points []float64, k int) *ClusterResult {
 	}
 }
 
-func elbowCostFunction(labels map[int]*ClusterLabels) float64 {
-	defer utils.TimeTrackMap(time.Now(), "elbowCostFunction", GlobalTimetracker)
+// kMeansFrom runs Lloyd's iterations starting from the given centroids.
+func kMeansFrom(points, centroids []float64, config *Config, rng *rand.Rand) *ClusterResult {
+	iterations := 0;
+	labels := make(map[int]*ClusterLabels)
+	oldCentroids := make([]float64, len(centroids))
+	for !shouldStop(oldCentroids, centroids, iterations, config) {
+		iterations++;
+		labels = getLabels(points, centroids, config);
+		oldCentroids = centroids
+		centroids = recalculateCentroids(points, labels, config, rng);
+	}
+
+	return &ClusterResult{
+		labels,
+		centroids,
+		elbowCostFunction(labels, config),
+	}
+}
+
+// elbowCostFunction sums the distances of points from their centroids,
+// weighted as the config compares them.
+func elbowCostFunction(labels map[int]*ClusterLabels, config *Config) float64 {
+	defer config.track(time.Now(), "elbowCostFunction")
 
 	cost := 0.0
 	for _, label := range labels {
-		centroidX, centroidY, centroidZ := label.centroids[0], label.centroids[1], label.centroids[2]
 		points := label.points
 
 		for i := 0; i < len(points); i += pointOffset {
-			cost += getDistanceSquared(centroidX, centroidY, centroidZ, points[i], points[i + 1], points[i + 2])
+			cost += config.distance(label.centroids, points[i:])
 		}
 	}
 
 	return cost
 }
 
-func elbowMethod(points []float64) *ClusterResult {
-	defer utils.TimeTrackMap(time.Now(), "elbowMethod", GlobalTimetracker)
+func elbowMethod(points []float64, config *Config) *ClusterResult {
+	defer config.track(time.Now(), "elbowMethod")
 
 	n := len(points) / pointOffset;
 	maxJ := math.Inf(-1)
@@ -228,7 +419,7 @@ func elbowMethod(points []float64) *ClusterResult {
 	for i := 1; i <= n / 2; i += skip {
 		wg.Add(1)
 		go func(i int) {
-			clusteringResult := kMeansHelper(points, i);
+			clusteringResult := kMeansHelper(points, i, config, config.newRand(points, uint64(i)));
 			mapping[i] = clusteringResult;
 			d[i] = clusteringResult.cost
 			wg.Done()
@@ -248,8 +439,9 @@ func elbowMethod(points []float64) *ClusterResult {
 	return mapping[maxJIndex]
 }
 
-func optimizedElbowMethod(points []float64) *ClusterResult{
+func optimizedElbowMethod(points []float64, config *Config) *ClusterResult{
 	n := len(points) / pointOffset;
+	rng := config.newRand(points, 0)
 
 	if n <= 1 {
 		return &ClusterResult{
@@ -266,7 +458,7 @@ func optimizedElbowMethod(points []float64) *ClusterResult{
 	l, r := 1, len(diff)
 
 	if l >= r {
-		return kMeansHelper(points, l)
+		return kMeansHelper(points, l, config, rng)
 	}
 
 	for l < r {
@@ -274,10 +466,10 @@ func optimizedElbowMethod(points []float64) *ClusterResult{
 
 		if mid > 1 && mid < d && diff[mid] == 0 {
 			if clusters[mid - 1] == nil {
-				clusters[mid - 1] = kMeansHelper(points, mid - 1)
+				clusters[mid - 1] = kMeansHelper(points, mid - 1, config, rng)
 			}
 			if clusters[mid] == nil {
-				clusters[mid] = kMeansHelper(points, mid)
+				clusters[mid] = kMeansHelper(points, mid, config, rng)
 			}
 
 			diff[mid] = math.Abs(clusters[mid - 1].cost - clusters[mid].cost)
@@ -285,10 +477,10 @@ func optimizedElbowMethod(points []float64) *ClusterResult{
 
 		if mid > 3 && mid - 1 < d && diff[mid - 1] == 0 {
 			if clusters[mid - 2] == nil {
-				clusters[mid - 2] = kMeansHelper(points, mid - 2)
+				clusters[mid - 2] = kMeansHelper(points, mid - 2, config, rng)
 			}
 			if clusters[mid - 1] == nil {
-				clusters[mid - 1] = kMeansHelper(points, mid - 1)
+				clusters[mid - 1] = kMeansHelper(points, mid - 1, config, rng)
 			}
 
 			diff[mid - 1] = math.Abs(clusters[mid - 2].cost - clusters[mid - 1].cost)
@@ -296,10 +488,10 @@ func optimizedElbowMethod(points []float64) *ClusterResult{
 
 		if mid + 1 < d && mid > 0 && diff[mid + 1] == 0 {
 			if clusters[mid + 1] == nil {
-				clusters[mid + 1] = kMeansHelper(points, mid + 1)
+				clusters[mid + 1] = kMeansHelper(points, mid + 1, config, rng)
 			}
 			if clusters[mid] == nil {
-				clusters[mid] = kMeansHelper(points, mid)
+				clusters[mid] = kMeansHelper(points, mid, config, rng)
 			}
 
 			diff[mid + 1] = math.Abs(clusters[mid + 1].cost - clusters[mid].cost)
@@ -324,7 +516,7 @@ func optimizedElbowMethod(points []float64) *ClusterResult{
 	// 	clusters[d] = 
 	// }
 
-	return kMeansHelper(points, d)
+	return kMeansHelper(points, d, config, rng)
 }
 
 func kdElbowCostFunction(centroids, points []float64) float64 {
@@ -342,56 +534,84 @@ func kdElbowCostFunction(centroids, points []float64) float64 {
 	return total / float64(len(centroids))
 }
 
-func kdElbowMethod(points []float64) *ClusterResult {
-	defer utils.TimeTrackMap(time.Now(), "kdElbowMethod", GlobalTimetracker)
-	n := len(points) / pointOffset;
-	maxJ := math.Inf(1)
-	maxJIndex := 1;
-	d := make([]float64, n / 2 + 1);
-	mapping := make([]*[]float64, n / 2 + 1);
-	d[0] = 0.0
+// kdElbowMethod tries every k up to the configured maximum on a bounded
+// pool of workers and picks the knee of the cost curve: the k furthest below
+// the line joining the costs of the smallest and largest k.
+func kdElbowMethod(points []float64, config *Config) *ClusterResult {
+	defer config.track(time.Now(), "kdElbowMethod")
+	maxK := config.maxK(len(points) / pointOffset)
+	d := make([]float64, maxK + 1);
+	mapping := make([]*[]float64, maxK + 1);
 	
+	// Filter only reads the tree, so every k shares one.
 	_, tree := kdtree.ConstructTree(points, 0)
 
-	wg := sync.WaitGroup{}
+	config.sweep(1, maxK, func(i int) {
+		rng := config.newRand(points, uint64(i))
+		centroids := config.getInitialCentroids(points, i, rng)
+
+		// The tree splits points by position alone, so colour and intensity
+		// weights need the plain iterations.
+		if config.weighted() {
+			res := kMeansFrom(points, centroids, config, rng)
+			d[i] = res.cost
+			mapping[i] = &res.centroids
+			return
+		}
 
-	for i := 1; i <= n / 2; i++ {
-		wg.Add(1)
-		go func(i int) {
-			randomCentroids := getRandomCentroids(points, i)
+		// Each filtering pass is one of Lloyd's iterations.
+		iterations := 0
+		oldCentroids := []float64{}
+		for !shouldStop(oldCentroids, centroids, iterations, config) {
+			iterations++
 			candidateSet := []*kdtree.MeansInstance{}	
-			for i := 0; i < len(randomCentroids); i += pointOffset {
-				candidateSet = append(candidateSet, kdtree.InitMeansInstance(pointOffset, points[i : i + pointOffset]))
+			for i := 0; i < len(centroids); i += pointOffset {
+				candidateSet = append(candidateSet, kdtree.InitMeansInstance(pointOffset, centroids[i : i + pointOffset]))
 			}
-			tree.CopyTree().Filter(candidateSet)
-			centroids := []float64{}
+			tree.Filter(candidateSet)
+
+			oldCentroids = centroids
+			centroids = []float64{}
 			for _, candidate := range candidateSet {
 				centroids = append(centroids, candidate.GetRealPoints()...)
 			}
+		}
 
-			labels := getLabels(points, centroids)
-			d[i] = elbowCostFunction(labels)
-			mapping[i] = &centroids
-			wg.Done()
-		}(i)
-	}
+		// Filtered means average the class codes, so finish with a pass that
+		// votes on them like every other path.
+		res := finaliseCentroids(points, centroids, config)
+		d[i] = res.cost
+		mapping[i] = &res.centroids
+	})
 
-	wg.Wait()
-
-	for i := 1; i < len(d); i++ {
-		if d[i] < maxJ {
-			maxJ = d[i]
-			maxJIndex = i 
-		}
-	}
+	best := knee(d[1:]) + 1
 	
 	return &ClusterResult{
 		nil, 
-		*mapping[maxJIndex],
+		*mapping[best],
 		0,
 	}
 }
 
+// knee returns the index of the point furthest below the chord from the first
+// cost to the last.
+func knee(costs []float64) int {
+	last := len(costs) - 1
+	if last < 2 {
+		return last
+	}
+
+	best, bestDistance := last, 0.0
+	for i := 1; i < last; i++ {
+		chord := costs[0] + (costs[last] - costs[0]) * float64(i) / float64(last)
+		if chord - costs[i] > bestDistance {
+			best, bestDistance = i, chord - costs[i]
+		}
+	}
+
+	return best
+}
+
 type Point struct {
 	X []float64
 	Y int
@@ -411,12 +631,148 @@ func kdTreeKMeansClustering(points []float64, k int) {
 }
 
 func KMeansClustering(points []float64) []float64 {
+	return DefaultConfig.Cluster(points)
+}
+
+func (config *Config) Cluster(points []float64) []float64 {
+	if !config.ByClass {
+		return config.cluster(points)
+	}
+
+	res := []float64{}
+	for _, group := range splitByClass(points) {
+		res = append(res, config.cluster(group)...)
+	}
+
+	return res
+}
+
+func (config *Config) cluster(points []float64) []float64 {
 	if (len(points) <= pointOffset) {
 		return points;
 	}
 	// res := optimizedElbowMethod(points).centroids;
 
-	return kdElbowMethod(points).centroids;
+	if config.KSelection == "density" {
+		return config.clusterK(points, config.densityK(points))
+	}
+
+	// Large leaves choose k on a sample, then cluster every point with
+	// mini-batch k-means.
+	n := len(points) / pointOffset
+	sample := points
+	if config.useMiniBatch(n) {
+		sample = samplePoints(points, config.miniBatchThreshold(), config.newRand(points, 0))
+	}
+
+	var res *ClusterResult
+	switch config.KSelection {
+	case "xmeans":
+		res = xMeans(sample, config)
+	case "silhouette":
+		res = silhouetteMethod(sample, config)
+	default:
+		res = kdElbowMethod(sample, config)
+	}
+
+	if len(sample) < len(points) {
+		return config.clusterK(points, len(res.centroids) / pointOffset)
+	}
+
+	return res.centroids;
 	// return elbowMethod(points).centroids;
 	// return kMeansHelper(points, 2).centroids
-}
\ No newline at end of file
+}
+
+// KMeansClusteringK reduces points to at most k centroids.
+func KMeansClusteringK(points []float64, k int) []float64 {
+	return DefaultConfig.ClusterK(points, k)
+}
+
+// ClusterK shares k between the classes in proportion to their point counts
+// when clustering by class, giving every class at least one centroid.
+func (config *Config) ClusterK(points []float64, k int) []float64 {
+	if !config.ByClass {
+		return config.clusterK(points, k)
+	}
+
+	groups := splitByClass(points)
+	targets := shareTarget(groups, k)
+
+	res := []float64{}
+	for i, group := range groups {
+		res = append(res, config.clusterK(group, targets[i])...)
+	}
+
+	return res
+}
+
+func (config *Config) clusterK(points []float64, k int) []float64 {
+	if len(points) <= k * pointOffset {
+		return points
+	}
+
+	return kMeansHelper(points, k, config, config.newRand(points, uint64(k))).centroids
+}
+
+// splitByClass groups points by classification, in class order.
+func splitByClass(points []float64) [][]float64 {
+	groups := map[float64][]float64{}
+	classes := []float64{}
+
+	for i := 0; i < len(points); i += pointOffset {
+		class := points[i + pointOffset - 1]
+		if _, ok := groups[class]; !ok {
+			classes = append(classes, class)
+		}
+		groups[class] = append(groups[class], points[i : i + pointOffset]...)
+	}
+
+	sort.Float64s(classes)
+
+	res := make([][]float64, len(classes))
+	for i, class := range classes {
+		res[i] = groups[class]
+	}
+
+	return res
+}
+
+// shareTarget splits k across groups by size with the largest remainder
+// method, giving each group at least one.
+func shareTarget(groups [][]float64, k int) []int {
+	total := 0
+	for _, group := range groups {
+		total += len(group) / pointOffset
+	}
+
+	targets := make([]int, len(groups))
+	remainders := make([]float64, len(groups))
+	assigned := 0
+
+	for i, group := range groups {
+		share := float64(k) * float64(len(group) / pointOffset) / float64(total)
+		targets[i] = int(share)
+		remainders[i] = share - float64(targets[i])
+		if targets[i] < 1 {
+			targets[i] = 1
+			remainders[i] = 0
+		}
+		assigned += targets[i]
+	}
+
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+
+	for i := 0; assigned < k && i < len(order); i++ {
+		targets[order[i]]++
+		assigned++
+	}
+
+	return targets
+}
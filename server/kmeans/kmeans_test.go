@@ -0,0 +1,58 @@
+package kmeans
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// cloud returns n points around each centre with the given class, colour
+// and intensity.
+func cloud(rng *rand.Rand, n int, centre [3]float64, colour, intensity, class float64) []float64 {
+	points := []float64{}
+	for i := 0; i < n; i++ {
+		points = append(points,
+			centre[0] + rng.Float64(), centre[1] + rng.Float64(), centre[2] + rng.Float64(),
+			colour, colour, colour, intensity, class,
+		)
+	}
+
+	return points
+}
+
+func TestElbowVotesOnClass(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := append(cloud(rng, 40, [3]float64{0, 0, 0}, 0, 0, 1), cloud(rng, 40, [3]float64{20, 0, 0}, 0, 0, 2)...)
+	points = append(points, cloud(rng, 40, [3]float64{0, 20, 0}, 0, 0, 6)...)
+
+	config := &Config{Seed: 1, Seeded: true, Init: "kmeans++", KSelection: "elbow", Workers: 2}
+	centroids := config.Cluster(points)
+
+	for i := pointOffset - 1; i < len(centroids); i += pointOffset {
+		switch centroids[i] {
+		case 1, 2, 6:
+		default:
+			t.Fatalf("centroid class %v is not a class in the input", centroids[i])
+		}
+	}
+}
+
+func TestElbowWeightsColour(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	// Two interleaved clouds in one place told apart only by colour.
+	points := append(cloud(rng, 30, [3]float64{0, 0, 0}, 0, 0, 1), cloud(rng, 30, [3]float64{0, 0, 0}, 255, 0, 1)...)
+
+	config := &Config{Seed: 1, Seeded: true, Init: "kmeans++", KSelection: "elbow", MaxK: 2, Workers: 2, ColourWeight: 1}
+	centroids := config.Cluster(points)
+
+	if len(centroids) != 2 * pointOffset {
+		t.Fatalf("got %d centroids, want 2", len(centroids) / pointOffset)
+	}
+
+	dark, light := centroids[3], centroids[pointOffset + 3]
+	if dark > light {
+		dark, light = light, dark
+	}
+	if dark != 0 || light != 255 {
+		t.Fatalf("centroid colours are %v and %v, want 0 and 255", dark, light)
+	}
+}
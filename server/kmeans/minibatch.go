@@ -0,0 +1,144 @@
+package kmeans
+
+import (
+	"math"
+	"time"
+
+	c "lidar/constants"
+
+	"golang.org/x/exp/rand"
+)
+
+// miniBatchThreshold is the point count above which clustering switches to
+// mini-batch k-means.
+func (config *Config) miniBatchThreshold() int {
+	if config.MiniBatchThreshold <= 0 {
+		return c.MiniBatchThreshold
+	}
+
+	return config.MiniBatchThreshold
+}
+
+func (config *Config) useMiniBatch(n int) bool {
+	return n > config.miniBatchThreshold()
+}
+
+// samplePoints copies up to size points chosen at random.
+func samplePoints(points []float64, size int, rng *rand.Rand) []float64 {
+	n := len(points) / pointOffset
+	if n <= size {
+		return points
+	}
+
+	sample := make([]float64, 0, size * pointOffset)
+	for _, i := range rng.Perm(n)[:size] {
+		sample = append(sample, points[i * pointOffset : (i + 1) * pointOffset]...)
+	}
+
+	return sample
+}
+
+// miniBatchKMeans refines centroids from random batches of points, moving
+// each centroid towards its batch points with a step that shrinks as it
+// absorbs more of them (Sculley, 2010). Buffers are allocated once and
+// reused every iteration. It stops once no centroid moves further than a
+// small fraction of the points' extent, then assigns every point once to
+// compute the final centroids' attributes.
+func miniBatchKMeans(points, initial []float64, config *Config, rng *rand.Rand) *ClusterResult {
+	defer config.track(time.Now(), "miniBatchKMeans")
+
+	n := len(points) / pointOffset
+	k := len(initial) / pointOffset
+	batchSize := c.MiniBatchSize
+	if batchSize > n {
+		batchSize = n
+	}
+
+	centroids := make([]float64, len(initial))
+	copy(centroids, initial)
+
+	tolerance := math.Pow(math.Cbrt(boundingVolume(points)) * 1e-4, 2)
+
+	// Weighted distances move colour and intensity along with position.
+	dimensions := 3
+	if config.weighted() {
+		dimensions = pointOffset - 1
+	}
+
+	counts := make([]int, k)
+	batch := make([]int, batchSize)
+	assigned := make([]int, batchSize)
+	previous := make([]float64, pointOffset)
+
+	for iteration := 0; iteration < c.MiniBatchIterations; iteration++ {
+		for i := range batch {
+			batch[i] = rng.Intn(n) * pointOffset
+			assigned[i] = config.nearestCentroid(points[batch[i]:], centroids) * pointOffset
+		}
+
+		moved := 0.0
+		for i, p := range batch {
+			j := assigned[i]
+			counts[j / pointOffset]++
+			rate := 1 / float64(counts[j / pointOffset])
+
+			copy(previous, centroids[j : j + pointOffset])
+			for d := 0; d < dimensions; d++ {
+				centroids[j + d] += rate * (points[p + d] - centroids[j + d])
+			}
+			moved = math.Max(moved, config.distance(previous, centroids[j:]))
+		}
+
+		if moved <= tolerance {
+			break
+		}
+	}
+
+	return finaliseCentroids(points, centroids, config)
+}
+
+// finaliseCentroids assigns every point to its nearest centroid and returns
+// the mean of each non-empty cluster, with the same attribute rules as
+// getPointsMean, without building per-cluster point slices.
+func finaliseCentroids(points, centroids []float64, config *Config) *ClusterResult {
+	k := len(centroids) / pointOffset
+	sums := make([]float64, len(centroids))
+	sizes := make([]int, k)
+	classes := make([]map[float64]int, k)
+	cost := 0.0
+
+	for i := 0; i < len(points); i += pointOffset {
+		label := config.nearestCentroid(points[i:], centroids)
+		j := label * pointOffset
+		sizes[label]++
+		cost += config.distance(points[i:], centroids[j:])
+
+		for d := 0; d < pointOffset - 1; d++ {
+			sums[j + d] += points[i + d]
+		}
+
+		if classes[label] == nil {
+			classes[label] = map[float64]int{}
+		}
+		classes[label][points[i + pointOffset - 1]]++
+	}
+
+	res := make([]float64, 0, len(centroids))
+	for label, size := range sizes {
+		if size == 0 {
+			continue
+		}
+
+		j := label * pointOffset
+		for d := 0; d < pointOffset - 1; d++ {
+			res = append(res, sums[j + d] / float64(size))
+		}
+		res = append(res, majority(classes[label]))
+	}
+
+	return &ClusterResult{
+		nil,
+		res,
+		cost,
+	}
+}
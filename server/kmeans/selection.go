@@ -0,0 +1,282 @@
+package kmeans
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	c "lidar/constants"
+)
+
+// maxK is the most clusters tried for n points: half of them, or MaxK when
+// it is set and lower.
+func (config *Config) maxK(n int) int {
+	maxK := n / 2
+	if config.MaxK > 0 && config.MaxK < maxK {
+		maxK = config.MaxK
+	}
+
+	if maxK < 1 {
+		maxK = 1
+	}
+
+	return maxK
+}
+
+// sweep calls fn for every k from minK to maxK on at most config.Workers
+// goroutines.
+func (config *Config) sweep(minK, maxK int, fn func(k int)) {
+	workers := config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	ks := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range ks {
+				fn(k)
+			}
+		}()
+	}
+
+	for k := minK; k <= maxK; k++ {
+		ks <- k
+	}
+	close(ks)
+
+	wg.Wait()
+}
+
+// densityK picks k so the clusters fill the points' bounding box at
+// TargetDensity points per cubic unit. Without a target density it falls
+// back to the square root of half the point count.
+func (config *Config) densityK(points []float64) int {
+	n := len(points) / pointOffset
+
+	k := int(math.Ceil(math.Sqrt(float64(n) / 2)))
+	if config.TargetDensity > 0 {
+		k = int(math.Ceil(boundingVolume(points) * config.TargetDensity))
+	}
+
+	if k < 1 {
+		k = 1
+	}
+	if k > n {
+		k = n
+	}
+
+	return k
+}
+
+func boundingVolume(points []float64) float64 {
+	min := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+
+	for i := 0; i < len(points); i += pointOffset {
+		for j := 0; j < 3; j++ {
+			min[j] = math.Min(min[j], points[i + j])
+			max[j] = math.Max(max[j], points[i + j])
+		}
+	}
+
+	extent := math.Max(max[0] - min[0], math.Max(max[1] - min[1], max[2] - min[2]))
+	volume := 1.0
+	for j := 0; j < 3; j++ {
+		// Flat extents would zero the volume, so give them a sliver of depth.
+		volume *= math.Max(max[j] - min[j], extent / 1000)
+	}
+
+	return volume
+}
+
+// xMeans starts from one cluster and splits each cluster in two while the
+// split improves the Bayesian information criterion, up to the maximum k.
+// The surviving centroids are then refined together with k-means.
+func xMeans(points []float64, config *Config) *ClusterResult {
+	defer config.track(time.Now(), "xMeans")
+
+	rng := config.newRand(points, 0)
+	maxK := config.maxK(len(points) / pointOffset)
+	centroids := getPointsMean(points, config)
+
+	for len(centroids) / pointOffset < maxK {
+		labels := getLabels(points, centroids, config)
+		keys := make([]int, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Ints(keys)
+
+		next := []float64{}
+		split := false
+
+		for i, key := range keys {
+			group := labels[key]
+			remaining := len(keys) - i - 1
+			k := len(next) / pointOffset + remaining
+
+			if k + 2 <= maxK && len(group.points) >= 4 * pointOffset {
+				children := kMeansHelper(group.points, 2, config, rng)
+				if len(children.centroids) == 2 * pointOffset && bic(children.labels, config) > bic(map[int]*ClusterLabels{0: {
+					points: group.points,
+					centroids: getPointsMean(group.points, config),
+				}}, config) {
+					next = append(next, children.centroids...)
+					split = true
+					continue
+				}
+			}
+
+			if len(group.points) > 0 {
+				next = append(next, getPointsMean(group.points, config)...)
+			}
+		}
+
+		centroids = next
+		if !split {
+			break
+		}
+	}
+
+	return kMeansFrom(points, centroids, config, rng)
+}
+
+// bic scores a clustering under a spherical Gaussian model with a shared
+// variance, after Pelleg and Moore. Higher is better.
+func bic(labels map[int]*ClusterLabels, config *Config) float64 {
+	dimensions := 3.0
+	k := float64(len(labels))
+	n := 0.0
+	for _, label := range labels {
+		n += float64(len(label.points) / pointOffset)
+	}
+
+	if n <= k {
+		return math.Inf(-1)
+	}
+
+	variance := elbowCostFunction(labels, config) / (n - k) / dimensions
+	if variance <= 0 {
+		// A perfect fit cannot be improved on by splitting.
+		return math.Inf(1)
+	}
+
+	likelihood := 0.0
+	for _, label := range labels {
+		size := float64(len(label.points) / pointOffset)
+		if size == 0 {
+			continue
+		}
+
+		likelihood += size * math.Log(size) -
+			size * math.Log(n) -
+			size * dimensions / 2 * math.Log(2 * math.Pi * variance) -
+			(size - k) / 2
+	}
+
+	parameters := (k - 1) + dimensions * k + 1
+
+	return likelihood - parameters / 2 * math.Log(n)
+}
+
+// silhouetteMethod scores each k up to the maximum by the mean silhouette of
+// a random sample of the points, then clusters all the points with the best k.
+func silhouetteMethod(points []float64, config *Config) *ClusterResult {
+	defer config.track(time.Now(), "silhouetteMethod")
+
+	sample := samplePoints(points, c.SilhouetteSampleSize, config.newRand(points, 0))
+
+	maxK := config.maxK(len(sample) / pointOffset)
+	scores := make([]float64, maxK + 1)
+	for i := range scores {
+		scores[i] = math.Inf(-1)
+	}
+
+	config.sweep(2, maxK, func(k int) {
+		res := kMeansHelper(sample, k, config, config.newRand(sample, uint64(k)))
+		scores[k] = config.silhouette(sample, res.centroids)
+	})
+
+	best := 1
+	for k := 2; k <= maxK; k++ {
+		if scores[k] > scores[best] {
+			best = k
+		}
+	}
+
+	return kMeansHelper(points, best, config, config.newRand(points, uint64(best)))
+}
+
+// silhouette is the mean silhouette coefficient of points assigned to their
+// nearest centroid. Points alone in their cluster score zero.
+func (config *Config) silhouette(points, centroids []float64) float64 {
+	n := len(points) / pointOffset
+	k := len(centroids) / pointOffset
+	if n == 0 || k < 2 {
+		return math.Inf(-1)
+	}
+
+	assigned := make([]int, n)
+	sizes := make([]int, k)
+	for i := 0; i < n; i++ {
+		assigned[i] = config.nearestCentroid(points[i * pointOffset:], centroids)
+		sizes[assigned[i]]++
+	}
+
+	total := 0.0
+	sums := make([]float64, k)
+
+	for i := 0; i < n; i++ {
+		if sizes[assigned[i]] <= 1 {
+			continue
+		}
+
+		for j := range sums {
+			sums[j] = 0
+		}
+
+		p := points[i * pointOffset:]
+		for j := 0; j < n; j++ {
+			if j == i {
+				continue
+			}
+
+			q := points[j * pointOffset:]
+			sums[assigned[j]] += math.Sqrt(config.distance(p, q))
+		}
+
+		a := sums[assigned[i]] / float64(sizes[assigned[i]] - 1)
+		b := math.Inf(1)
+		for j := 0; j < k; j++ {
+			if j != assigned[i] && sizes[j] > 0 {
+				b = math.Min(b, sums[j] / float64(sizes[j]))
+			}
+		}
+
+		if math.IsInf(b, 1) || math.Max(a, b) == 0 {
+			continue
+		}
+
+		total += (b - a) / math.Max(a, b)
+	}
+
+	return total / float64(n)
+}
+
+func (config *Config) nearestCentroid(point, centroids []float64) int {
+	best, bestDistance := 0, math.Inf(1)
+	for j := 0; j < len(centroids); j += pointOffset {
+		d := config.distance(point, centroids[j:])
+		if d < bestDistance {
+			best, bestDistance = j / pointOffset, d
+		}
+	}
+
+	return best
+}
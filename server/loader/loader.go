@@ -1,23 +1,41 @@
 package loader
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"sort"
 	"sync"
 	"strconv"
+	"strings"
 
 	"math"
 	"math/rand"
+	"runtime"
 
 	"lidar/constants"
+	"lidar/contours"
+	"lidar/datastore"
+	"lidar/diagnostics"
+	"lidar/dimensions"
 	"lidar/filewriter"
+	"lidar/ground"
 	"lidar/kmeans"
 	utils "lidar/loader_utils"
 	"lidar/lod"
+	"lidar/metrics"
+	"lidar/normals"
 	"lidar/octree"
+	"lidar/outliers"
+	"lidar/raster"
+	"lidar/reducer"
+	"lidar/shapes"
+	"lidar/spill"
 	"lidar/structs"
+	"lidar/vector"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 
@@ -61,9 +79,47 @@ func GetLASHeaders(part *structs.FilePart) *structs.LASHeaders {
 		MinimumBounds: []float64{bounds[1], bounds[3], bounds[5]},
 	}
 
+	readGeoKeys(buf, &header)
+
 	return &header;
 }
 
+// readGeoKeys copies the GeoTIFF projection records, if the file has any,
+// from the variable length records that follow the public header.
+func readGeoKeys(buf []byte, header *structs.LASHeaders) {
+	if len(buf) < 104 {
+		return
+	}
+
+	offset := int64(utils.ReadUint16Single(buf, 94))
+	records := utils.ReadUint32Single(buf, 100)
+
+	for r := uint32(0); r < records; r++ {
+		if offset + 54 > int64(len(buf)) {
+			return
+		}
+
+		recordId := utils.ReadUint16Single(buf, offset + 18)
+		length := int64(utils.ReadUint16Single(buf, offset + 20))
+		data := offset + 54
+
+		if data + length > int64(len(buf)) {
+			return
+		}
+
+		switch recordId {
+		case 34735:
+			header.GeoKeys = utils.ReadUint16Multiple(buf, data, int(length / 2))
+		case 34736:
+			header.GeoDoubleParams = utils.ReadFloat64Multiple(buf, data, int(length / 8))
+		case 34737:
+			header.GeoAsciiParams = strings.TrimRight(string(buf[data : data + length]), "\x00")
+		}
+
+		offset = data + length
+	}
+}
+
 func SendHeaders(socket *structs.ConcurrentSocket, h structs.LASHeaders) {
 	socket.Lock.Lock()
 	defer socket.Lock.Unlock()
@@ -78,18 +134,27 @@ func sendDone(socket *structs.ConcurrentSocket) {
 	})
 }
 
-func coinFlip(density float64) bool {
-	return rand.Float64() <= 0.1 + (density / 100 * 0.6)
+// coinFlip decides whether a subsampled point is kept, drawing from rng
+// when the job is seeded.
+func coinFlip(rng *rand.Rand, density float64) bool {
+	if rng == nil {
+		return rand.Float64() <= 0.1 + (density / 100 * 0.6)
+	}
+
+	return rng.Float64() <= 0.1 + (density / 100 * 0.6)
 }
 
-func LoadData(socket *structs.ConcurrentSocket, buf []byte, m *structs.LASMetaData, o *octree.Octree, wg *sync.WaitGroup, subsample bool, density float64) {
+// LoadData inserts a window's points into the octree. With a filter, the
+// window is parsed first so outliers can be removed before insertion.
+func LoadData(socket *structs.ConcurrentSocket, buf []byte, m *structs.LASMetaData, o *octree.Octree, wg *sync.WaitGroup, subsample bool, density float64, rng *rand.Rand, filter *outliers.Config) {
 	// o.Mutex.Lock()
 	// defer o.Mutex.Unlock()
 	defer wg.Done()
 	var i int64 = 0;
 	bufferLen := int64(len(buf))
+	window := []float64{}
 	for i < bufferLen {
-		if !subsample || coinFlip(density) {
+		if !subsample || coinFlip(rng, density) {
 			x, z, y, r, g, b, intensity, classification := pointFormatReader(
 				buf,
 				i, 
@@ -102,24 +167,50 @@ func LoadData(socket *structs.ConcurrentSocket, buf []byte, m *structs.LASMetaDa
 				m.OffsetZ,
 			);
 
-			octree.AddPoint(
-				x,
-				z,
-				y,
-				r,
-				g,
-				b,
-				intensity,
-				classification,
-				0,
-				o.Granularity, 
-				o.Root,
-				o,
-			)
+			if filter != nil {
+				window = append(window, x, z, y, r, g, b, intensity, classification)
+			} else {
+				octree.AddPoint(
+					x,
+					z,
+					y,
+					r,
+					g,
+					b,
+					intensity,
+					classification,
+					0,
+					o.Granularity, 
+					o.Root,
+					o,
+				)
+			}
 		}
 		
 		i += m.StructSize;
 	}
+
+	if filter == nil {
+		return
+	}
+
+	window, _ = filter.Filter(window)
+	for j := 0; j < len(window); j += constants.PointOffset {
+		octree.AddPoint(
+			window[j],
+			window[j + 1],
+			window[j + 2],
+			window[j + 3],
+			window[j + 4],
+			window[j + 5],
+			window[j + 6],
+			window[j + 7],
+			0,
+			o.Granularity,
+			o.Root,
+			o,
+		)
+	}
 }
 
 func pointFormatReader(
@@ -187,59 +278,91 @@ func getFileMetaData(headers *structs.LASHeaders) *structs.LASMetaData {
 	}
 }
 
-func sendClusteredPoints(socket *structs.ConcurrentSocket, o *octree.Octree, wg *sync.WaitGroup, m *structs.LASMetaData) {
+// removeOutliers filters the tree's points and returns how many remain.
+func removeOutliers(o *octree.Octree, filter *outliers.Config) int {
+	defer utils.TimeTrack(time.Now(), "removeOutliers")
+
+	flagged := filter.Remove(o)
+
+	fmt.Println("OUTLIERS FLAGGED", flagged)
+
+	remaining := 0
+	for _, leaf := range o.Leaves {
+		remaining += o.PointCount(leaf)
+	}
+
+	return remaining
+}
+
+// sendClusteredPoints streams the clustered leaves one at a time, reading
+// spilled leaves back from disk, so the cloud is never gathered in one slice.
+// Each chunk carries its points' extra dimensions, which are kept in cache.
+func sendClusteredPoints(socket *structs.ConcurrentSocket, o *octree.Octree, m *structs.LASMetaData, dims dimensions.Set, cache *dimensions.Cache) int {
 	defer utils.TimeTrack(time.Now(), "sendClusteredPoints")
 
-	collector := []float64{}
-	pointsAfter := 0
+	totalChunks := 0
 	for _, leaf := range o.Leaves {
-		for i := 0; i < len(leaf.Points); i += constants.PointOffset {
-			leaf.Points[i] = leaf.Points[i] + m.OffsetX
-			leaf.Points[i + 1] = leaf.Points[i + 1] + m.OffsetZ
-			leaf.Points[i + 2] = leaf.Points[i + 2] + m.OffsetY
-		}
-		
-		p := leaf.Points
-		pointsAfter += len(p)
+		totalChunks += int(math.Ceil(float64(o.PointCount(leaf) * constants.PointOffset) / float64(constants.SocketChunkSize)))
+	}
 
-		collector = append(collector, p...)
+	var index *octree.NodeIndex
+	if dims.Context() {
+		index = o.IndexLeaves()
 	}
 
-	i := 0
+	pointsAfter := 0
+	for _, leaf := range o.Leaves {
+		points, err := o.ReadPoints(leaf)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
 
-	totalChunks := math.Ceil(float64(len(collector)) / float64(constants.SocketChunkSize))
+		var around []float64
+		if index != nil {
+			around = leavesAround(o, index, leaf)
+		}
 
-	for i + constants.SocketChunkSize < len(collector) {
-		wg.Add(1)
-		go func(chunk []float64) {
-			socket.Lock.Lock()
-			defer socket.Lock.Unlock()
-			defer wg.Done()
-			socket.Conn.WriteJSON(structs.PointChunk{
-				Event: "points",
-				Points: chunk,
-				TotalChunks: int(totalChunks), 
-			})
-		}(collector[i : i + constants.SocketChunkSize])
+		pointsAfter += len(points)
+		values := dims.Compute(points, around)
+		cache.Store("leaf", leaf.Id, values)
 
-		i += constants.SocketChunkSize
-	}
+		for i := 0; i < len(points); i += constants.SocketChunkSize {
+			end := i + constants.SocketChunkSize
+			if end > len(points) {
+				end = len(points)
+			}
 
-	if i < len(collector) {
-		wg.Add(1)
-		go func(chunk []float64) {
 			socket.Lock.Lock()
-			defer socket.Lock.Unlock()
-			defer wg.Done()
 			socket.Conn.WriteJSON(structs.PointChunk{
 				Event: "points",
-				Points: chunk,
-				TotalChunks: int(totalChunks), 
+				Points: utils.OffsetPoints(points[i:end], m),
+				Dimensions: dimensions.Slice(values, i / constants.PointOffset, end / constants.PointOffset),
+				TotalChunks: totalChunks, 
 			})
-		}(collector[i:])
+			socket.Lock.Unlock()
+		}
 	}
 
 	fmt.Println("POINTS AFTER ", pointsAfter / constants.PointOffset)
+
+	return pointsAfter / constants.PointOffset
+}
+
+// leavesAround returns the points of the leaves around leaf.
+func leavesAround(o *octree.Octree, index *octree.NodeIndex, leaf *octree.OctreeNode) []float64 {
+	around := []float64{}
+	for _, neighbour := range index.Around(leaf, 0)[1:] {
+		points, err := o.ReadPoints(neighbour)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		around = append(around, points...)
+	}
+
+	return around
 }
 
 func readAndSendPointsFromBuffer(socket *structs.ConcurrentSocket, buf []byte, idx int, m structs.LASMetaData, wg2 *sync.WaitGroup, subsample bool, density float64) {
@@ -249,7 +372,7 @@ func readAndSendPointsFromBuffer(socket *structs.ConcurrentSocket, buf []byte, i
 	temp := []float64{}
 
 	for i < bufferLen {
-		if !subsample || coinFlip(density) {
+		if !subsample || coinFlip(nil, density) {
 			x, z, y, r, g, b, intensity, classification := pointFormatReader(
 				buf,
 				i, 
@@ -304,12 +427,10 @@ func readAndSendPointsFromBuffer(socket *structs.ConcurrentSocket, buf []byte, i
 	wg2.Done()
 }
 
-func processWithoutClustering(socket *structs.ConcurrentSocket, parts []*structs.FilePart, headers *structs.LASHeaders, metadata *structs.LASMetaData, subsample bool, density float64) {
-	startBP := int64(headers.PointOffset)
-	windowSize := int64(metadata.PointsInWindow * uint32(headers.StructSize)) // no. of points
-	j := 0
-	wg := sync.WaitGroup{}
-
+// forEachWindow reads the point records of parts in windows of windowSize
+// bytes, stitching together windows that straddle two parts, and passes each
+// window to fn in file order.
+func forEachWindow(parts []*structs.FilePart, startBP, windowSize int64, fn func(chunk []byte)) {
 	for i := 0; i < len(parts); i++ {
 		startPart := parts[i]
 		fileSize := startPart.File.Size
@@ -319,9 +440,7 @@ func processWithoutClustering(socket *structs.ConcurrentSocket, parts []*structs
 		for startBP + windowSize < fileSize {
 			chunk := make([]byte, windowSize)
 			file.Read(chunk)
-			wg.Add(1)
-			go readAndSendPointsFromBuffer(socket, chunk, j, *metadata, &wg, subsample, density)
-			j++
+			fn(chunk)
 			file.Seek(startBP + windowSize, 0)
 			startBP += windowSize
 		}
@@ -345,9 +464,7 @@ func processWithoutClustering(socket *structs.ConcurrentSocket, parts []*structs
 			file.Read(prevChunk)
 
 			prevChunk = append(prevChunk, nextChunk...)
-			wg.Add(1)
-			go readAndSendPointsFromBuffer(socket, prevChunk, j, *metadata, &wg, subsample, density)
-			j++
+			fn(prevChunk)
 			startBP = nextSize
 
 			defer file.Close()
@@ -356,31 +473,390 @@ func processWithoutClustering(socket *structs.ConcurrentSocket, parts []*structs
 			chunkSize := fileSize - startBP
 			chunk := make([]byte, chunkSize)
 			file.Read(chunk)
-			wg.Add(1)
-			go readAndSendPointsFromBuffer(socket, chunk, j, *metadata, &wg, subsample, density)
-			j++
+			fn(chunk)
 			defer file.Close()
 		}
 	}
+}
+
+func processWithoutClustering(socket *structs.ConcurrentSocket, parts []*structs.FilePart, headers *structs.LASHeaders, metadata *structs.LASMetaData, subsample bool, density float64) {
+	startBP := int64(headers.PointOffset)
+	windowSize := int64(metadata.PointsInWindow * uint32(headers.StructSize)) // no. of points
+	j := 0
+	wg := sync.WaitGroup{}
+
+	forEachWindow(parts, startBP, windowSize, func(chunk []byte) {
+		wg.Add(1)
+		go readAndSendPointsFromBuffer(socket, chunk, j, *metadata, &wg, subsample, density)
+		j++
+	})
+
 	wg.Wait()
 }
 
+// persistDataset writes the clustered leaves, then the LOD levels and
+// artifacts once pendingWg is done, to the job's dataset.
+func persistDataset(
+	socket *structs.ConcurrentSocket,
+	dataset *datastore.Dataset,
+	o *octree.Octree,
+	headers *structs.LASHeaders,
+	pendingWg *sync.WaitGroup,
+	levels *[]*lod.Level,
+	artifacts *[]artifact,
+	dims dimensions.Set,
+	cache *dimensions.Cache,
+	exports []string,
+	tracker *diagnostics.Tracker,
+) *datastore.Dataset {
+	defer utils.TimeTrack(time.Now(), "persistDataset")
+
+	start := time.Now()
+
+	if dataset == nil {
+		pendingWg.Wait()
+		return nil
+	}
+
+	err := dataset.WriteLevel("leaf", 0, 0, o.Leaves, o.ReadPoints)
+	if err != nil {
+		fmt.Println(err)
+		pendingWg.Wait()
+		return nil
+	}
+
+	for _, leaf := range o.Leaves {
+		dataset.Info.PointCount += o.PointCount(leaf)
+	}
+
+	pendingWg.Wait()
+
+	for _, level := range *levels {
+		err = dataset.WriteLevel(level.Label, level.RenderDistance, level.GeometricError, level.OctreeNodes(), level.ReadPoints)
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+	}
+
+	for _, level := range dataset.Info.Levels {
+		if level.Label == "raw" || len(dims) == 0 {
+			continue
+		}
+
+		// Values were cached as each level was sent, so they are only
+		// computed here for nodes that were never sent.
+		label := level.Label
+		utils.PrintLoadError(dataset.WriteDimensions(label, dims.Names(), func(nodeId string, points []float64) map[string][]float64 {
+			values, ok := cache.Load(label, nodeId)
+			if !ok {
+				values = dims.Compute(points, nil)
+			}
+			return values
+		}))
+	}
+
+	written := writeArtifacts(dataset, *artifacts)
+	written = append(written, writeExports(dataset, exports, headers)...)
+
+	err = dataset.Save()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	tracker.Stage("persist", dataset.Info.PointCount, dataset.Info.PointCount, start)
+
+	socket.Lock.Lock()
+	defer socket.Lock.Unlock()
+	socket.Conn.WriteJSON(structs.DatasetEvent{
+		Event: "dataset",
+		DatasetId: dataset.Info.Id,
+	})
+
+	for _, name := range written {
+		socket.Conn.WriteJSON(structs.ArtifactEvent{
+			Event: "artifact-ready",
+			DatasetId: dataset.Info.Id,
+			Name: name,
+			Url: "/datasets/" + dataset.Info.Id + "/artifacts/" + name,
+		})
+	}
+
+	return dataset
+}
+
+// artifact is a file to store with the dataset once it has been created.
+type artifact struct {
+	name string
+	write func(w io.Writer) error
+}
+
+// writeArtifacts stores each artifact with the dataset, returning the names
+// of those written.
+func writeArtifacts(dataset *datastore.Dataset, artifacts []artifact) []string {
+	names := []string{}
+
+	for _, a := range artifacts {
+		err := dataset.WriteArtifact(a.name, a.write)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		names = append(names, a.name)
+	}
+
+	return names
+}
+
+// rasterArtifacts writes each raster in every requested format.
+func rasterArtifacts(rasters []raster.Product, config *raster.Config, headers *structs.LASHeaders) []artifact {
+	artifacts := []artifact{}
+
+	for _, product := range rasters {
+		for _, format := range config.Formats {
+			name := product.Name + ".asc"
+			write := raster.WriteASCII
+			if format == "geotiff" {
+				name = product.Name + ".tif"
+				write = raster.WriteGeoTIFF
+			}
+
+			grid := product.Grid
+			artifacts = append(artifacts, artifact{
+				name: name,
+				write: func(w io.Writer) error {
+					return write(w, grid, headers)
+				},
+			})
+		}
+	}
+
+	return artifacts
+}
+
+// contourArtifacts writes the contours in every requested format.
+func contourArtifacts(lines []contours.Line, config *contours.Config, headers *structs.LASHeaders) []artifact {
+	collection := contours.Collection(lines, headers)
+	artifacts := []artifact{}
+
+	for _, format := range config.Formats {
+		switch format {
+		case "geojson":
+			artifacts = append(artifacts, artifact{
+				name: "contours.geojson",
+				write: func(w io.Writer) error {
+					return vector.WriteGeoJSON(w, collection)
+				},
+			})
+		case "shapefile":
+			artifacts = append(artifacts, artifact{
+				name: "contours.zip",
+				write: func(w io.Writer) error {
+					return vector.WriteShapefile(w, "contours", collection)
+				},
+			})
+		case "dxf":
+			artifacts = append(artifacts, artifact{
+				name: "contours.dxf",
+				write: func(w io.Writer) error {
+					return vector.WriteDXF(w, collection)
+				},
+			})
+		}
+	}
+
+	return artifacts
+}
+
+// parseExports reads a comma separated list of export formats.
+func parseExports(value string) []string {
+	formats := []string{}
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format != "" {
+			formats = append(formats, format)
+		}
+	}
+
+	return formats
+}
+
+// writeExports stores the leaf points with their extra dimensions in each
+// requested format, "csv" or "ply", returning the names of those written.
+func writeExports(dataset *datastore.Dataset, formats []string, headers *structs.LASHeaders) []string {
+	names := []string{}
+
+	source := func(visit func(points []float64, values map[string][]float64)) error {
+		return dataset.EachSegment("leaf", func(nodeId string, points []float64) {
+			values, err := dataset.ReadDimensions("leaf", nodeId)
+			utils.PrintLoadError(err)
+			visit(points, values)
+		})
+	}
+
+	for _, format := range formats {
+		var err error
+		name := "points." + format
+
+		switch format {
+		case "csv":
+			err = dataset.WriteArtifact(name, func(w io.Writer) error {
+				return filewriter.WriteCSV(w, source, dataset.Info.Dimensions, headers)
+			})
+		case "ply":
+			err = dataset.WriteArtifact(name, func(w io.Writer) error {
+				return filewriter.WritePLY(w, source, dataset.Info.PointCount, dataset.Info.Dimensions, headers)
+			})
+		default:
+			continue
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// sendDiagnostics reports on a finished job over the socket, and keeps a copy
+// with the dataset so it can be fetched later.
+func sendDiagnostics(socket *structs.ConcurrentSocket, tracker *diagnostics.Tracker, dataset *datastore.Dataset) {
+	datasetId := ""
+	if dataset != nil {
+		datasetId = dataset.Info.Id
+	}
+
+	report := tracker.Report(datasetId)
+
+	if dataset != nil {
+		utils.PrintLoadError(dataset.WriteJSON("diagnostics.json", report))
+	}
+
+	socket.Lock.Lock()
+	defer socket.Lock.Unlock()
+	socket.Conn.WriteJSON(report)
+}
+
+// StreamDataset sends a stored dataset to a socket the same way a freshly
+// processed file is sent: headers, the clustered points, then its LOD levels.
+func StreamDataset(socket *structs.ConcurrentSocket, dataset *datastore.Dataset) {
+	defer utils.TimeTrack(time.Now(), "StreamDataset")
+
+	m := &dataset.Info.Metadata
+
+	SendHeaders(socket, dataset.Info.Headers)
+
+	leafLevel := dataset.Level("leaf")
+	if leafLevel == nil {
+		sendDone(socket)
+		return
+	}
+
+	totalChunks := 0
+	for _, segment := range leafLevel.Segments {
+		totalChunks += int(math.Ceil(float64(segment.Length) / float64(constants.SocketChunkSize)))
+	}
+
+	err := dataset.EachSegment("leaf", func(nodeId string, points []float64) {
+		values, err := dataset.ReadDimensions("leaf", nodeId)
+		utils.PrintLoadError(err)
+
+		for i := 0; i < len(points); i += constants.SocketChunkSize {
+			end := i + constants.SocketChunkSize
+			if end > len(points) {
+				end = len(points)
+			}
+
+			socket.Lock.Lock()
+			socket.Conn.WriteJSON(structs.PointChunk{
+				Event: "points",
+				Points: utils.OffsetPoints(points[i:end], m),
+				Dimensions: dimensions.Slice(values, i / constants.PointOffset, end / constants.PointOffset),
+				TotalChunks: totalChunks,
+			})
+			socket.Lock.Unlock()
+		}
+	})
+	utils.PrintLoadError(err)
+
+	sendDone(socket)
+
+	for _, stored := range dataset.Info.Levels {
+		// The raw points are kept for measurement, not for viewing.
+		if stored.Label == "leaf" || stored.Label == "raw" {
+			continue
+		}
+
+		level := &lod.Level{
+			Label: stored.Label,
+			RenderDistance: stored.RenderDistance,
+			GeometricError: stored.GeometricError,
+			Nodes: []*lod.Node{},
+		}
+
+		err := dataset.EachSegment(stored.Label, func(nodeId string, points []float64) {
+			values, err := dataset.ReadDimensions(stored.Label, nodeId)
+			utils.PrintLoadError(err)
+
+			level.Depth = len(nodeId) - 1
+			level.Nodes = append(level.Nodes, &lod.Node{
+				Points: points,
+				Dimensions: values,
+			})
+		})
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		lod.SendLevel(socket, level, m)
+	}
+
+	report, err := dataset.ReadFile("diagnostics.json")
+	if err == nil {
+		socket.Lock.Lock()
+		socket.Conn.WriteMessage(websocket.TextMessage, report)
+		socket.Lock.Unlock()
+	}
+}
+
 func ProcessFileParts(
 	uploaderId string, 
 	filePartMapping *map[string][]*structs.FilePart,
 	socket *structs.ConcurrentSocket, 
+	datasets *datastore.Store,
 	options *structs.ProcessingOptions,
 ) {
 	defer utils.TimeTrack(time.Now(), "ProcessFileParts")
 
 	utils.SendProgress("Parsing point cloud file...", socket)
 
+	tracker := diagnostics.NewTracker()
+
 	parts := (*filePartMapping)[uploaderId]
 
 	clusteringFlag, _ := strconv.ParseBool(options.Clustering)
 	subsampleFlag, _ := strconv.ParseBool(options.Subsample)
 	lodFlag, _ := strconv.ParseBool(options.Lod)
 	densityValue, _ := strconv.ParseFloat(options.Density, 64)
+	outOfCoreFlag, _ := strconv.ParseBool(options.OutOfCore)
+	memoryBudget, err := strconv.Atoi(options.MemoryBudget)
+	if err != nil || memoryBudget <= 0 {
+		memoryBudget = constants.OutOfCoreBatchSize
+	}
+	pointBudget, _ := strconv.Atoi(options.PointBudget)
+	metricsFlag, _ := strconv.ParseBool(options.Metrics)
+	heightFlag, _ := strconv.ParseBool(options.HeightAboveGround)
+	// Keeping the full resolution points about doubles a dataset's size on
+	// disk, so jobs opt in; volumes are measured on the leaves without them.
+	keepRawFlag, _ := strconv.ParseBool(options.KeepRaw)
+	exports := parseExports(options.Export)
 
 	sort.Slice(parts, func(i, j int) bool {
 		return parts[i].ChunkNumber < parts[j].ChunkNumber
@@ -415,66 +891,67 @@ func ProcessFileParts(
 
 	fmt.Println("OCTREE DIMENSIONS", o.Root.X1, o.Root.X2, o.Root.Y1, o.Root.Y2, o.Root.Z1, o.Root.Z2)
 
-	pointBeforeTree := 0
+	if outOfCoreFlag {
+		store, err := spill.NewStore(constants.WorkingDirectory)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			o.Store = store
+		}
+	}
 
-	var wg sync.WaitGroup;
+	pointBeforeTree := 0
+	loadStart := time.Now()
 
-	for i := 0; i < len(parts); i++ {
-		startPart := parts[i]
-		fileSize := startPart.File.Size
-		file, _ := startPart.File.Open()
-		file.Seek(startBP, 0)
+	outlierFilter := outliers.FromOptions(options)
+	var loadFilter *outliers.Config
+	if outlierFilter != nil && outlierFilter.Stage == "load" {
+		loadFilter = outlierFilter
+	}
 
-		for startBP + windowSize < fileSize {
-			chunk := make([]byte, windowSize)
-			file.Read(chunk)
-			pointBeforeTree += len(chunk)
-			wg.Add(1);
-			go LoadData(socket, chunk, metadata, o, &wg, subsampleFlag, densityValue)
-			file.Seek(startBP + windowSize, 0)
-			startBP += windowSize
-		}
-		
-		if startBP == fileSize {
-			startBP = 0
-			defer file.Close()
-			continue
-		}
+	var wg sync.WaitGroup;
 
-		if startBP < fileSize && i + 1 < len(parts) {
-			prevSize := fileSize - startBP
-			nextSize := windowSize - prevSize
+	// Out-of-core trees bound how many windows are parsed at once, so that
+	// memory is held by at most a few windows and the unspilled node buffers.
+	var sem chan struct{}
+	if outOfCoreFlag {
+		sem = make(chan struct{}, runtime.NumCPU())
+	}
 
-			nextFile, _ := parts[i + 1].File.Open()
-			nextChunk := make([]byte, nextSize)
-			nextFile.Read(nextChunk)
+	// Seeded jobs subsample each window from its own generator, so the kept
+	// points don't depend on how the windows' goroutines are scheduled.
+	clusteringConfig := kmeans.ConfigFromOptions(options)
+	window := int64(0)
 
-			file.Seek(startBP, 0)
-			prevChunk := make([]byte, prevSize)
-			file.Read(prevChunk)
+	forEachWindow(parts, startBP, windowSize, func(chunk []byte) {
+		pointBeforeTree += len(chunk)
+		wg.Add(1);
 
-			prevChunk = append(prevChunk, nextChunk...)
-			wg.Add(1);
-			pointBeforeTree += len(prevChunk)
-			go LoadData(socket, prevChunk, metadata, o, &wg, subsampleFlag, densityValue)
-			startBP = nextSize
+		var rng *rand.Rand
+		if clusteringConfig.Seeded {
+			rng = rand.New(rand.NewSource(int64(clusteringConfig.Seed) + window))
+		}
+		window++
 
-			defer file.Close()
-			defer nextFile.Close()
-		} else {
-			chunkSize := fileSize - startBP
-			chunk := make([]byte, chunkSize)
-			file.Read(chunk)
-			wg.Add(1);
-			pointBeforeTree += len(chunk)
-			go LoadData(socket, chunk, metadata, o, &wg, subsampleFlag, densityValue)
-			defer file.Close()
+		if sem == nil {
+			go LoadData(socket, chunk, metadata, o, &wg, subsampleFlag, densityValue, rng, loadFilter)
+			return
 		}
-	}
+
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			LoadData(socket, chunk, metadata, o, &wg, subsampleFlag, densityValue, rng, loadFilter)
+		}()
+	})
 
 	wg.Wait()
 	fmt.Println("WAIT GROUP DONE")
 
+	if clusteringConfig.Seeded {
+		o.SortLeaves()
+	}
+
 	utils.SendProgress("Optimizing data...", socket)
 
 	fmt.Println("POINT BEFORE ADDED TO TREE ", pointBeforeTree / int(headers.StructSize))
@@ -482,37 +959,249 @@ func ProcessFileParts(
 	totalPoints := 0
 
 	for _, leaf := range o.Leaves {
-		totalPoints += len(leaf.Points)
+		totalPoints += o.PointCount(leaf)
+	}
+
+	fmt.Println("POINTS BEFORE CLUSTERING", totalPoints);
+
+	tracker.Stage("load", pointBeforeTree / int(headers.StructSize), totalPoints, loadStart)
+
+	// Unless they were filtered from each window, outliers are removed once
+	// the tree is loaded, so each point can be compared with its neighbours
+	// in the leaves around it.
+	if outlierFilter != nil && outlierFilter.Stage == "tree" {
+		utils.SendProgress("Removing outliers...", socket)
+
+		outlierStart := time.Now()
+		pointsIn := totalPoints
+		totalPoints = removeOutliers(o, outlierFilter)
+		tracker.Stage("outliers", pointsIn, totalPoints, outlierStart)
+	}
+
+	groundFilter := ground.FromOptions(options)
+	if groundFilter != nil {
+		utils.SendProgress("Classifying ground...", socket)
+
+		groundStart := time.Now()
+		groundPoints := groundFilter.Classify(o)
+		fmt.Println("GROUND POINTS", groundPoints)
+		tracker.Stage("ground", totalPoints, totalPoints, groundStart)
+		tracker.Count("ground", "ground", groundPoints)
+	}
+
+	// The dataset is created before clustering so that it can keep the full
+	// resolution points, which measurements such as volumes are taken from.
+	dataset, err := datasets.Create(parts[0].File.Filename, headers, metadata)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if dataset != nil && keepRawFlag {
+		rawStart := time.Now()
+		utils.PrintLoadError(dataset.WriteLevel("raw", 0, 0, o.Leaves, o.ReadPoints))
+		tracker.Stage("raw", totalPoints, totalPoints, rawStart)
 	}
 
-	fmt.Println("POINTS BEFORE CLUSTERING", totalPoints / constants.PointOffset);
+	leafSource := func(visit func(points []float64)) {
+		for _, leaf := range o.Leaves {
+			points, err := o.ReadPoints(leaf)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			visit(points)
+		}
+	}
+
+	// Rasters are taken from the full resolution points, before clustering
+	// thins them out.
+	rasterConfig := raster.FromOptions(options)
+	artifacts := []artifact{}
+	if rasterConfig != nil {
+		utils.SendProgress("Rasterising...", socket)
+
+		rasterStart := time.Now()
+		rasters := raster.Rasterise(leafSource, headers, rasterConfig)
+		artifacts = append(artifacts, rasterArtifacts(rasters, rasterConfig, headers)...)
+		tracker.Stage("raster", totalPoints, totalPoints, rasterStart)
+	}
+
+	// Heights above ground and contours both come from a DTM of the full
+	// resolution ground points, so clustered and LOD points share the same
+	// surface.
+	contourConfig := contours.FromOptions(options)
+	var surface *raster.Grid
+	if heightFlag || contourConfig != nil {
+		resolution := constants.RasterResolution
+		if rasterConfig != nil {
+			resolution = rasterConfig.Resolution
+		}
+
+		surfaceStart := time.Now()
+		surface = raster.GroundSurface(leafSource, headers, resolution)
+		if surface == nil {
+			fmt.Println("NO GROUND POINTS, SKIPPING HEIGHT ABOVE GROUND AND CONTOURS")
+		}
+		tracker.Stage("surface", totalPoints, totalPoints, surfaceStart)
+	}
+
+	dims := dimensions.Set{}
+	dimensionCache := dimensions.NewCache()
+	if heightFlag && surface != nil {
+		dims = append(dims, dimensions.HeightAboveGroundOf(surface))
+	}
+
+	// Normals are estimated on each node's points and its neighbours', so
+	// clustered and LOD points get normals of the surface they show.
+	normalConfig := normals.FromOptions(options)
+	if normalConfig != nil {
+		dims = append(dims, normalConfig.Dimensions(headers)...)
+	}
+
+	if contourConfig != nil && surface != nil {
+		utils.SendProgress("Tracing contours...", socket)
+
+		contourStart := time.Now()
+		lines := contourConfig.Generate(surface, headers.Offset[2])
+		fmt.Println("CONTOUR LINES", len(lines))
+		contours.Send(socket, lines, metadata)
+		artifacts = append(artifacts, contourArtifacts(lines, contourConfig, headers)...)
+		tracker.Stage("contours", totalPoints, totalPoints, contourStart)
+	}
+
+	tracker.Octree(o)
 
 	utils.SendProgress("Clustering points...", socket)
 
-	clusteringWg := sync.WaitGroup{}
+	clusterStart := time.Now()
 
-	octree.ClusterPoints(socket, &o.Leaves, &clusteringWg);
+	pointReducer := reducer.FromOptions(options, tracker.Timings)
 
-	clusteringWg.Wait()
+	var targets map[*octree.OctreeNode]int
+	if pointBudget > 0 {
+		targets = o.AllocateBudget(pointBudget, options.BudgetWeighting)
+	}
+
+	var collector *metrics.Collector
+	if metricsFlag {
+		collector = metrics.NewCollector()
+	}
+
+	if o.Store != nil {
+		octree.ClusterPointsInBatches(socket, o, memoryBudget, pointReducer, targets, collector)
+	} else {
+		clusteringWg := sync.WaitGroup{}
+
+		octree.ClusterPoints(socket, &o.Leaves, &clusteringWg, pointReducer, targets, collector);
+
+		clusteringWg.Wait()
+	}
+
+	if collector != nil {
+		tracker.Simplification(collector)
+	}
 
 	fmt.Println("DONE CLUSTERING")
 
-	kmeans.GlobalTimetracker.Range(func(key string, value interface{}) bool {
+	tracker.Timings.Range(func(key string, value interface{}) bool {
 		fmt.Println(key, value);
 		return true
 	});
 
-	sendingWg := sync.WaitGroup{}
+	clusteredPoints := 0
+	for _, leaf := range o.Leaves {
+		clusteredPoints += o.PointCount(leaf)
+	}
+
+	tracker.Stage("cluster", totalPoints, clusteredPoints, clusterStart)
 
-	sendClusteredPoints(socket, o, &sendingWg, metadata)
+	sendStart := time.Now()
+	sentPoints := sendClusteredPoints(socket, o, metadata, dims, dimensionCache)
+	tracker.Stage("send", clusteredPoints, sentPoints, sendStart)
+
+	postWg := sync.WaitGroup{}
+	pendingWg := sync.WaitGroup{}
+	levels := []*lod.Level{}
 
-	sendingWg.Wait()
-	
 	if lodFlag {
-		go lod.GenerateAndSendLod(socket, o.Leaves, metadata)
+		pendingWg.Add(1)
+		go func() {
+			defer pendingWg.Done()
+			lodStart := time.Now()
+			levels = lod.GenerateAndSendLod(socket, o, metadata, lod.ParseConfig(options, o.Granularity), pointReducer, dims, dimensionCache)
+
+			lodPoints := 0
+			for _, level := range levels {
+				for _, node := range level.Nodes {
+					lodPoints += len(node.Points) / constants.PointOffset
+				}
+			}
+			tracker.Stage("lod", clusteredPoints, lodPoints, lodStart)
+
+			for _, level := range levels {
+				if level.Metrics != nil {
+					tracker.Level(level.Label, level.Metrics)
+				}
+			}
+		}()
 	}
 
-	go filewriter.CreateOptimisedFile(socket, parts, o.Leaves, headers)
+	// Shapes are found among the clustered leaves, so their inlier IDs index
+	// the points just streamed. The leaves no longer change, so detection
+	// runs alongside the LOD levels and persist waits for its artifact.
+	shapeConfig := shapes.FromOptions(options)
+	if shapeConfig != nil {
+		pendingWg.Add(1)
+		go func() {
+			defer pendingWg.Done()
+			shapeStart := time.Now()
+
+			found := shapeConfig.DetectTree(o, dimensionCache)
+			fmt.Println("SHAPES", len(found))
+			shapes.Send(socket, found, metadata)
+
+			segments := shapes.Segments(found, headers)
+			artifacts = append(artifacts, artifact{
+				name: "shapes.json",
+				write: func(w io.Writer) error {
+					return json.NewEncoder(w).Encode(segments)
+				},
+			})
+
+			supported := 0
+			for _, s := range found {
+				supported += len(s.Inliers)
+			}
+			tracker.Stage("shapes", clusteredPoints, clusteredPoints, shapeStart)
+			tracker.Count("shapes", "shapes", len(found))
+			tracker.Count("shapes", "inliers", supported)
+		}()
+	}
+
+	postWg.Add(1)
+	go func() {
+		defer postWg.Done()
+		exportStart := time.Now()
+		exported := filewriter.CreateOptimisedFile(socket, parts, o, headers)
+		tracker.Stage("export", clusteredPoints, exported, exportStart)
+	}()
+
+	var stored *datastore.Dataset
+
+	postWg.Add(1)
+	go func() {
+		defer postWg.Done()
+		stored = persistDataset(socket, dataset, o, headers, &pendingWg, &levels, &artifacts, dims, dimensionCache, exports, tracker)
+	}()
+
+	go func() {
+		postWg.Wait()
+		if o.Store != nil {
+			utils.PrintLoadError(o.Store.Close())
+		}
+		sendDiagnostics(socket, tracker, stored)
+	}()
 
 	fmt.Println("DONE SENDING CLUSTERED CHUNKS")
 
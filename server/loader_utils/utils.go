@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"lidar/constants"
 	"lidar/structs"
 	"log"
+	"math"
 	"mime/multipart"
 	"time"
 
 	"github.com/puzpuzpuz/xsync"
+	"golang.org/x/exp/rand"
 )
 
 const (
@@ -121,7 +124,7 @@ func TimeTrackMap(start time.Time, name string, mapping *xsync.Map) {
 	if ok {
 		(*mapping).Store(name, elapsed.Milliseconds() + val.(int64))
 	} else {
-		(*mapping).Store(name, int64(0))
+		(*mapping).Store(name, elapsed.Milliseconds())
 	}
 }
 
@@ -185,6 +188,20 @@ func DetermineColor(color uint16, classification uint8, idx int) float64 {
 	return 1.0;
 }
 
+// OffsetPoints returns a copy of points shifted into the client's coordinate space.
+func OffsetPoints(points []float64, m *structs.LASMetaData) []float64 {
+	res := make([]float64, len(points))
+	copy(res, points)
+
+	for i := 0; i < len(res); i += constants.PointOffset {
+		res[i] += m.OffsetX
+		res[i + 1] += m.OffsetZ
+		res[i + 2] += m.OffsetY
+	}
+
+	return res
+}
+
 func SendProgress(message string, socket *structs.ConcurrentSocket) {
 	go func() {
 		socket.Lock.Lock()
@@ -214,4 +231,32 @@ var ColorClassifications [][3]float64 = [][3]float64{
 	{255, 255, 0},
 	{255, 255, 0},
 	{255, 255, 0},
-}
\ No newline at end of file
+}
+// PointsRand returns a generator seeded from seed and the points themselves.
+// Point hashes are summed, so the seed does not depend on point order.
+func PointsRand(seed uint64, points []float64) *rand.Rand {
+	var sum uint64 = 0
+	for i := 0; i < len(points); i += constants.PointOffset {
+		sum += HashPoint(0, points[i : i + constants.PointOffset])
+	}
+
+	return rand.New(rand.NewSource(mix64(seed ^ sum)))
+}
+
+// HashPoint mixes the values of a point record into seed.
+func HashPoint(seed uint64, point []float64) uint64 {
+	h := seed
+	for _, value := range point {
+		h = mix64(h ^ math.Float64bits(value))
+	}
+
+	return h
+}
+
+// mix64 is the splitmix64 finaliser.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
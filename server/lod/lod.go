@@ -2,82 +2,352 @@ package lod
 
 import (
 	"fmt"
-	"lidar/kmeans"
+	"lidar/dimensions"
+	utils "lidar/loader_utils"
+	"lidar/metrics"
 	"lidar/octree"
+	"lidar/reducer"
 	"lidar/structs"
 	"lidar/constants"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
-
-	"github.com/emirpasic/gods/sets/hashset"
 )
 
-func GenerateAndSendLod(socket *structs.ConcurrentSocket, leaves []*octree.OctreeNode, m *structs.LASMetaData) {
-	mediumLod := generateLod(leaves)
-	lowLod := generateLod(mediumLod)
+// Node holds the reduced points of one octree node at one level. Levels are
+// computed into their own buffers; the octree's points are only ever read.
+type Node struct {
+	Node *octree.OctreeNode
+	Points []float64
+	// Dimensions holds the points' extra dimensions, if the job has any.
+	Dimensions map[string][]float64
+}
 
-	sendLod(socket, mediumLod, 200, m, "medium")
-	sendLod(socket, lowLod, 400, m, "low")
+type Level struct {
+	Label string
+	Depth int
+	RenderDistance float64
+	GeometricError float64
+	Nodes []*Node
+	// Metrics measures each node against the level it was reduced from, and
+	// is nil unless the job asked for metrics.
+	Metrics *metrics.Collector
+	index map[*octree.OctreeNode]*Node
 }
 
-func sendLod(
-	socket *structs.ConcurrentSocket, 
-	pointChunks []*octree.OctreeNode, 
-	renderDistance float64, 
-	m *structs.LASMetaData,
-	label string,
-) {
-	go func() {
-		points := []float64{}
+func newLevel(nodes []*Node) *Level {
+	index := make(map[*octree.OctreeNode]*Node, len(nodes))
+	for _, node := range nodes {
+		index[node.Node] = node
+	}
+
+	return &Level{
+		Nodes: nodes,
+		index: index,
+	}
+}
+
+func (l *Level) OctreeNodes() []*octree.OctreeNode {
+	res := make([]*octree.OctreeNode, len(l.Nodes))
+	for i, node := range l.Nodes {
+		res[i] = node.Node
+	}
+
+	return res
+}
+
+// ReadPoints returns the level's points for an octree node.
+func (l *Level) ReadPoints(node *octree.OctreeNode) ([]float64, error) {
+	lodNode, ok := l.index[node]
+	if !ok {
+		return []float64{}, nil
+	}
+
+	return lodNode.Points, nil
+}
+
+type LevelConfig struct {
+	Label string
+	TargetPoints int
+	RenderDistance float64
+	GeometricError float64
+}
+
+type Config struct {
+	Levels []LevelConfig
+	Metrics bool
+}
+
+// ParseConfig builds a pyramid from the upload options. By default, and when
+// the level count is zero or deeper than the octree, every level up to the
+// root is generated. Lists of targets, distances or errors shorter than the
+// level count are extended: target points repeat their last value, distances
+// and errors double each level.
+func ParseConfig(options *structs.ProcessingOptions, depth int) *Config {
+	measure, _ := strconv.ParseBool(options.Metrics)
+
+	count, _ := strconv.Atoi(options.LodLevels)
+	if count <= 0 || count > depth {
+		count = depth
+	}
+
+	points := parseList(options.LodPoints)
+	distances := parseList(options.LodDistances)
+	errors := parseList(options.LodErrors)
+
+	config := &Config{
+		Levels: make([]LevelConfig, count),
+		Metrics: measure,
+	}
+
+	for i := 0; i < count; i++ {
+		config.Levels[i] = LevelConfig{
+			Label: "lod-" + strconv.Itoa(i + 1),
+			TargetPoints: int(extendList(points, i, 1, 0)),
+			RenderDistance: extendList(distances, i, 2, 200),
+			GeometricError: extendList(errors, i, 2, 0),
+		}
+	}
+
+	return config
+}
+
+func parseList(value string) []float64 {
+	res := []float64{}
+
+	for _, field := range strings.Split(value, ",") {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err == nil {
+			res = append(res, parsed)
+		}
+	}
+
+	return res
+}
+
+func extendList(values []float64, i int, factor, fallback float64) float64 {
+	if len(values) == 0 {
+		if fallback == 0 {
+			return 0
+		}
+		return fallback * math.Pow(factor, float64(i))
+	}
+
+	if i < len(values) {
+		return values[i]
+	}
+
+	return values[len(values) - 1] * math.Pow(factor, float64(i - len(values) + 1))
+}
 
-		for _, chunk := range pointChunks {
-			nodePoints := make([]float64, len(chunk.Points))
+// computeDimensions gives every node of the level its points' extra
+// dimensions, looking at the level's neighbouring nodes when a dimension
+// asks for them. The level is held in memory, so dimensions that can are
+// prepared once over all of its points rather than gathering each node's
+// neighbours.
+func (l *Level) computeDimensions(o *octree.Octree, dims dimensions.Set, cache *dimensions.Cache) {
+	if dims.Context() {
+		total := 0
+		for _, node := range l.Nodes {
+			total += len(node.Points)
+		}
+
+		all := make([]float64, 0, total)
+		for _, node := range l.Nodes {
+			all = append(all, node.Points...)
+		}
+		dims = dims.Prepare(all)
+	}
+
+	var index *octree.NodeIndex
+	if dims.Context() {
+		index = o.IndexNodes(l.OctreeNodes(), l.Depth)
+	}
+
+	for _, node := range l.Nodes {
+		var around []float64
+		if index != nil {
+			for _, neighbour := range index.Around(node.Node, 0)[1:] {
+				around = append(around, l.index[neighbour].Points...)
+			}
+		}
+
+		node.Dimensions = dims.Compute(node.Points, around)
+		cache.Store(l.Label, node.Node.Id, node.Dimensions)
+	}
+}
+
+// GenerateAndSendLod builds the configured levels from the leaves upwards,
+// sending each as soon as it is ready along with the points' extra
+// dimensions, which are kept in cache. It stops early at the root.
+func GenerateAndSendLod(socket *structs.ConcurrentSocket, o *octree.Octree, m *structs.LASMetaData, config *Config, r reducer.Reducer, dims dimensions.Set, cache *dimensions.Cache) []*Level {
+	levels := []*Level{}
+	children := o.Leaves
+	read := o.ReadPoints
 
-			copy(nodePoints, chunk.Points)
+	for i, levelConfig := range config.Levels {
+		var collector *metrics.Collector
+		if config.Metrics {
+			collector = metrics.NewCollector()
+		}
 
-			points = append(points, nodePoints...)
+		nodes := generateLod(children, read, levelConfig.TargetPoints, r, collector)
+		if len(nodes) == 0 {
+			break
 		}
 
-		fmt.Println("LOD POINT LENGTH ", len(points) / constants.PointOffset)
+		level := newLevel(nodes)
+		level.Label = levelConfig.Label
+		level.Depth = o.Granularity - i - 1
+		level.RenderDistance = levelConfig.RenderDistance
+		level.GeometricError = levelConfig.GeometricError
+		level.Metrics = collector
+		levels = append(levels, level)
+
+		level.computeDimensions(o, dims, cache)
+
+		children = level.OctreeNodes()
+		read = level.ReadPoints
+
+		go SendLevel(socket, level, m)
+	}
+
+	return levels
+}
+
+// SendLevel streams a level in chunks of SocketChunkSize values, numbered
+// by Sequence out of TotalChunks, then sends a lod-done event for the level.
+func SendLevel(
+	socket *structs.ConcurrentSocket, 
+	level *Level,
+	m *structs.LASMetaData,
+) {
+	total := 0
+	for _, node := range level.Nodes {
+		total += len(node.Points)
+	}
 
+	fmt.Println("LOD POINT LENGTH ", total / constants.PointOffset)
+
+	totalChunks := int(math.Ceil(float64(total) / float64(constants.SocketChunkSize)))
+	sequence := 0
+	chunk := make([]float64, 0, constants.SocketChunkSize)
+	var values map[string][]float64
+
+	flush := func() {
 		socket.Lock.Lock()
 		socket.Conn.WriteJSON(structs.LODChunk{
 			Event: "lod-points",
-			Points: points,
-			TotalChunks: 0,
-			RenderDistance: renderDistance,
-			Label: label,
+			Points: utils.OffsetPoints(chunk, m),
+			Dimensions: values,
+			Sequence: sequence,
+			TotalChunks: totalChunks,
+			RenderDistance: level.RenderDistance,
+			GeometricError: level.GeometricError,
+			Depth: level.Depth,
+			Label: level.Label,
 		})
 		socket.Lock.Unlock()
-	}()
+
+		sequence++
+		chunk = chunk[:0]
+		values = nil
+	}
+
+	for _, node := range level.Nodes {
+		points := node.Points
+		start := 0
+
+		for len(points) > 0 {
+			n := constants.SocketChunkSize - len(chunk)
+			if n > len(points) {
+				n = len(points)
+			}
+
+			chunk = append(chunk, points[:n]...)
+			points = points[n:]
+
+			end := start + n / constants.PointOffset
+			values = dimensions.Append(values, dimensions.Slice(node.Dimensions, start, end))
+			start = end
+
+			if len(chunk) == constants.SocketChunkSize {
+				flush()
+			}
+		}
+	}
+
+	if len(chunk) > 0 {
+		flush()
+	}
+
+	socket.Lock.Lock()
+	defer socket.Lock.Unlock()
+	socket.Conn.WriteJSON(structs.LODDoneEvent{
+		Event: "lod-done",
+		Label: level.Label,
+		RenderDistance: level.RenderDistance,
+		TotalChunks: totalChunks,
+		PointCount: total / constants.PointOffset,
+	})
 }
 
-func generateLod(leaves []*octree.OctreeNode) []*octree.OctreeNode {
-	parents := hashset.New()
-	for _, leaf := range leaves {
-		parents.Add(leaf.Parent)
+// generateLod merges the points of each child into a new buffer for its
+// parent and reduces it to targetPoints points, or to the reducer's own choice
+// when targetPoints is zero. The children's points are read through read and
+// are never modified.
+func generateLod(children []*octree.OctreeNode, read func(*octree.OctreeNode) ([]float64, error), targetPoints int, r reducer.Reducer, collector *metrics.Collector) []*Node {
+	groups := map[*octree.OctreeNode][]*octree.OctreeNode{}
+	for _, child := range children {
+		if child.Parent != nil {
+			groups[child.Parent] = append(groups[child.Parent], child)
+		}
+	}
+
+	res := make([]*Node, 0, len(groups))
+	for parent := range groups {
+		res = append(res, &Node{
+			Node: parent,
+		})
 	}
 
-	res := make([]*octree.OctreeNode, parents.Size())
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Node.Id < res[j].Node.Id
+	})
 
 	wg := sync.WaitGroup{}
 	
-	wg.Add(parents.Size())
+	wg.Add(len(res))
 
-	for i, parent := range parents.Values() {
-		castedParent := parent.(*octree.OctreeNode)
+	// Children may live on disk, so only load as many parents as can be
+	// clustered at once.
+	sem := make(chan struct{}, runtime.NumCPU())
 
-		for _, child := range castedParent.Children {
-			castedParent.Points = append(castedParent.Points, child.Points...)
-		}
-
-		go func(i int) {
+	for _, node := range res {
+		sem <- struct{}{}
+		go func(node *Node) {
 			defer wg.Done()
-			castedParent.Points = kmeans.KMeansClustering(castedParent.Points)
-			res[i] = castedParent
-		}(i)
+			defer func() { <-sem }()
+
+			points := []float64{}
+			for _, child := range groups[node.Node] {
+				childPoints, err := read(child)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				points = append(points, childPoints...)
+			}
+
+			node.Points = r.Reduce(points, targetPoints)
+			collector.Node(node.Node.Id, points, node.Points)
+		}(node)
 	}
 
 	wg.Wait()
 
 	return res
-}
\ No newline at end of file
+}
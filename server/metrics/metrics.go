@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	c "lidar/constants"
+	"lidar/kdtree"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+// Collector accumulates simplification error over the nodes of one
+// reduction, such as the leaves of a job or the nodes of a LOD level. Each
+// node is compared only with its own input, so a reduced point is never
+// matched to an original in a neighbouring node.
+type Collector struct {
+	Mutex sync.Mutex
+	total nodeError
+	nodes []structs.NodeError
+}
+
+// nodeError holds running sums from which the reported metrics are derived.
+type nodeError struct {
+	pointsIn int
+	pointsOut int
+	forwardMax float64
+	backwardMax float64
+	sum float64
+	sumSquared float64
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		nodes: []structs.NodeError{},
+	}
+}
+
+// Node measures how far a node's reduced points lie from its original ones.
+// A KD-tree over the original points gives each reduced point's distance to
+// the data it stands for; one over the reduced points gives each original
+// point's distance to its nearest representative.
+func (c *Collector) Node(id string, original, reduced []float64) {
+	if c == nil {
+		return
+	}
+
+	e := measure(original, reduced)
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	c.nodes = append(c.nodes, structs.NodeError{
+		NodeId: id,
+		ErrorMetrics: e.metrics(),
+	})
+
+	c.total.pointsIn += e.pointsIn
+	c.total.pointsOut += e.pointsOut
+	c.total.forwardMax = math.Max(c.total.forwardMax, e.forwardMax)
+	c.total.backwardMax = math.Max(c.total.backwardMax, e.backwardMax)
+	c.total.sum += e.sum
+	c.total.sumSquared += e.sumSquared
+}
+
+// Summary combines every node measured so far.
+func (c *Collector) Summary() structs.ErrorMetrics {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return c.total.metrics()
+}
+
+// Nodes returns the per-node metrics in node ID order.
+func (c *Collector) Nodes() []structs.NodeError {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	nodes := make([]structs.NodeError, len(c.nodes))
+	copy(nodes, c.nodes)
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].NodeId < nodes[j].NodeId
+	})
+
+	return nodes
+}
+
+func measure(original, reduced []float64) nodeError {
+	e := nodeError{
+		pointsIn: len(original) / pointOffset,
+		pointsOut: len(reduced) / pointOffset,
+	}
+
+	if len(original) == 0 || len(reduced) == 0 {
+		return e
+	}
+
+	_, originalTree := kdtree.ConstructTree(original, 0)
+	_, reducedTree := kdtree.ConstructTree(reduced, 0)
+
+	for i := 0; i < len(reduced); i += pointOffset {
+		n, _ := originalTree.Nearest(reduced[i:])
+		d := math.Sqrt(n.DistanceSquared)
+		e.backwardMax = math.Max(e.backwardMax, d)
+	}
+
+	for i := 0; i < len(original); i += pointOffset {
+		n, _ := reducedTree.Nearest(original[i:])
+		d := n.DistanceSquared
+		e.sumSquared += d
+		d = math.Sqrt(d)
+		e.sum += d
+		e.forwardMax = math.Max(e.forwardMax, d)
+	}
+
+	return e
+}
+
+func (e nodeError) metrics() structs.ErrorMetrics {
+	m := structs.ErrorMetrics{
+		PointsIn: e.pointsIn,
+		PointsOut: e.pointsOut,
+		HausdorffForward: e.forwardMax,
+		HausdorffBackward: e.backwardMax,
+		Hausdorff: math.Max(e.forwardMax, e.backwardMax),
+	}
+
+	if e.pointsIn > 0 {
+		m.ReductionRatio = float64(e.pointsOut) / float64(e.pointsIn)
+		m.MeanDistance = e.sum / float64(e.pointsIn)
+		m.RmsDistance = math.Sqrt(e.sumSquared / float64(e.pointsIn))
+	}
+
+	return m
+}
@@ -0,0 +1,224 @@
+package normals
+
+import (
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	c "lidar/constants"
+	"lidar/dimensions"
+	"lidar/geometry"
+	"lidar/kdtree"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+// Dimension names follow the PLY convention, with nx and ny horizontal and
+// nz up, in real-world axes rather than the point layout's.
+const (
+	NormalX string = "nx"
+	NormalY string = "ny"
+	NormalZ string = "nz"
+	Curvature string = "curvature"
+)
+
+// Config sets how normals are estimated. Each normal is the direction of
+// least variance of a point's K nearest neighbours. Orientation is "up" to
+// point normals upwards, "scanner" to point them towards Scanner, given in
+// real-world coordinates, or "none" to leave their sign as it falls.
+type Config struct {
+	K int
+	Orientation string
+	Scanner []float64
+}
+
+// FromOptions returns nil when the job asked for no normals.
+func FromOptions(options *structs.ProcessingOptions) *Config {
+	enabled, _ := strconv.ParseBool(options.Normals)
+	if !enabled {
+		return nil
+	}
+
+	config := &Config{
+		K: c.NormalNeighbours,
+		Orientation: "up",
+	}
+
+	k, err := strconv.Atoi(options.NormalK)
+	if err == nil && k >= 3 {
+		config.K = k
+	}
+
+	switch options.NormalOrientation {
+	case "scanner", "none":
+		config.Orientation = options.NormalOrientation
+	}
+
+	scanner := []float64{}
+	for _, value := range strings.Split(options.NormalScanner, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			break
+		}
+		scanner = append(scanner, v)
+	}
+	if len(scanner) == 3 {
+		config.Scanner = scanner
+	}
+
+	return config
+}
+
+// Dimensions returns the normal and curvature of each point as dimensions.
+// Neighbours are searched among the points of the node being computed and
+// of the nodes around it, or among all of a level's points once prepared,
+// so points at a node's edge fit the surface across it. Without a scanner position, scanner orientation points normals
+// towards the centre of the bounds.
+func (config *Config) Dimensions(headers *structs.LASHeaders) []dimensions.Dimension {
+	// The scanner is kept in the point layout: x, elevation, north.
+	var scanner [3]float64
+	if config.Scanner != nil {
+		scanner = [3]float64{
+			config.Scanner[0] - headers.Offset[0],
+			config.Scanner[2] - headers.Offset[2],
+			config.Scanner[1] - headers.Offset[1],
+		}
+	} else {
+		scanner = [3]float64{
+			(headers.MinimumBounds[0] + headers.MaximumBounds[0]) / 2 - headers.Offset[0],
+			(headers.MinimumBounds[2] + headers.MaximumBounds[2]) / 2 - headers.Offset[2],
+			(headers.MinimumBounds[1] + headers.MaximumBounds[1]) / 2 - headers.Offset[1],
+		}
+	}
+
+	group := &dimensions.Group{
+		Compute: func(points, around []float64) map[string][]float64 {
+			normals, curvature := Estimate(points, around, config.K)
+			return config.orient(points, normals, curvature, scanner)
+		},
+		Prepare: func(all []float64) func(points []float64) map[string][]float64 {
+			_, tree := kdtree.ConstructTree(all, 0)
+			total := len(all) / pointOffset
+
+			return func(points []float64) map[string][]float64 {
+				normals, curvature := estimate(tree, total, points, config.K)
+				return config.orient(points, normals, curvature, scanner)
+			}
+		},
+		Context: true,
+	}
+
+	return dimensions.Grouped([]string{NormalX, NormalY, NormalZ, Curvature}, group)
+}
+
+// orient flips normals to the configured side and returns them along with
+// curvature as dimension values.
+func (config *Config) orient(points []float64, normals [][3]float64, curvature []float64, scanner [3]float64) map[string][]float64 {
+	n := len(points) / pointOffset
+	values := map[string][]float64{
+		NormalX: make([]float64, n),
+		NormalY: make([]float64, n),
+		NormalZ: make([]float64, n),
+		Curvature: make([]float64, n),
+	}
+
+	copy(values[Curvature], curvature)
+
+	for i, normal := range normals {
+		p := points[i * pointOffset:]
+
+		flip := false
+		switch config.Orientation {
+		case "up":
+			flip = normal[1] < 0
+		case "scanner":
+			flip = normal[0] * (scanner[0] - p[0]) + normal[1] * (scanner[1] - p[1]) + normal[2] * (scanner[2] - p[2]) < 0
+		}
+		if flip {
+			normal = [3]float64{-normal[0], -normal[1], -normal[2]}
+		}
+
+		values[NormalX][i] = normal[0]
+		values[NormalY][i] = normal[2]
+		values[NormalZ][i] = normal[1]
+	}
+
+	return values
+}
+
+// Estimate returns the unoriented normal of each point, in the point layout,
+// and its curvature: the share of its neighbourhood's variance off the
+// fitted plane. Neighbours are drawn from points and around together, but
+// only points get normals. Fewer than three points can't fit a plane, so
+// they face up with no curvature.
+func Estimate(points, around []float64, k int) ([][3]float64, []float64) {
+	all := points
+	if len(around) > 0 {
+		all = make([]float64, 0, len(points) + len(around))
+		all = append(all, points...)
+		all = append(all, around...)
+	}
+
+	_, tree := kdtree.ConstructTree(all, 0)
+	return estimate(tree, len(all) / pointOffset, points, k)
+}
+
+// estimate fits each point's normal to its neighbours in tree, which holds
+// total points including points' own.
+func estimate(tree *kdtree.KDTreeNode, total int, points []float64, k int) ([][3]float64, []float64) {
+	n := len(points) / pointOffset
+	normals := make([][3]float64, n)
+	curvature := make([]float64, n)
+
+	if total < 3 {
+		for i := range normals {
+			normals[i] = [3]float64{0, 1, 0}
+		}
+
+		return normals, curvature
+	}
+
+	if k > total {
+		k = total
+	}
+
+	workers := runtime.NumCPU()
+	per := (n + workers - 1) / workers
+	wg := sync.WaitGroup{}
+
+	for from := 0; from < n; from += per {
+		to := from + per
+		if to > n {
+			to = n
+		}
+
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+
+			neighbourhood := make([]float64, k * pointOffset)
+			for i := from; i < to; i++ {
+				neighbours := tree.KNearest(points[i * pointOffset : (i + 1) * pointOffset], k)
+				for j, neighbour := range neighbours {
+					copy(neighbourhood[j * pointOffset : (j + 1) * pointOffset], neighbour.Point)
+				}
+
+				_, cov := geometry.Covariance(neighbourhood[:len(neighbours) * pointOffset])
+				eigenvalues, eigenvectors := geometry.SymmetricEigen(cov)
+				normals[i] = eigenvectors[0]
+
+				total := eigenvalues[0] + eigenvalues[1] + eigenvalues[2]
+				if total > 0 {
+					curvature[i] = math.Max(eigenvalues[0], 0) / total
+				}
+			}
+		}(from, to)
+	}
+
+	wg.Wait()
+
+	return normals, curvature
+}
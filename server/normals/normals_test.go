@@ -0,0 +1,115 @@
+package normals
+
+import (
+	"math"
+	"testing"
+
+	"lidar/dimensions"
+	"lidar/structs"
+)
+
+// slope returns a grid of points on the plane elevation = x / 2, from x0 up
+// to x1 along x and over 0 to 2 along north.
+func slope(x0, x1 float64) []float64 {
+	points := []float64{}
+	for x := x0; x < x1; x += 0.25 {
+		for north := 0.0; north < 2; north += 0.25 {
+			points = append(points, x, x / 2, north, 0, 0, 0, 0, 2)
+		}
+	}
+
+	return points
+}
+
+func TestEstimateUsesPointsAround(t *testing.T) {
+	// Two points alone can't fit a plane, but with their neighbours' they
+	// lie on the slope.
+	points := []float64{
+		1, 0.5, 1, 0, 0, 0, 0, 2,
+		1.1, 0.55, 1.1, 0, 0, 0, 0, 2,
+	}
+	around := slope(0, 3)
+
+	normals, curvature := Estimate(points, around, 8)
+
+	want := [3]float64{-1 / math.Sqrt(5), 2 / math.Sqrt(5), 0}
+	for i, normal := range normals {
+		dot := normal[0] * want[0] + normal[1] * want[1] + normal[2] * want[2]
+		if math.Abs(math.Abs(dot) - 1) > 1e-6 {
+			t.Errorf("normal %d is %v, want ±%v", i, normal, want)
+		}
+		if curvature[i] > 1e-9 {
+			t.Errorf("curvature %d is %v, want 0", i, curvature[i])
+		}
+	}
+
+	if len(normals) != 2 {
+		t.Fatalf("got %d normals, want one per point", len(normals))
+	}
+}
+
+func TestEdgePointsMatchAcrossNodes(t *testing.T) {
+	// A ridge: the slope rises to x = 2 then falls. Points just left of
+	// the ridge only see the falling side through the node beyond it.
+	left := slope(0, 2)
+	right := []float64{}
+	for x := 2.0; x < 4; x += 0.25 {
+		for north := 0.0; north < 2; north += 0.25 {
+			right = append(right, x, 2 - x / 2, north, 0, 0, 0, 0, 2)
+		}
+	}
+
+	_, alone := Estimate(left, nil, 12)
+	_, together := Estimate(left, right, 12)
+
+	// The last column of the left node sits at the ridge.
+	edge := len(alone) - 1
+	if alone[edge] > 1e-9 {
+		t.Fatalf("alone, the edge's curvature is %v, want 0", alone[edge])
+	}
+	if together[edge] <= 1e-3 {
+		t.Fatalf("with the node beyond, the edge's curvature is %v, want the ridge to show", together[edge])
+	}
+}
+
+func TestDimensionsOrientUp(t *testing.T) {
+	config := &Config{K: 8, Orientation: "up"}
+	points := slope(0, 2)
+	normals, curvature := Estimate(points, nil, config.K)
+	values := config.orient(points, normals, curvature, [3]float64{})
+
+	for i, nz := range values[NormalZ] {
+		if nz <= 0 {
+			t.Fatalf("normal %d points down, nz = %v", i, nz)
+		}
+	}
+}
+
+func TestPreparedMatchesAround(t *testing.T) {
+	config := &Config{K: 12, Orientation: "up"}
+	headers := &structs.LASHeaders{
+		Offset: []float64{0, 0, 0},
+		MinimumBounds: []float64{0, 0, 0},
+		MaximumBounds: []float64{4, 2, 2},
+	}
+	dims := dimensions.Set(config.Dimensions(headers))
+
+	left := slope(0, 2)
+	right := []float64{}
+	for x := 2.0; x < 4; x += 0.25 {
+		for north := 0.0; north < 2; north += 0.25 {
+			right = append(right, x, 2 - x / 2, north, 0, 0, 0, 0, 2)
+		}
+	}
+
+	want := dims.Compute(left, right)
+	got := dims.Prepare(append(append([]float64{}, left...), right...)).Compute(left, nil)
+
+	for _, name := range dims.Names() {
+		for i := range want[name] {
+			if math.Abs(got[name][i] - want[name][i]) > 1e-9 {
+				t.Fatalf("prepared %s %d is %v, want %v", name, i, got[name][i], want[name][i])
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package octree
+
+import (
+	"math"
+)
+
+// NodeIndex finds the nodes around a node among nodes of one depth. Nodes
+// of a depth tile the root's bounds in a regular grid, so each can be found
+// by its cell.
+type NodeIndex struct {
+	origin [3]float64
+	size [3]float64
+	cells map[[3]int]*OctreeNode
+}
+
+// IndexLeaves indexes the tree's leaves, which all sit at its deepest level.
+func (o *Octree) IndexLeaves() *NodeIndex {
+	return o.IndexNodes(o.Leaves, o.Granularity)
+}
+
+func (o *Octree) IndexNodes(nodes []*OctreeNode, depth int) *NodeIndex {
+	index := &NodeIndex{
+		origin: [3]float64{o.Root.X1, o.Root.Y1, o.Root.Z1},
+		cells: make(map[[3]int]*OctreeNode, len(nodes)),
+	}
+
+	cells := math.Pow(2, float64(depth))
+	index.size = [3]float64{
+		(o.Root.X2 - o.Root.X1) / cells,
+		(o.Root.Y2 - o.Root.Y1) / cells,
+		(o.Root.Z2 - o.Root.Z1) / cells,
+	}
+
+	for _, node := range nodes {
+		index.cells[index.cell(node)] = node
+	}
+
+	return index
+}
+
+func (index *NodeIndex) cell(node *OctreeNode) [3]int {
+	res := [3]int{}
+	for i, lower := range [3]float64{node.X1, node.Y1, node.Z1} {
+		if index.size[i] > 0 {
+			res[i] = int(math.Round((lower - index.origin[i]) / index.size[i]))
+		}
+	}
+
+	return res
+}
+
+// Around returns node followed by every other indexed node that comes
+// within reach of its bounds, always including the nodes touching it.
+func (index *NodeIndex) Around(node *OctreeNode, reach float64) []*OctreeNode {
+	centre := index.cell(node)
+	res := []*OctreeNode{node}
+
+	steps := [3]int{}
+	for i := range steps {
+		steps[i] = 1
+		if index.size[i] > 0 {
+			steps[i] = int(math.Max(1, math.Ceil(reach / index.size[i])))
+		}
+	}
+
+	for dx := -steps[0]; dx <= steps[0]; dx++ {
+		for dy := -steps[1]; dy <= steps[1]; dy++ {
+			for dz := -steps[2]; dz <= steps[2]; dz++ {
+				if dx == 0 && dy == 0 && dz == 0 {
+					continue
+				}
+
+				neighbour, ok := index.cells[[3]int{centre[0] + dx, centre[1] + dy, centre[2] + dz}]
+				if ok {
+					res = append(res, neighbour)
+				}
+			}
+		}
+	}
+
+	return res
+}
@@ -1,9 +1,17 @@
 package octree
 
 import (
-	"lidar/kmeans"
+	"fmt"
+	"lidar/constants"
+	"lidar/geometry"
+	"lidar/metrics"
 	utils "lidar/loader_utils"
+	"lidar/reducer"
+	"lidar/spill"
 	"lidar/structs"
+	"math"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,10 +23,13 @@ type Octree struct {
 	Leaves []*OctreeNode
 	Granularity int
 	Mutex sync.Mutex
+	Store *spill.Store
 }
 
 type OctreeNode struct {
+	Id string
 	Points []float64
+	Spilled int
 	Mutex sync.Mutex
 	Children []*OctreeNode
 	X1 float64
@@ -54,6 +65,7 @@ func GenerateOctree(dimensions *OctreeDimensions) *Octree {
 		dimensions.Z2,
 		dimensions.Granularity,
 		nil,
+		"r",
 	)
 	
 	ptr := &Octree{
@@ -65,8 +77,9 @@ func GenerateOctree(dimensions *OctreeDimensions) *Octree {
 	return ptr
 }
 
-func GenerateOctreeNodes(x1, x2, y1, y2, z1, z2 float64, granularity int, parent *OctreeNode) *OctreeNode {
+func GenerateOctreeNodes(x1, x2, y1, y2, z1, z2 float64, granularity int, parent *OctreeNode, id string) *OctreeNode {
 	root := &OctreeNode{
+		Id: id,
 		X1: x1, 
 		X2: x2, 
 		Y1: y1, 
@@ -87,7 +100,7 @@ func GenerateOctreeNodes(x1, x2, y1, y2, z1, z2 float64, granularity int, parent
 		root.Children = make([]*OctreeNode, 8)
 		wg := sync.WaitGroup{}
 		helper := func(x1, x2, y1, y2, z1, z2 float64, granularity, i int) {
-			root.Children[i] = GenerateOctreeNodesConcurrent(x1, x2, y1, y2, z1, z2, granularity, root)
+			root.Children[i] = GenerateOctreeNodesConcurrent(x1, x2, y1, y2, z1, z2, granularity, root, id + strconv.Itoa(i))
 			wg.Done()
 		}
 		wg.Add(8)
@@ -102,22 +115,23 @@ func GenerateOctreeNodes(x1, x2, y1, y2, z1, z2 float64, granularity int, parent
 		wg.Wait()
 	} else if (granularity > concurrencyLevel) {
 		root.Children = [] *OctreeNode{
-			GenerateOctreeNodes(x1, midX, y1, midY, z1, midZ, granularity - 1, root),
-			GenerateOctreeNodes(x1, midX, midY, y2, z1, midZ, granularity - 1, root),
-			GenerateOctreeNodes(x1, midX, y1, midY, midZ, z2, granularity - 1, root),
-			GenerateOctreeNodes(x1, midX, midY, y2, midZ, z2, granularity - 1, root),
-			GenerateOctreeNodes(midX, x2, y1, midY, midZ, z2, granularity - 1, root),
-			GenerateOctreeNodes(midX, x2, y1, midY, z1, midZ, granularity - 1, root),
-			GenerateOctreeNodes(midX, x2, midY, y2, z1, midZ, granularity - 1, root),
-			GenerateOctreeNodes(midX, x2, midY, y2, midZ, z2, granularity - 1, root),
+			GenerateOctreeNodes(x1, midX, y1, midY, z1, midZ, granularity - 1, root, id + "0"),
+			GenerateOctreeNodes(x1, midX, midY, y2, z1, midZ, granularity - 1, root, id + "1"),
+			GenerateOctreeNodes(x1, midX, y1, midY, midZ, z2, granularity - 1, root, id + "2"),
+			GenerateOctreeNodes(x1, midX, midY, y2, midZ, z2, granularity - 1, root, id + "3"),
+			GenerateOctreeNodes(midX, x2, y1, midY, midZ, z2, granularity - 1, root, id + "4"),
+			GenerateOctreeNodes(midX, x2, y1, midY, z1, midZ, granularity - 1, root, id + "5"),
+			GenerateOctreeNodes(midX, x2, midY, y2, z1, midZ, granularity - 1, root, id + "6"),
+			GenerateOctreeNodes(midX, x2, midY, y2, midZ, z2, granularity - 1, root, id + "7"),
 		}
 	}
 
 	return root;
 }
 
-func GenerateOctreeNodesConcurrent(x1, x2, y1, y2, z1, z2 float64, granularity int, parent *OctreeNode) *OctreeNode {
+func GenerateOctreeNodesConcurrent(x1, x2, y1, y2, z1, z2 float64, granularity int, parent *OctreeNode, id string) *OctreeNode {
 	root := &OctreeNode{
+		Id: id,
 		X1: x1, 
 		X2: x2, 
 		Y1: y1, 
@@ -156,7 +170,8 @@ func GenerateOctreeNodesConcurrent(x1, x2, y1, y2, z1, z2 float64, granularity i
 
 		popped.Children = []*OctreeNode{c1, c2, c3, c4, c5, c6, c7, c8}
 
-		for _, child := range popped.Children {
+		for i, child := range popped.Children {
+			child.Id = popped.Id + strconv.Itoa(i)
 			stack.Push(child)
 		}
 	}
@@ -173,6 +188,9 @@ func AddPoint(x, y, z, r, g, b, alpha, classification float64, depth, granularit
 	if (depth == granularity) {
 		node.Mutex.Lock()
 		node.Points = append(node.Points, x, y, z, r, g, b, alpha, classification);
+		if tree.Store != nil && len(node.Points) >= constants.SpillThreshold * constants.PointOffset {
+			tree.spill(node)
+		}
 		node.Mutex.Unlock()
 
 		if (!node.Active) {
@@ -209,14 +227,227 @@ func GetPoints(root *OctreeNode, arr *[]float64) {
 	}
 } 
 
-func ClusterPoints(socket *structs.ConcurrentSocket, leaves *[]*OctreeNode, wg *sync.WaitGroup) {
+// ClusterPoints reduces every leaf concurrently. Leaves with a target in
+// targets are reduced to about that many points; the rest, or all of them
+// when targets is nil, are left to the reducer. A non-nil collector measures
+// each leaf's simplification error.
+func ClusterPoints(socket *structs.ConcurrentSocket, leaves *[]*OctreeNode, wg *sync.WaitGroup, r reducer.Reducer, targets map[*OctreeNode]int, collector *metrics.Collector) {
 	defer utils.TimeTrack(time.Now(), "ClusterPoints")
 
 	for _, leaf := range *leaves {
 		wg.Add(1)
 		go func(leaf *OctreeNode) {
 			defer wg.Done()
-			leaf.Points = kmeans.KMeansClustering(leaf.Points);
+			reduced := r.Reduce(leaf.Points, targets[leaf]);
+			collector.Node(leaf.Id, leaf.Points, reduced)
+			leaf.Points = reduced
 		}(leaf)
 	}
 }
+
+// ClusterPointsInBatches clusters the leaves of an out-of-core octree a batch
+// at a time, so that at most batchSize points are held in memory at once.
+func ClusterPointsInBatches(socket *structs.ConcurrentSocket, o *Octree, batchSize int, r reducer.Reducer, targets map[*OctreeNode]int, collector *metrics.Collector) {
+	defer utils.TimeTrack(time.Now(), "ClusterPointsInBatches")
+
+	batch := []*OctreeNode{}
+	batchPoints := 0
+
+	flush := func() {
+		wg := sync.WaitGroup{}
+		for _, leaf := range batch {
+			wg.Add(1)
+			go func(leaf *OctreeNode) {
+				defer wg.Done()
+				points, err := o.ReadPoints(leaf)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+
+				reduced := r.Reduce(points, targets[leaf])
+				collector.Node(leaf.Id, points, reduced)
+				o.ReplacePoints(leaf, reduced)
+			}(leaf)
+		}
+		wg.Wait()
+		batch = []*OctreeNode{}
+		batchPoints = 0
+	}
+
+	for _, leaf := range o.Leaves {
+		count := o.PointCount(leaf)
+		if len(batch) > 0 && batchPoints + count > batchSize {
+			flush()
+		}
+		batch = append(batch, leaf)
+		batchPoints += count
+	}
+
+	flush()
+}
+
+// spill moves a node's in-memory points to the tree's store. The caller must
+// hold the node's mutex.
+func (o *Octree) spill(node *OctreeNode) {
+	err := o.Store.Append(node.Id, node.Points)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	node.Spilled += len(node.Points)
+	node.Points = []float64{}
+}
+
+// ReadPoints returns all of a node's points, including those spilled to disk.
+// For in-memory nodes the node's own slice is returned and must not be modified.
+// If the spilled points can't be read, no points are returned, since the
+// in-memory ones alone would quietly drop the rest of the node.
+func (o *Octree) ReadPoints(node *OctreeNode) ([]float64, error) {
+	if o.Store == nil || node.Spilled == 0 {
+		return node.Points, nil
+	}
+
+	points, err := o.Store.Read(node.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(points, node.Points...), nil
+}
+
+// ReplacePoints swaps a node's points for new ones, writing them to disk
+// rather than memory when the tree is out-of-core.
+func (o *Octree) ReplacePoints(node *OctreeNode, points []float64) {
+	if o.Store == nil {
+		node.Points = points
+		return
+	}
+
+	err := o.Store.Write(node.Id, points)
+	if err != nil {
+		fmt.Println(err)
+		node.Points = points
+		node.Spilled = 0
+		return
+	}
+
+	node.Points = []float64{}
+	node.Spilled = len(points)
+}
+
+// SortLeaves puts the leaves in ID order and each leaf's points in a fixed
+// order, undoing the arrival order left behind by concurrent loading.
+func (o *Octree) SortLeaves() {
+	sort.Slice(o.Leaves, func(i, j int) bool {
+		return o.Leaves[i].Id < o.Leaves[j].Id
+	})
+
+	for _, leaf := range o.Leaves {
+		points, err := o.ReadPoints(leaf)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		o.ReplacePoints(leaf, sortPoints(points))
+	}
+}
+
+func sortPoints(points []float64) []float64 {
+	n := len(points) / constants.PointOffset
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i * constants.PointOffset
+	}
+
+	sort.Slice(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		for k := 0; k < constants.PointOffset; k++ {
+			if points[i + k] != points[j + k] {
+				return points[i + k] < points[j + k]
+			}
+		}
+		return false
+	})
+
+	res := make([]float64, 0, len(points))
+	for _, i := range order {
+		res = append(res, points[i : i + constants.PointOffset]...)
+	}
+
+	return res
+}
+
+func (o *Octree) PointCount(node *OctreeNode) int {
+	return (node.Spilled + len(node.Points)) / constants.PointOffset
+}
+
+// AllocateBudget splits a total point budget across the leaves in proportion
+// to their weight: their point count for "occupancy", or their point count
+// scaled up by surface variation for "complexity", so rough or cluttered
+// leaves keep more points than flat ones. Leaves that would be given more
+// points than they hold keep them all, and the surplus is shared among the
+// rest so that the total lands close to the budget.
+func (o *Octree) AllocateBudget(budget int, weighting string) map[*OctreeNode]int {
+	defer utils.TimeTrack(time.Now(), "AllocateBudget")
+
+	counts := make(map[*OctreeNode]int, len(o.Leaves))
+	weights := make(map[*OctreeNode]float64, len(o.Leaves))
+
+	for _, leaf := range o.Leaves {
+		counts[leaf] = o.PointCount(leaf)
+		weights[leaf] = float64(counts[leaf])
+
+		if weighting == "complexity" {
+			points, err := o.ReadPoints(leaf)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			weights[leaf] *= 1 + 3 * geometry.SurfaceVariation(points)
+		}
+	}
+
+	targets := make(map[*OctreeNode]int, len(o.Leaves))
+	remaining := append([]*OctreeNode{}, o.Leaves...)
+	remainingBudget := float64(budget)
+
+	for len(remaining) > 0 {
+		totalWeight := 0.0
+		for _, leaf := range remaining {
+			totalWeight += weights[leaf]
+		}
+
+		if totalWeight <= 0 {
+			break
+		}
+
+		saturated := false
+		next := []*OctreeNode{}
+
+		for _, leaf := range remaining {
+			share := remainingBudget * weights[leaf] / totalWeight
+			if share >= float64(counts[leaf]) {
+				targets[leaf] = counts[leaf]
+				remainingBudget -= float64(counts[leaf])
+				saturated = true
+			} else {
+				next = append(next, leaf)
+			}
+		}
+
+		if !saturated {
+			for _, leaf := range remaining {
+				targets[leaf] = int(math.Max(1, math.Round(remainingBudget * weights[leaf] / totalWeight)))
+			}
+			break
+		}
+
+		remaining = next
+	}
+
+	return targets
+}
@@ -0,0 +1,323 @@
+package outliers
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+
+	c "lidar/constants"
+	"lidar/kdtree"
+	"lidar/octree"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+// NoiseClass is the ASPRS classification for low noise.
+const NoiseClass float64 = 7
+
+// Config selects the outlier tests for a job. Statistical removal flags
+// points whose mean distance to their K nearest neighbours is more than
+// StdDev standard deviations above the mean over the whole cloud; radius
+// removal flags points with fewer than MinNeighbours others within
+// SearchRadius, which defaults to OutlierRadius. Flagged points are dropped,
+// or kept as class 7 when Reclassify is set. Stage is "tree" to test the
+// loaded octree as a whole, or "load" to filter each window on its own before
+// it is inserted, which saves inserting points only to remove them again but
+// can't see neighbours in other windows.
+type Config struct {
+	Statistical bool
+	Radius bool
+	K int
+	StdDev float64
+	SearchRadius float64
+	MinNeighbours int
+	Reclassify bool
+	Stage string
+}
+
+// FromOptions returns nil when the job has no outlier filtering.
+func FromOptions(options *structs.ProcessingOptions) *Config {
+	config := &Config{
+		K: c.OutlierNeighbours,
+		StdDev: c.OutlierStdDev,
+		SearchRadius: c.OutlierRadius,
+		MinNeighbours: c.OutlierMinNeighbours,
+		Reclassify: options.OutlierAction == "reclassify",
+		Stage: "tree",
+	}
+
+	switch options.Outliers {
+	case "statistical":
+		config.Statistical = true
+	case "radius":
+		config.Radius = true
+	case "both":
+		config.Statistical = true
+		config.Radius = true
+	default:
+		return nil
+	}
+
+	if options.OutlierStage == "load" {
+		config.Stage = "load"
+	}
+
+	k, err := strconv.Atoi(options.OutlierK)
+	if err == nil && k > 0 {
+		config.K = k
+	}
+
+	stdDev, err := strconv.ParseFloat(options.OutlierStdDev, 64)
+	if err == nil && stdDev > 0 {
+		config.StdDev = stdDev
+	}
+
+	minNeighbours, err := strconv.Atoi(options.OutlierMinNeighbours)
+	if err == nil && minNeighbours > 0 {
+		config.MinNeighbours = minNeighbours
+	}
+
+	radius, err := strconv.ParseFloat(options.OutlierRadius, 64)
+	if err == nil && radius > 0 {
+		config.SearchRadius = radius
+	}
+
+	return config
+}
+
+// leafResult holds what the first pass learnt about each of a leaf's points.
+type leafResult struct {
+	distances []float64
+	flagged []bool
+}
+
+// Remove applies the configured tests to every point in the tree and returns
+// how many were flagged. Each leaf's points are tested against those of the
+// leaves around it, so points near a leaf's edge see their real neighbours
+// and small leaves are tested like any other. The statistical limit is only
+// known once every point's mean distance is, so leaves are rewritten in a
+// second pass.
+func (config *Config) Remove(o *octree.Octree) int {
+	if config == nil || len(o.Leaves) == 0 {
+		return 0
+	}
+
+	index := o.IndexLeaves()
+	results := make([]*leafResult, len(o.Leaves))
+
+	// Leaves touching a point's own hold every neighbour closer than a leaf's
+	// width; the radius test needs those within its radius.
+	reach := 0.0
+	if config.Radius {
+		reach = config.SearchRadius
+	}
+
+	mutex := sync.Mutex{}
+	sum, sumSquared, measured := 0.0, 0.0, 0
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, runtime.NumCPU())
+
+	for i, leaf := range o.Leaves {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, leaf *octree.OctreeNode) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			points, n, err := gather(o, index.Around(leaf, reach))
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			result := config.test(points, n)
+			results[i] = result
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, d := range result.distances {
+				if !math.IsInf(d, 1) {
+					sum += d
+					sumSquared += d * d
+					measured++
+				}
+			}
+		}(i, leaf)
+	}
+
+	wg.Wait()
+
+	limit := config.limit(sum, sumSquared, measured)
+	count := 0
+
+	for i, leaf := range o.Leaves {
+		result := results[i]
+		if result == nil {
+			continue
+		}
+
+		for j := range result.flagged {
+			if config.Statistical && result.distances[j] > limit {
+				result.flagged[j] = true
+			}
+		}
+
+		points, err := o.ReadPoints(leaf)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		res, flagged := config.apply(points, result.flagged)
+		if flagged > 0 {
+			o.ReplacePoints(leaf, res)
+			count += flagged
+		}
+	}
+
+	return count
+}
+
+// Filter applies the configured tests to points alone, taking the statistics
+// over them, and returns the points that remain along with how many were
+// flagged. points is never modified.
+func (config *Config) Filter(points []float64) ([]float64, int) {
+	n := len(points) / pointOffset
+	if config == nil || n == 0 {
+		return points, 0
+	}
+
+	result := config.test(points, n)
+
+	sum, sumSquared, measured := 0.0, 0.0, 0
+	for _, d := range result.distances {
+		if !math.IsInf(d, 1) {
+			sum += d
+			sumSquared += d * d
+			measured++
+		}
+	}
+
+	limit := config.limit(sum, sumSquared, measured)
+	for j := range result.flagged {
+		if config.Statistical && result.distances[j] > limit {
+			result.flagged[j] = true
+		}
+	}
+
+	return config.apply(points, result.flagged)
+}
+
+// limit is the mean distance above which the statistical test flags a point,
+// given the sums of the measured distances and of their squares.
+func (config *Config) limit(sum float64, sumSquared float64, measured int) float64 {
+	if !config.Statistical || measured == 0 {
+		return math.Inf(1)
+	}
+
+	mean := sum / float64(measured)
+	stdDev := math.Sqrt(math.Max(sumSquared / float64(measured) - mean * mean, 0))
+	return mean + config.StdDev * stdDev
+}
+
+// gather reads the points of nodes into one slice, returning it along with
+// the number of points belonging to the first node, which come first.
+func gather(o *octree.Octree, nodes []*octree.OctreeNode) ([]float64, int, error) {
+	points := []float64{}
+	n := 0
+
+	for i, node := range nodes {
+		nodePoints, err := o.ReadPoints(node)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		points = append(points, nodePoints...)
+		if i == 0 {
+			n = len(nodePoints) / pointOffset
+		}
+	}
+
+	return points, n, nil
+}
+
+// test measures the first n points against all of points. Points with no
+// neighbours at all have an infinite mean distance and are always flagged.
+func (config *Config) test(points []float64, n int) *leafResult {
+	result := &leafResult{
+		distances: make([]float64, n),
+		flagged: make([]bool, n),
+	}
+
+	if n == 0 {
+		return result
+	}
+
+	payloads := make([]interface{}, len(points) / pointOffset)
+	for i := range payloads {
+		payloads[i] = i
+	}
+	tree := kdtree.ConstructTreeWithPayloads(points, payloads)
+
+	for i := 0; i < n; i++ {
+		p := points[i * pointOffset:]
+
+		if config.Statistical {
+			total, count := 0.0, 0
+			for _, neighbour := range tree.KNearest(p, config.K + 1) {
+				if neighbour.Payload.(int) == i {
+					continue
+				}
+				total += math.Sqrt(neighbour.DistanceSquared)
+				count++
+			}
+
+			result.distances[i] = math.Inf(1)
+			if count > 0 {
+				result.distances[i] = total / float64(count)
+			} else {
+				result.flagged[i] = true
+			}
+		}
+
+		// The point finds itself, so it needs one more than MinNeighbours.
+		if config.Radius && len(tree.Radius(p, config.SearchRadius)) - 1 < config.MinNeighbours {
+			result.flagged[i] = true
+		}
+	}
+
+	return result
+}
+
+// apply drops or reclassifies the flagged points, returning the points that
+// remain along with how many were flagged. points is never modified.
+func (config *Config) apply(points []float64, flagged []bool) ([]float64, int) {
+	count := 0
+	for _, f := range flagged {
+		if f {
+			count++
+		}
+	}
+
+	if count == 0 {
+		return points, 0
+	}
+
+	res := make([]float64, 0, len(points))
+	for i := range flagged {
+		if flagged[i] && !config.Reclassify {
+			continue
+		}
+
+		res = append(res, points[i * pointOffset : (i + 1) * pointOffset]...)
+		if flagged[i] {
+			res[len(res) - 1] = NoiseClass
+		}
+	}
+
+	return res, count
+}
@@ -0,0 +1,127 @@
+package outliers
+
+import (
+	"math/rand"
+	"testing"
+
+	"lidar/octree"
+)
+
+// plane fills a tree spanning 0 to 16 on each axis, split into leaves 2
+// units across, with points scattered about a grid every 0.25 units on
+// ground just below the leaves' boundary at 2.
+func plane() *octree.Octree {
+	rng := rand.New(rand.NewSource(1))
+
+	o := octree.GenerateOctree(&octree.OctreeDimensions{
+		X1: 0, X2: 16,
+		Y1: 0, Y2: 16,
+		Z1: 0, Z2: 16,
+		Granularity: 3,
+	})
+
+	for x := 0.125; x < 16; x += 0.25 {
+		for z := 0.125; z < 16; z += 0.25 {
+			jx, jy, jz := rng.Float64() * 0.1 - 0.05, rng.Float64() * 0.01, rng.Float64() * 0.1 - 0.05
+			octree.AddPoint(x + jx, 1.98 + jy, z + jz, 0, 0, 0, 0, 2, 0, o.Granularity, o.Root, o)
+		}
+	}
+
+	return o
+}
+
+// count returns how many points are inside the ground's outer edge, where
+// every point has a full ring of neighbours, and how many are above it.
+func count(o *octree.Octree) (int, int) {
+	inside, above := 0, 0
+	for _, leaf := range o.Leaves {
+		points, _ := o.ReadPoints(leaf)
+		for i := 0; i < len(points); i += pointOffset {
+			if points[i + 1] > 2.1 {
+				above++
+			} else if points[i] > 0.5 && points[i] < 15.5 && points[i + 2] > 0.5 && points[i + 2] < 15.5 {
+				inside++
+			}
+		}
+	}
+
+	return inside, above
+}
+
+func TestStatisticalRemovesIsolatedPoint(t *testing.T) {
+	o := plane()
+	before, _ := count(o)
+
+	// A bird well above the ground, alone in its leaf.
+	octree.AddPoint(8.1, 13, 8.1, 0, 0, 0, 0, 1, 0, o.Granularity, o.Root, o)
+
+	config := &Config{Statistical: true, K: 8, StdDev: 3}
+	config.Remove(o)
+
+	// Points on the ground's outer edge have half the neighbours, so some
+	// of those may go too.
+	inside, above := count(o)
+	if inside != before || above != 0 {
+		t.Fatalf("%d points inside the edge and %d above remain, want %d and 0", inside, above, before)
+	}
+}
+
+func TestLeafEdgesSeeNeighbouringLeaves(t *testing.T) {
+	o := plane()
+
+	// Two points of ground just over the boundary, alone in their leaf but
+	// with plenty of neighbours in the leaf below.
+	octree.AddPoint(4.2, 2.005, 4.2, 0, 0, 0, 0, 2, 0, o.Granularity, o.Root, o)
+	octree.AddPoint(4.45, 2.005, 4.2, 0, 0, 0, 0, 2, 0, o.Granularity, o.Root, o)
+	before, _ := count(o)
+
+	config := &Config{Statistical: true, Radius: true, K: 8, StdDev: 3, SearchRadius: 0.5, MinNeighbours: 4}
+	config.Remove(o)
+
+	if inside, _ := count(o); inside != before {
+		t.Fatalf("%d points inside the edge remain, want %d", inside, before)
+	}
+}
+
+func TestReclassifyKeepsPoints(t *testing.T) {
+	o := plane()
+	octree.AddPoint(8, 15, 8, 0, 0, 0, 0, 1, 0, o.Granularity, o.Root, o)
+
+	config := &Config{Radius: true, SearchRadius: 1, MinNeighbours: 2, Reclassify: true}
+	config.Remove(o)
+
+	if _, above := count(o); above != 1 {
+		t.Fatalf("%d points remain above the ground, want 1", above)
+	}
+
+	for _, leaf := range o.Leaves {
+		points, _ := o.ReadPoints(leaf)
+		for i := 0; i < len(points); i += pointOffset {
+			if points[i + 1] > 2.1 && points[i + pointOffset - 1] != NoiseClass {
+				t.Fatalf("the point above the ground is class %v, want %v", points[i + pointOffset - 1], NoiseClass)
+			}
+		}
+	}
+}
+
+func TestFilterWindow(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := []float64{}
+	for i := 0; i < 400; i++ {
+		points = append(points, rng.Float64() * 5, rng.Float64() * 0.01, rng.Float64() * 5, 0, 0, 0, 0, 2)
+	}
+	points = append(points, 2.5, 10, 2.5, 0, 0, 0, 0, 1)
+
+	config := &Config{Statistical: true, K: 8, StdDev: 3, Stage: "load"}
+	res, flagged := config.Filter(points)
+
+	if flagged == 0 || len(res) != len(points) - flagged * pointOffset {
+		t.Fatalf("flagged %d and kept %d points of %d", flagged, len(res) / pointOffset, len(points) / pointOffset)
+	}
+
+	for i := 0; i < len(res); i += pointOffset {
+		if res[i + 1] > 1 {
+			t.Fatalf("the point above the ground was kept")
+		}
+	}
+}
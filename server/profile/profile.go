@@ -0,0 +1,188 @@
+package profile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	c "lidar/constants"
+	"lidar/datastore"
+	"lidar/structs"
+	"lidar/vector"
+)
+
+var pointOffset int = c.PointOffset
+
+// Extract returns the points of a dataset within the request's corridor,
+// projected onto its polyline. It reads the full resolution points when the
+// dataset kept them and its leaves otherwise, skipping nodes clear of the
+// corridor's bounding box.
+func Extract(dataset *datastore.Dataset, request *structs.ProfileRequest) (*structs.ProfileReport, error) {
+	if len(request.Vertices) < 2 {
+		return nil, errors.New("a polyline needs at least two vertices")
+	}
+
+	line, err := dataset.ToRealWorld(request.Vertices)
+	if err != nil {
+		return nil, err
+	}
+
+	width := request.Width
+	if width <= 0 {
+		width = c.ProfileWidth
+	}
+	half := width / 2
+
+	stations := make([]float64, len(line))
+	for i := 1; i < len(line); i++ {
+		stations[i] = stations[i - 1] + math.Hypot(line[i][0] - line[i - 1][0], line[i][1] - line[i - 1][1])
+	}
+
+	length := stations[len(stations) - 1]
+	if length == 0 {
+		return nil, errors.New("polyline has no length")
+	}
+
+	minX, minZ, maxX, maxZ := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range line {
+		minX, maxX = math.Min(minX, p[0] - half), math.Max(maxX, p[0] + half)
+		minZ, maxZ = math.Min(minZ, p[1] - half), math.Max(maxZ, p[1] + half)
+	}
+
+	label := "raw"
+	if dataset.Level(label) == nil {
+		label = "leaf"
+	}
+
+	report := &structs.ProfileReport{
+		Level: label,
+		Width: width,
+		Length: length,
+		Stations: stations,
+		Points: []structs.ProfilePoint{},
+	}
+
+	offset := dataset.Info.Headers.Offset
+
+	min, max := [2]float64{minX, minZ}, [2]float64{maxX, maxZ}
+	err = dataset.EachSegmentWithin(label, min, max, func(nodeId string, points []float64) {
+		for i := 0; i < len(points); i += pointOffset {
+			x, north := points[i] + offset[0], points[i + 2] + offset[1]
+			if x < minX || x > maxX || north < minZ || north > maxZ {
+				continue
+			}
+
+			station, distance, ok := project(line, stations, x, north)
+			if !ok || math.Abs(distance) > half {
+				continue
+			}
+
+			report.Points = append(report.Points, structs.ProfilePoint{
+				Station: station,
+				Offset: distance,
+				Elevation: points[i + 1] + offset[2],
+				Easting: x,
+				Northing: north,
+				Intensity: points[i + 6],
+				Classification: points[i + pointOffset - 1],
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(report.Points, func(i, j int) bool {
+		return report.Points[i].Station < report.Points[j].Station
+	})
+
+	return report, nil
+}
+
+// project finds the closest point on a polyline to x and z, returning its
+// station and the signed distance to it, left of the line positive. Points
+// before the start or past the end of the line are not on it.
+func project(line [][2]float64, stations []float64, x, z float64) (float64, float64, bool) {
+	best, station, distance := math.Inf(1), 0.0, 0.0
+
+	for i := 0; i < len(line) - 1; i++ {
+		a, b := line[i], line[i + 1]
+		dx, dz := b[0] - a[0], b[1] - a[1]
+		segment := stations[i + 1] - stations[i]
+		if segment == 0 {
+			continue
+		}
+
+		t := ((x - a[0]) * dx + (z - a[1]) * dz) / segment
+		if (i == 0 && t < 0) || (i == len(line) - 2 && t > segment) {
+			continue
+		}
+		t = math.Max(0, math.Min(segment, t))
+
+		px, pz := a[0] + t * dx / segment, a[1] + t * dz / segment
+		d := math.Hypot(x - px, z - pz)
+		if d >= best {
+			continue
+		}
+
+		best, station, distance = d, stations[i] + t, d
+		if dx * (z - a[1]) - dz * (x - a[0]) < 0 {
+			distance = -d
+		}
+	}
+
+	return station, distance, !math.IsInf(best, 1)
+}
+
+// WriteCSV writes one row per point, in order of station.
+func WriteCSV(w io.Writer, report *structs.ProfileReport) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "station,offset,elevation,x,y,intensity,classification")
+	for _, p := range report.Points {
+		fmt.Fprintf(bw, "%.3f,%.3f,%.3f,%.3f,%.3f,%g,%g\n", p.Station, p.Offset, p.Elevation, p.Easting, p.Northing, p.Intensity, p.Classification)
+	}
+
+	return bw.Flush()
+}
+
+// Collection lays a profile out for drawing, with station along x and
+// elevation along y. Points are on a layer per classification, and each
+// vertex of the polyline is marked by a vertical line spanning the points.
+func Collection(report *structs.ProfileReport) *vector.Collection {
+	collection := &vector.Collection{
+		Fields: []string{"station"},
+		Lines: []vector.Polyline{},
+		Points: make([]vector.Point, len(report.Points)),
+	}
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for i, p := range report.Points {
+		low = math.Min(low, p.Elevation)
+		high = math.Max(high, p.Elevation)
+
+		collection.Points[i] = vector.Point{
+			Layer: fmt.Sprintf("PROFILE_CLASS_%d", int(p.Classification)),
+			Position: [3]float64{p.Station, p.Elevation, 0},
+		}
+	}
+
+	if len(report.Points) == 0 {
+		return collection
+	}
+
+	for _, station := range report.Stations {
+		collection.Lines = append(collection.Lines, vector.Polyline{
+			Layer: "PROFILE_STATION",
+			Points: [][3]float64{{station, low, 0}, {station, high, 0}},
+			Properties: map[string]float64{
+				"station": station,
+			},
+		})
+	}
+
+	return collection
+}
@@ -0,0 +1,373 @@
+package raster
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	c "lidar/constants"
+	"lidar/kdtree"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+const groundClass float64 = 2
+
+// Grid is a raster over the ground plane, the octree's X and Z axes, in the
+// same coordinates as the points. Row 0 is the southern edge. Cells without
+// a value hold NaN. Elevation grids hold point elevations, which are shifted
+// by the header's Z offset when written.
+type Grid struct {
+	MinX float64
+	MinZ float64
+	CellSize float64
+	Columns int
+	Rows int
+	Values []float64
+	Elevation bool
+}
+
+func NewGrid(minX, minZ, maxX, maxZ, cellSize float64) *Grid {
+	g := &Grid{
+		MinX: minX,
+		MinZ: minZ,
+		CellSize: cellSize,
+		Columns: int((maxX - minX) / cellSize) + 1,
+		Rows: int((maxZ - minZ) / cellSize) + 1,
+	}
+
+	g.Values = make([]float64, g.Columns * g.Rows)
+	for i := range g.Values {
+		g.Values[i] = math.NaN()
+	}
+
+	return g
+}
+
+// Cell returns the column and row holding a position, clamped to the grid.
+func (g *Grid) Cell(x, z float64) (int, int) {
+	col := int(math.Floor((x - g.MinX) / g.CellSize))
+	row := int(math.Floor((z - g.MinZ) / g.CellSize))
+
+	return clamp(col, 0, g.Columns - 1), clamp(row, 0, g.Rows - 1)
+}
+
+func (g *Grid) Index(x, z float64) int {
+	col, row := g.Cell(x, z)
+	return row * g.Columns + col
+}
+
+func (g *Grid) At(x, z float64) float64 {
+	return g.Values[g.Index(x, z)]
+}
+
+// Centre returns the position of a cell's centre.
+func (g *Grid) Centre(col, row int) (float64, float64) {
+	return g.MinX + (float64(col) + 0.5) * g.CellSize, g.MinZ + (float64(row) + 0.5) * g.CellSize
+}
+
+// Sample interpolates bilinearly between cell centres, ignoring empty
+// cells. It returns NaN when every surrounding cell is empty.
+func (g *Grid) Sample(x, z float64) float64 {
+	fx := (x - g.MinX) / g.CellSize - 0.5
+	fz := (z - g.MinZ) / g.CellSize - 0.5
+	col, row := int(math.Floor(fx)), int(math.Floor(fz))
+	tx, tz := fx - float64(col), fz - float64(row)
+
+	total, weights := 0.0, 0.0
+	for dr := 0; dr <= 1; dr++ {
+		for dc := 0; dc <= 1; dc++ {
+			cc, rr := clamp(col + dc, 0, g.Columns - 1), clamp(row + dr, 0, g.Rows - 1)
+			v := g.Values[rr * g.Columns + cc]
+			if math.IsNaN(v) {
+				continue
+			}
+
+			w := (1 - math.Abs(float64(dc) - tx)) * (1 - math.Abs(float64(dr) - tz))
+			total += w * v
+			weights += w
+		}
+	}
+
+	if weights == 0 {
+		return math.NaN()
+	}
+
+	return total / weights
+}
+
+// Product is one named raster produced for a job.
+type Product struct {
+	Name string
+	Grid *Grid
+}
+
+// Config picks the rasters for a job and their cell size. Products are any
+// of "dsm", "dtm", "chm", "intensity" and "density"; Formats any of
+// "geotiff" and "ascii".
+type Config struct {
+	Resolution float64
+	Products []string
+	Formats []string
+}
+
+// FromOptions returns nil when the job asked for no rasters.
+func FromOptions(options *structs.ProcessingOptions) *Config {
+	config := &Config{
+		Resolution: c.RasterResolution,
+		Products: []string{},
+		Formats: []string{},
+	}
+
+	for _, product := range strings.Split(options.Rasters, ",") {
+		product = strings.TrimSpace(product)
+		switch product {
+		case "dsm", "dtm", "chm", "intensity", "density":
+			config.Products = append(config.Products, product)
+		}
+	}
+
+	if len(config.Products) == 0 {
+		return nil
+	}
+
+	for _, format := range strings.Split(options.RasterFormats, ",") {
+		format = strings.TrimSpace(format)
+		switch format {
+		case "geotiff", "ascii":
+			config.Formats = append(config.Formats, format)
+		}
+	}
+
+	if len(config.Formats) == 0 {
+		config.Formats = []string{"geotiff", "ascii"}
+	}
+
+	resolution, err := strconv.ParseFloat(options.RasterResolution, 64)
+	if err == nil && resolution > 0 {
+		config.Resolution = resolution
+	}
+
+	return config
+}
+
+// Source visits every point of a cloud, a slice at a time.
+type Source func(visit func(points []float64))
+
+// bounds returns the header's extent on the ground plane in point
+// coordinates.
+func bounds(headers *structs.LASHeaders) (float64, float64, float64, float64) {
+	minX := headers.MinimumBounds[0] - headers.Offset[0]
+	minZ := headers.MinimumBounds[1] - headers.Offset[1]
+	maxX := headers.MaximumBounds[0] - headers.Offset[0]
+	maxZ := headers.MaximumBounds[1] - headers.Offset[1]
+
+	return minX, minZ, maxX, maxZ
+}
+
+// GroundSurface interpolates the ground class points into a DTM covering the
+// header's bounds, or returns nil when no point is classified as ground.
+func GroundSurface(source Source, headers *structs.LASHeaders, resolution float64) *Grid {
+	minX, minZ, maxX, maxZ := bounds(headers)
+	template := NewGrid(minX, minZ, maxX, maxZ, resolution)
+
+	sums := make([]float64, len(template.Values))
+	counts := make([]int, len(template.Values))
+
+	source(func(points []float64) {
+		for i := 0; i < len(points); i += pointOffset {
+			if points[i + pointOffset - 1] == groundClass {
+				j := template.Index(points[i], points[i + 2])
+				sums[j] += points[i + 1]
+				counts[j]++
+			}
+		}
+	})
+
+	return interpolateGround(template, sums, counts)
+}
+
+// Rasterise builds the configured rasters in a single pass over the points,
+// on a grid covering the header's bounds. The DSM takes the highest point
+// in each cell, intensity the mean intensity and density the points per
+// unit area. The DTM interpolates ground points by inverse distance
+// weighting, and is skipped when no point is classified as ground. The CHM
+// needs a second pass to take the greatest height above the DTM in each
+// cell.
+func Rasterise(source Source, headers *structs.LASHeaders, config *Config) []Product {
+	minX, minZ, maxX, maxZ := bounds(headers)
+
+	template := NewGrid(minX, minZ, maxX, maxZ, config.Resolution)
+	cells := len(template.Values)
+
+	dsm := NewGrid(minX, minZ, maxX, maxZ, config.Resolution)
+	dsm.Elevation = true
+	counts := make([]int, cells)
+	intensities := make([]float64, cells)
+	groundSums := make([]float64, cells)
+	groundCounts := make([]int, cells)
+
+	source(func(points []float64) {
+		for i := 0; i < len(points); i += pointOffset {
+			j := template.Index(points[i], points[i + 2])
+			counts[j]++
+			intensities[j] += points[i + 6]
+
+			if math.IsNaN(dsm.Values[j]) || points[i + 1] > dsm.Values[j] {
+				dsm.Values[j] = points[i + 1]
+			}
+
+			if points[i + pointOffset - 1] == groundClass {
+				groundSums[j] += points[i + 1]
+				groundCounts[j]++
+			}
+		}
+	})
+
+	products := []Product{}
+	var dtm *Grid
+
+	for _, name := range config.Products {
+		switch name {
+		case "dsm":
+			products = append(products, Product{Name: name, Grid: dsm})
+		case "dtm", "chm":
+			if dtm == nil {
+				dtm = interpolateGround(template, groundSums, groundCounts)
+			}
+			if dtm == nil {
+				fmt.Println("NO GROUND POINTS, SKIPPING", strings.ToUpper(name))
+				continue
+			}
+
+			if name == "dtm" {
+				products = append(products, Product{Name: name, Grid: dtm})
+			} else {
+				products = append(products, Product{Name: name, Grid: canopyHeight(source, dtm)})
+			}
+		case "intensity":
+			grid := NewGrid(minX, minZ, maxX, maxZ, config.Resolution)
+			for j, count := range counts {
+				if count > 0 {
+					grid.Values[j] = intensities[j] / float64(count)
+				}
+			}
+			products = append(products, Product{Name: name, Grid: grid})
+		case "density":
+			grid := NewGrid(minX, minZ, maxX, maxZ, config.Resolution)
+			area := config.Resolution * config.Resolution
+			for j, count := range counts {
+				grid.Values[j] = float64(count) / area
+			}
+			products = append(products, Product{Name: name, Grid: grid})
+		}
+	}
+
+	return products
+}
+
+// interpolateGround averages the ground points in each cell, then fills
+// every empty cell by inverse distance weighting of the nearest cell
+// averages.
+func interpolateGround(template *Grid, sums []float64, counts []int) *Grid {
+	grid := NewGrid(template.MinX, template.MinZ, template.MinX + float64(template.Columns - 1) * template.CellSize, template.MinZ + float64(template.Rows - 1) * template.CellSize, template.CellSize)
+	grid.Elevation = true
+
+	for j, count := range counts {
+		if count > 0 {
+			grid.Values[j] = sums[j] / float64(count)
+		}
+	}
+
+	if FillIDW(grid) < 0 {
+		return nil
+	}
+
+	return grid
+}
+
+// FillIDW gives every empty cell the inverse distance weighted mean of the
+// nearest filled cells. It returns how many cells it filled, or -1 when no
+// cell has a value.
+func FillIDW(g *Grid) int {
+	samples := []float64{}
+	values := []interface{}{}
+
+	for j, v := range g.Values {
+		if math.IsNaN(v) {
+			continue
+		}
+
+		x, z := g.Centre(j % g.Columns, j / g.Columns)
+		samples = append(samples, x, 0, z, 0, 0, 0, 0, 0)
+		values = append(values, v)
+	}
+
+	if len(values) == 0 {
+		return -1
+	}
+
+	tree := kdtree.ConstructTreeWithPayloads(samples, values)
+	filled := 0
+
+	for j, v := range g.Values {
+		if !math.IsNaN(v) {
+			continue
+		}
+
+		x, z := g.Centre(j % g.Columns, j / g.Columns)
+		g.Values[j] = idw(tree, x, z)
+		filled++
+	}
+
+	return filled
+}
+
+// canopyHeight takes the greatest height of any point above the surface in
+// each cell. Points below the surface count as zero height.
+func canopyHeight(source Source, surface *Grid) *Grid {
+	grid := NewGrid(surface.MinX, surface.MinZ, surface.MinX + float64(surface.Columns - 1) * surface.CellSize, surface.MinZ + float64(surface.Rows - 1) * surface.CellSize, surface.CellSize)
+
+	source(func(points []float64) {
+		for i := 0; i < len(points); i += pointOffset {
+			j := grid.Index(points[i], points[i + 2])
+			height := math.Max(points[i + 1] - surface.Sample(points[i], points[i + 2]), 0)
+
+			if math.IsNaN(grid.Values[j]) || height > grid.Values[j] {
+				grid.Values[j] = height
+			}
+		}
+	})
+
+	return grid
+}
+
+func idw(tree *kdtree.KDTreeNode, x, z float64) float64 {
+	neighbours := tree.KNearest([]float64{x, 0, z}, c.RasterIdwNeighbours)
+
+	total, weights := 0.0, 0.0
+	for _, n := range neighbours {
+		if n.DistanceSquared == 0 {
+			return n.Payload.(float64)
+		}
+
+		// Squared distance gives the usual power of two.
+		w := 1 / n.DistanceSquared
+		total += w * n.Payload.(float64)
+		weights += w
+	}
+
+	return total / weights
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,201 @@
+package raster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	c "lidar/constants"
+	"lidar/structs"
+)
+
+// georeference returns the real-world position of the grid's north-west
+// corner and the offset to add to its values.
+func georeference(g *Grid, headers *structs.LASHeaders) (float64, float64, float64) {
+	west := g.MinX + headers.Offset[0]
+	north := g.MinZ + float64(g.Rows) * g.CellSize + headers.Offset[1]
+
+	valueOffset := 0.0
+	if g.Elevation {
+		valueOffset = headers.Offset[2]
+	}
+
+	return west, north, valueOffset
+}
+
+// WriteASCII writes an ESRI ASCII grid, rows from north to south.
+func WriteASCII(w io.Writer, g *Grid, headers *structs.LASHeaders) error {
+	bw := bufio.NewWriter(w)
+	west, _, valueOffset := georeference(g, headers)
+
+	fmt.Fprintf(bw, "ncols %d\n", g.Columns)
+	fmt.Fprintf(bw, "nrows %d\n", g.Rows)
+	fmt.Fprintf(bw, "xllcorner %f\n", west)
+	fmt.Fprintf(bw, "yllcorner %f\n", g.MinZ + headers.Offset[1])
+	fmt.Fprintf(bw, "cellsize %f\n", g.CellSize)
+	fmt.Fprintf(bw, "NODATA_value %g\n", c.RasterNoData)
+
+	for row := g.Rows - 1; row >= 0; row-- {
+		for col := 0; col < g.Columns; col++ {
+			if col > 0 {
+				bw.WriteByte(' ')
+			}
+
+			v := g.Values[row * g.Columns + col]
+			if math.IsNaN(v) {
+				fmt.Fprintf(bw, "%g", c.RasterNoData)
+			} else {
+				fmt.Fprintf(bw, "%.3f", v + valueOffset)
+			}
+		}
+		bw.WriteByte('\n')
+	}
+
+	return bw.Flush()
+}
+
+// TIFF field types.
+const (
+	tiffShort uint16 = 3
+	tiffLong uint16 = 4
+	tiffAscii uint16 = 2
+	tiffDouble uint16 = 12
+)
+
+type tiffEntry struct {
+	tag uint16
+	kind uint16
+	count uint32
+	data []byte
+}
+
+// WriteGeoTIFF writes a single-band 32-bit float GeoTIFF in one strip. The
+// GeoKeys come from the LAS file's GeoKeyDirectory record when it has one,
+// so the raster carries the cloud's coordinate reference system.
+func WriteGeoTIFF(w io.Writer, g *Grid, headers *structs.LASHeaders) error {
+	west, north, valueOffset := georeference(g, headers)
+	le := binary.LittleEndian
+
+	pixels := make([]byte, g.Columns * g.Rows * 4)
+	for row := 0; row < g.Rows; row++ {
+		for col := 0; col < g.Columns; col++ {
+			v := g.Values[(g.Rows - 1 - row) * g.Columns + col]
+			if math.IsNaN(v) {
+				v = c.RasterNoData
+			} else {
+				v += valueOffset
+			}
+			le.PutUint32(pixels[(row * g.Columns + col) * 4:], math.Float32bits(float32(v)))
+		}
+	}
+
+	shorts := func(values ...uint16) []byte {
+		buf := make([]byte, len(values) * 2)
+		for i, v := range values {
+			le.PutUint16(buf[i * 2:], v)
+		}
+		return buf
+	}
+	longs := func(values ...uint32) []byte {
+		buf := make([]byte, len(values) * 4)
+		for i, v := range values {
+			le.PutUint32(buf[i * 4:], v)
+		}
+		return buf
+	}
+	doubles := func(values ...float64) []byte {
+		buf := make([]byte, len(values) * 8)
+		for i, v := range values {
+			le.PutUint64(buf[i * 8:], math.Float64bits(v))
+		}
+		return buf
+	}
+	ascii := func(s string) []byte {
+		return append([]byte(s), 0)
+	}
+
+	geoKeys := headers.GeoKeys
+	if len(geoKeys) < 4 {
+		// No CRS is known, so only say that pixels are areas.
+		geoKeys = []uint16{1, 1, 0, 1, 1025, 0, 1, 1}
+	}
+
+	const stripOffset uint32 = 8
+	entries := []tiffEntry{
+		{256, tiffLong, 1, longs(uint32(g.Columns))},
+		{257, tiffLong, 1, longs(uint32(g.Rows))},
+		{258, tiffShort, 1, shorts(32)},
+		{259, tiffShort, 1, shorts(1)},
+		{262, tiffShort, 1, shorts(1)},
+		{273, tiffLong, 1, longs(stripOffset)},
+		{277, tiffShort, 1, shorts(1)},
+		{278, tiffLong, 1, longs(uint32(g.Rows))},
+		{279, tiffLong, 1, longs(uint32(len(pixels)))},
+		{284, tiffShort, 1, shorts(1)},
+		{339, tiffShort, 1, shorts(3)},
+		{33550, tiffDouble, 3, doubles(g.CellSize, g.CellSize, 0)},
+		{33922, tiffDouble, 6, doubles(0, 0, 0, west, north, 0)},
+		{34735, tiffShort, uint32(len(geoKeys)), shorts(geoKeys...)},
+		{42113, tiffAscii, 0, ascii(fmt.Sprintf("%g", c.RasterNoData))},
+	}
+
+	if len(headers.GeoDoubleParams) > 0 {
+		entries = append(entries, tiffEntry{34736, tiffDouble, uint32(len(headers.GeoDoubleParams)), doubles(headers.GeoDoubleParams...)})
+	}
+	if headers.GeoAsciiParams != "" {
+		entries = append(entries, tiffEntry{34737, tiffAscii, 0, ascii(headers.GeoAsciiParams)})
+	}
+
+	for i := range entries {
+		if entries[i].kind == tiffAscii {
+			entries[i].count = uint32(len(entries[i].data))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].tag < entries[j].tag
+	})
+
+	// Layout: header, pixels, directory, then values too large to fit in a
+	// directory entry. Offsets are kept even as TIFF requires.
+	ifdOffset := stripOffset + uint32(len(pixels))
+	ifdOffset += ifdOffset % 2
+	ifdSize := uint32(2 + len(entries) * 12 + 4)
+	extraOffset := ifdOffset + ifdSize
+
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{'I', 'I'})
+	bw.Write(shorts(42))
+	bw.Write(longs(ifdOffset))
+	bw.Write(pixels)
+	if len(pixels) % 2 == 1 {
+		bw.WriteByte(0)
+	}
+
+	extra := []byte{}
+	bw.Write(shorts(uint16(len(entries))))
+	for _, e := range entries {
+		bw.Write(shorts(e.tag, e.kind))
+		bw.Write(longs(e.count))
+
+		if len(e.data) <= 4 {
+			value := make([]byte, 4)
+			copy(value, e.data)
+			bw.Write(value)
+			continue
+		}
+
+		bw.Write(longs(extraOffset + uint32(len(extra))))
+		extra = append(extra, e.data...)
+		if len(extra) % 2 == 1 {
+			extra = append(extra, 0)
+		}
+	}
+	bw.Write(longs(0))
+	bw.Write(extra)
+
+	return bw.Flush()
+}
@@ -0,0 +1,378 @@
+package reducer
+
+import (
+	"math"
+	"strconv"
+
+	c "lidar/constants"
+	"lidar/kmeans"
+	utils "lidar/loader_utils"
+	"lidar/structs"
+
+	"github.com/puzpuzpuz/xsync"
+	"golang.org/x/exp/rand"
+)
+
+var pointOffset int = c.PointOffset
+
+// Reducer thins a flat slice of points. A positive target asks for roughly
+// that many points back; otherwise the reducer's own parameters decide.
+// Reducers never modify points.
+type Reducer interface {
+	Reduce(points []float64, target int) []float64
+}
+
+// FromOptions picks the reducer for a job, defaulting to k-means. Clustering
+// times are added to timings.
+func FromOptions(options *structs.ProcessingOptions, timings *xsync.Map) Reducer {
+	voxelSize, _ := strconv.ParseFloat(options.VoxelSize, 64)
+	sampleRate, _ := strconv.ParseFloat(options.SampleRate, 64)
+	poissonRadius, _ := strconv.ParseFloat(options.PoissonRadius, 64)
+	config := kmeans.ConfigFromOptions(options)
+	config.Timings = timings
+
+	switch options.Reducer {
+	case "voxel-centroid":
+		return &VoxelCentroid{Size: voxelSize}
+	case "voxel-nearest":
+		return &VoxelNearest{Size: voxelSize}
+	case "random":
+		return &Random{Rate: sampleRate, Config: config}
+	case "poisson":
+		return &PoissonDisk{Radius: poissonRadius, Config: config}
+	default:
+		return &KMeans{Config: config}
+	}
+}
+
+// newRand draws from the job's seed when one is set, so seeded jobs sample
+// the same points on every run.
+func newRand(config *kmeans.Config, points []float64) *rand.Rand {
+	if config == nil || !config.Seeded {
+		return rand.New(rand.NewSource(rand.Uint64()))
+	}
+
+	return utils.PointsRand(config.Seed, points)
+}
+
+type KMeans struct {
+	Config *kmeans.Config
+}
+
+func (r *KMeans) Reduce(points []float64, target int) []float64 {
+	config := r.Config
+	if config == nil {
+		config = kmeans.DefaultConfig
+	}
+
+	if target > 0 {
+		return config.ClusterK(points, target)
+	}
+
+	return config.Cluster(points)
+}
+
+// VoxelCentroid replaces the points in each cube of side Size with their
+// centroid, keeping the most common classification. Without a Size or a
+// target the cube is sized from the points' density.
+type VoxelCentroid struct {
+	Size float64
+}
+
+func (r *VoxelCentroid) Reduce(points []float64, target int) []float64 {
+	size := voxelSize(points, r.Size, target)
+	if size <= 0 {
+		return points
+	}
+
+	return voxelCentroids(points, size)
+}
+
+// VoxelNearest keeps, for each cube of side Size, the point closest to the
+// centre of its points, so every output point is a real measurement. Cubes
+// are sized as for VoxelCentroid.
+type VoxelNearest struct {
+	Size float64
+}
+
+func (r *VoxelNearest) Reduce(points []float64, target int) []float64 {
+	size := voxelSize(points, r.Size, target)
+	if size <= 0 {
+		return points
+	}
+
+	min := bounds(points)
+	order := [][3]int64{}
+	centres := map[[3]int64]*[4]float64{}
+
+	for i := 0; i < len(points); i += pointOffset {
+		key := voxelKey(points, i, min, size)
+
+		centre, ok := centres[key]
+		if !ok {
+			centre = &[4]float64{}
+			centres[key] = centre
+			order = append(order, key)
+		}
+
+		centre[0] += points[i]
+		centre[1] += points[i + 1]
+		centre[2] += points[i + 2]
+		centre[3]++
+	}
+
+	nearest := map[[3]int64]int{}
+	distances := map[[3]int64]float64{}
+
+	for i := 0; i < len(points); i += pointOffset {
+		key := voxelKey(points, i, min, size)
+		centre := centres[key]
+		dx := points[i] - centre[0] / centre[3]
+		dy := points[i + 1] - centre[1] / centre[3]
+		dz := points[i + 2] - centre[2] / centre[3]
+		d := dx * dx + dy * dy + dz * dz
+
+		best, ok := distances[key]
+		if !ok || d < best {
+			distances[key] = d
+			nearest[key] = i
+		}
+	}
+
+	res := make([]float64, 0, len(order) * pointOffset)
+	for _, key := range order {
+		j := nearest[key]
+		res = append(res, points[j : j + pointOffset]...)
+	}
+
+	return res
+}
+
+// Random keeps each point with probability Rate.
+type Random struct {
+	Rate float64
+	Config *kmeans.Config
+}
+
+func (r *Random) Reduce(points []float64, target int) []float64 {
+	n := len(points) / pointOffset
+	rate := r.Rate
+	if target > 0 && n > 0 {
+		rate = float64(target) / float64(n)
+	}
+
+	if rate <= 0 {
+		rate = 0.5
+	}
+
+	if rate >= 1 {
+		return points
+	}
+
+	rng := newRand(r.Config, points)
+	res := make([]float64, 0, int(float64(len(points)) * rate) + pointOffset)
+	for i := 0; i < len(points); i += pointOffset {
+		if rng.Float64() < rate {
+			res = append(res, points[i : i + pointOffset]...)
+		}
+	}
+
+	return res
+}
+
+// PoissonDisk keeps a random subset of points no two of which are closer
+// than Radius, giving an even spacing without clumps or holes. Without a
+// Radius it is sized like the default voxels.
+type PoissonDisk struct {
+	Radius float64
+	Config *kmeans.Config
+}
+
+func (r *PoissonDisk) Reduce(points []float64, target int) []float64 {
+	radius := r.Radius
+	if target > 0 || radius <= 0 {
+		// Disks of this radius pack about target points, or as many as the
+		// default voxels, into the bounding box.
+		radius = voxelSize(points, 0, target) * 0.8
+	}
+
+	n := len(points) / pointOffset
+	if radius <= 0 || n <= 1 {
+		return points
+	}
+
+	min := bounds(points)
+	grid := map[[3]int64][]int{}
+	radiusSquared := radius * radius
+
+	res := []float64{}
+
+	for _, p := range newRand(r.Config, points).Perm(n) {
+		i := p * pointOffset
+		key := voxelKey(points, i, min, radius)
+
+		accepted := true
+		for dx := int64(-1); dx <= 1 && accepted; dx++ {
+			for dy := int64(-1); dy <= 1 && accepted; dy++ {
+				for dz := int64(-1); dz <= 1 && accepted; dz++ {
+					for _, j := range grid[[3]int64{key[0] + dx, key[1] + dy, key[2] + dz}] {
+						ex, ey, ez := points[i] - points[j], points[i + 1] - points[j + 1], points[i + 2] - points[j + 2]
+						if ex * ex + ey * ey + ez * ez < radiusSquared {
+							accepted = false
+							break
+						}
+					}
+				}
+			}
+		}
+
+		if accepted {
+			grid[key] = append(grid[key], i)
+			res = append(res, points[i : i + pointOffset]...)
+		}
+
+		// Disks pack a little tighter than cubes, and the points are visited
+		// in random order, so stopping here still spreads them evenly.
+		if target > 0 && len(res) >= target * pointOffset {
+			break
+		}
+	}
+
+	return res
+}
+
+func bounds(points []float64) [3]float64 {
+	min := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+
+	for i := 0; i < len(points); i += pointOffset {
+		min[0] = math.Min(min[0], points[i])
+		min[1] = math.Min(min[1], points[i + 1])
+		min[2] = math.Min(min[2], points[i + 2])
+	}
+
+	return min
+}
+
+func voxelKey(points []float64, i int, min [3]float64, size float64) [3]int64 {
+	return [3]int64{
+		int64(math.Floor((points[i] - min[0]) / size)),
+		int64(math.Floor((points[i + 1] - min[1]) / size)),
+		int64(math.Floor((points[i + 2] - min[2]) / size)),
+	}
+}
+
+// voxelSize returns size, or when a target is given, the cube side at which
+// the points fill no more than target cells. Without either, there is a cell
+// for every VoxelPointsPerCell points. Surfaces leave most of their bounding
+// box empty, so the side is searched on the occupied cells, starting from
+// the one that splits the box into target cells.
+func voxelSize(points []float64, size float64, target int) float64 {
+	if target <= 0 && size > 0 {
+		return size
+	}
+
+	if target <= 0 {
+		target = int(math.Max(1, float64(len(points) / pointOffset / c.VoxelPointsPerCell)))
+	}
+
+	if len(points) <= target * pointOffset {
+		return 0
+	}
+
+	min := bounds(points)
+	max := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for i := 0; i < len(points); i += pointOffset {
+		max[0] = math.Max(max[0], points[i])
+		max[1] = math.Max(max[1], points[i + 1])
+		max[2] = math.Max(max[2], points[i + 2])
+	}
+
+	extent := math.Max(max[0] - min[0], math.Max(max[1] - min[1], max[2] - min[2]))
+	volume := 1.0
+	for i := 0; i < 3; i++ {
+		// Flat extents would zero the volume, so give them a sliver of depth.
+		volume *= math.Max(max[i] - min[i], extent / 1000)
+	}
+
+	lo := math.Cbrt(volume / float64(target))
+	if occupied(points, min, lo) <= target {
+		return lo
+	}
+
+	// Grow the side until few enough cells are filled, then narrow in on
+	// the smallest side that still fits.
+	hi := lo * 2
+	for occupied(points, min, hi) > target {
+		lo, hi = hi, hi * 2
+	}
+
+	for i := 0; i < 8; i++ {
+		mid := (lo + hi) / 2
+		if occupied(points, min, mid) <= target {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	return hi
+}
+
+// occupied counts the cubes of side size holding at least one point.
+func occupied(points []float64, min [3]float64, size float64) int {
+	cells := map[[3]int64]bool{}
+	for i := 0; i < len(points); i += pointOffset {
+		cells[voxelKey(points, i, min, size)] = true
+	}
+
+	return len(cells)
+}
+
+func voxelCentroids(points []float64, size float64) []float64 {
+	min := bounds(points)
+	order := [][3]int64{}
+	sums := map[[3]int64][]float64{}
+	classes := map[[3]int64]map[float64]int{}
+
+	for i := 0; i < len(points); i += pointOffset {
+		key := voxelKey(points, i, min, size)
+
+		sum, ok := sums[key]
+		if !ok {
+			sum = make([]float64, pointOffset)
+			sums[key] = sum
+			classes[key] = map[float64]int{}
+			order = append(order, key)
+		}
+
+		for j := 0; j < pointOffset - 1; j++ {
+			sum[j] += points[i + j]
+		}
+		sum[pointOffset - 1]++
+		classes[key][points[i + pointOffset - 1]]++
+	}
+
+	res := make([]float64, 0, len(order) * pointOffset)
+	for _, key := range order {
+		sum := sums[key]
+		count := sum[pointOffset - 1]
+
+		for j := 0; j < pointOffset - 1; j++ {
+			res = append(res, sum[j] / count)
+		}
+		res = append(res, majority(classes[key]))
+	}
+
+	return res
+}
+
+func majority(counts map[float64]int) float64 {
+	best, bestCount := 0.0, -1
+	for value, count := range counts {
+		if count > bestCount || (count == bestCount && value < best) {
+			best, bestCount = value, count
+		}
+	}
+
+	return best
+}
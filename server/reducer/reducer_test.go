@@ -0,0 +1,60 @@
+package reducer
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func cube(n int) []float64 {
+	rng := rand.New(rand.NewSource(1))
+	points := make([]float64, 0, n * pointOffset)
+	for i := 0; i < n; i++ {
+		points = append(points, rng.Float64() * 10, rng.Float64() * 10, rng.Float64() * 10, 0, 0, 0, 0, 2)
+	}
+
+	return points
+}
+
+func TestDefaultsReduce(t *testing.T) {
+	points := cube(4000)
+	n := len(points) / pointOffset
+
+	for name, r := range map[string]Reducer{
+		"voxel-centroid": &VoxelCentroid{},
+		"voxel-nearest": &VoxelNearest{},
+		"poisson": &PoissonDisk{},
+	} {
+		got := len(r.Reduce(points, 0)) / pointOffset
+		if got == 0 || got >= n {
+			t.Errorf("%s kept %d of %d points without a size, want fewer but some", name, got, n)
+		}
+	}
+}
+
+func TestVoxelSizeWins(t *testing.T) {
+	points := cube(4000)
+
+	// One cube holding every point.
+	if got := len((&VoxelCentroid{Size: 20}).Reduce(points, 0)) / pointOffset; got != 1 {
+		t.Fatalf("kept %d points, want 1", got)
+	}
+}
+
+func TestTargetOnFlatLeaf(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := []float64{}
+	for i := 0; i < 40000; i++ {
+		points = append(points, rng.Float64() * 100, rng.Float64() * 0.05, rng.Float64() * 100, 0, 0, 0, 0, 2)
+	}
+
+	for name, r := range map[string]Reducer{
+		"voxel-centroid": &VoxelCentroid{},
+		"voxel-nearest": &VoxelNearest{},
+		"poisson": &PoissonDisk{},
+	} {
+		got := len(r.Reduce(points, 1000)) / pointOffset
+		if got > 1000 || got < 700 {
+			t.Errorf("%s kept %d points for a target of 1000", name, got)
+		}
+	}
+}
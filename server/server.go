@@ -10,9 +10,17 @@ import (
 	"github.com/gorilla/websocket"
 
 	"fmt"
+	"lidar/constants"
+	"lidar/datastore"
 	"lidar/loader"
+	"lidar/profile"
+	"lidar/streaming"
 	"lidar/structs"
+	"lidar/vector"
+	"lidar/volume"
+	"log"
 	"net/http"
+	"os"
 )
 
 type SessionIdEvent struct {
@@ -23,11 +31,44 @@ type SessionIdEvent struct {
 func main() {
 	socketMapping := make(map[string]*structs.ConcurrentSocket)
 
+	datasets, err := datastore.NewStore(constants.DatasetDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	openSocket := func(c *gin.Context) *structs.ConcurrentSocket {
+		ws, err := websocket.Upgrade(c.Writer, c.Request, nil, 1024 * 32, 1024 * 32);
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+
+		sessionId := uuid.NewString()
+		socket := &structs.ConcurrentSocket{
+			Conn: ws,
+			Lock: sync.Mutex{},
+		};
+		socketMapping[sessionId] = socket
+
+		err = ws.WriteJSON(SessionIdEvent{
+			Event: "sessionId",
+			SessionId: sessionId,
+		})
+
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		go streaming.Listen(socket, datasets)
+
+		return socket
+	}
+
 	r := gin.Default()
 
 	r.Use(cors.New(cors.Config{
         AllowOrigins:     []string{"*"},
-        AllowMethods:     []string{"POST", "OPTIONS"},
+        AllowMethods:     []string{"GET", "POST", "OPTIONS"},
         AllowHeaders:     []string{"*"},
         ExposeHeaders:    []string{"Content-Length"},
         AllowCredentials: true,
@@ -36,27 +77,159 @@ func main() {
 	userFiles := make(map[string][]*structs.FilePart)
 
 	r.GET("/ws", func(c *gin.Context) {
-		ws, err := websocket.Upgrade(c.Writer, c.Request, nil, 1024 * 32, 1024 * 32);
+		openSocket(c)
+	})
+
+	r.GET("/datasets", func(c *gin.Context) {
+		summaries, err := datasets.List()
 		if err != nil {
-			fmt.Println(err)
+			c.String(http.StatusInternalServerError, err.Error())
+			return
 		}
 
-		sessionId := uuid.NewString()
-		socketMapping[sessionId] = &structs.ConcurrentSocket{
-			Conn: ws,
-			Lock: sync.Mutex{},
-		};
+		c.JSON(http.StatusOK, summaries)
+	})
 
-		err = ws.WriteJSON(SessionIdEvent{
-			Event: "sessionId",
-			SessionId: sessionId,
-		})
+	r.GET("/datasets/:id/diagnostics", func(c *gin.Context) {
+		dataset, err := datasets.Open(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusNotFound, "Dataset not found")
+			return
+		}
+
+		report, err := dataset.ReadFile("diagnostics.json")
+		if err != nil {
+			c.String(http.StatusNotFound, "Diagnostics not available")
+			return
+		}
+
+		c.Data(http.StatusOK, "application/json", report)
+	})
+
+	r.GET("/datasets/:id/artifacts", func(c *gin.Context) {
+		dataset, err := datasets.Open(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusNotFound, "Dataset not found")
+			return
+		}
+
+		artifacts, err := dataset.Artifacts()
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.JSON(http.StatusOK, artifacts)
+	})
+
+	r.GET("/datasets/:id/artifacts/:name", func(c *gin.Context) {
+		dataset, err := datasets.Open(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusNotFound, "Dataset not found")
+			return
+		}
+
+		path, err := dataset.ArtifactPath(c.Param("name"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			c.String(http.StatusNotFound, "Artifact not found")
+			return
+		}
+
+		c.FileAttachment(path, c.Param("name"))
+	})
+
+	r.POST("/datasets/:id/volume", func(c *gin.Context) {
+		dataset, err := datasets.Open(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusNotFound, "Dataset not found")
+			return
+		}
+
+		request := structs.VolumeRequest{}
+		err = c.ShouldBindJSON(&request)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var base *datastore.Dataset
+		if request.BaseDatasetId != "" {
+			base, err = datasets.Open(request.BaseDatasetId)
+			if err != nil {
+				c.String(http.StatusNotFound, "Base dataset not found")
+				return
+			}
+		}
+
+		report, err := volume.Compute(dataset, base, &request)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	})
+
+	r.POST("/datasets/:id/profile", func(c *gin.Context) {
+		dataset, err := datasets.Open(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusNotFound, "Dataset not found")
+			return
+		}
+
+		request := structs.ProfileRequest{}
+		err = c.ShouldBindJSON(&request)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		report, err := profile.Extract(dataset, &request)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		switch c.Query("format") {
+		case "csv":
+			c.Header("Content-Type", "text/csv")
+			c.Header("Content-Disposition", "attachment; filename=profile.csv")
+			c.Status(http.StatusOK)
+			err = profile.WriteCSV(c.Writer, report)
+		case "dxf":
+			c.Header("Content-Type", "application/dxf")
+			c.Header("Content-Disposition", "attachment; filename=profile.dxf")
+			c.Status(http.StatusOK)
+			err = vector.WriteDXF(c.Writer, profile.Collection(report))
+		default:
+			c.JSON(http.StatusOK, report)
+		}
 
 		if err != nil {
 			fmt.Println(err)
 		}
 	})
 
+	r.GET("/datasets/:id/ws", func(c *gin.Context) {
+		dataset, err := datasets.Open(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusNotFound, "Dataset not found")
+			return
+		}
+
+		socket := openSocket(c)
+		if socket == nil {
+			return
+		}
+
+		go loader.StreamDataset(socket, dataset)
+	})
+
 	r.POST("/upload", func(c *gin.Context) {
 		uploadFile, _ := c.FormFile("file")
 		uploaderId := c.Request.Header.Get("Uploader-File-Id")
@@ -84,11 +257,68 @@ func main() {
 				uploaderId,
 				&userFiles, 
 				socketMapping[sessionId], 
+				datasets,
 				&structs.ProcessingOptions{
 					Clustering: c.Request.Header.Get("Clustering"),
 					Subsample: c.Request.Header.Get("Subsample"),
 					Lod: c.Request.Header.Get("Lod"),
 					Density: c.Request.Header.Get("Density"),
+					OutOfCore: c.Request.Header.Get("OutOfCore"),
+					MemoryBudget: c.Request.Header.Get("MemoryBudget"),
+					LodLevels: c.Request.Header.Get("LodLevels"),
+					LodPoints: c.Request.Header.Get("LodPoints"),
+					LodDistances: c.Request.Header.Get("LodDistances"),
+					LodErrors: c.Request.Header.Get("LodErrors"),
+					Reducer: c.Request.Header.Get("Reducer"),
+					VoxelSize: c.Request.Header.Get("VoxelSize"),
+					SampleRate: c.Request.Header.Get("SampleRate"),
+					PoissonRadius: c.Request.Header.Get("PoissonRadius"),
+					PointBudget: c.Request.Header.Get("PointBudget"),
+					BudgetWeighting: c.Request.Header.Get("BudgetWeighting"),
+					Seed: c.Request.Header.Get("Seed"),
+					KMeansInit: c.Request.Header.Get("KMeansInit"),
+					KSelection: c.Request.Header.Get("KSelection"),
+					MaxK: c.Request.Header.Get("MaxK"),
+					TargetDensity: c.Request.Header.Get("TargetDensity"),
+					ClusterWorkers: c.Request.Header.Get("ClusterWorkers"),
+					MiniBatchThreshold: c.Request.Header.Get("MiniBatchThreshold"),
+					ClusterByClass: c.Request.Header.Get("ClusterByClass"),
+					ColourWeight: c.Request.Header.Get("ColourWeight"),
+					IntensityWeight: c.Request.Header.Get("IntensityWeight"),
+					Metrics: c.Request.Header.Get("Metrics"),
+					Outliers: c.Request.Header.Get("Outliers"),
+					OutlierK: c.Request.Header.Get("OutlierK"),
+					OutlierStdDev: c.Request.Header.Get("OutlierStdDev"),
+					OutlierRadius: c.Request.Header.Get("OutlierRadius"),
+					OutlierMinNeighbours: c.Request.Header.Get("OutlierMinNeighbours"),
+					OutlierAction: c.Request.Header.Get("OutlierAction"),
+					OutlierStage: c.Request.Header.Get("OutlierStage"),
+					Ground: c.Request.Header.Get("Ground"),
+					GroundCellSize: c.Request.Header.Get("GroundCellSize"),
+					GroundSlope: c.Request.Header.Get("GroundSlope"),
+					GroundMaxWindow: c.Request.Header.Get("GroundMaxWindow"),
+					GroundThreshold: c.Request.Header.Get("GroundThreshold"),
+					GroundMaxThreshold: c.Request.Header.Get("GroundMaxThreshold"),
+					GroundOverwrite: c.Request.Header.Get("GroundOverwrite"),
+					HeightAboveGround: c.Request.Header.Get("HeightAboveGround"),
+					Rasters: c.Request.Header.Get("Rasters"),
+					RasterFormats: c.Request.Header.Get("RasterFormats"),
+					RasterResolution: c.Request.Header.Get("RasterResolution"),
+					Export: c.Request.Header.Get("Export"),
+					Contours: c.Request.Header.Get("Contours"),
+					ContourInterval: c.Request.Header.Get("ContourInterval"),
+					ContourIndex: c.Request.Header.Get("ContourIndex"),
+					ContourSmoothing: c.Request.Header.Get("ContourSmoothing"),
+					ContourFormats: c.Request.Header.Get("ContourFormats"),
+					KeepRaw: c.Request.Header.Get("KeepRaw"),
+					Normals: c.Request.Header.Get("Normals"),
+					NormalK: c.Request.Header.Get("NormalK"),
+					NormalOrientation: c.Request.Header.Get("NormalOrientation"),
+					NormalScanner: c.Request.Header.Get("NormalScanner"),
+					Shapes: c.Request.Header.Get("Shapes"),
+					ShapeTolerance: c.Request.Header.Get("ShapeTolerance"),
+					ShapeMinSupport: c.Request.Header.Get("ShapeMinSupport"),
+					ShapeNormalDeviation: c.Request.Header.Get("ShapeNormalDeviation"),
 				},
 			)
 		}
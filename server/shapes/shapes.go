@@ -0,0 +1,792 @@
+package shapes
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	c "lidar/constants"
+	"lidar/geometry"
+	"lidar/kdtree"
+	"lidar/normals"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+// Config selects the primitives to detect. A point supports a shape when it
+// lies within Tolerance of it and its normal is within NormalDeviation
+// degrees of the shape's normal there. Shapes need at least MinSupport
+// connected points. Normals the job doesn't already compute are estimated
+// from NormalK neighbours.
+type Config struct {
+	Types []string
+	Tolerance float64
+	MinSupport int
+	NormalDeviation float64
+	NormalK int
+	Seed int64
+}
+
+// FromOptions returns nil when the job asked for no shapes. Shapes is a list
+// of "plane", "cylinder" and "sphere", or "all".
+func FromOptions(options *structs.ProcessingOptions) *Config {
+	config := &Config{
+		Types: []string{},
+		Tolerance: c.ShapeTolerance,
+		MinSupport: c.ShapeMinSupport,
+		NormalDeviation: c.ShapeNormalDeviation,
+		NormalK: c.NormalNeighbours,
+	}
+
+	for _, shape := range strings.Split(options.Shapes, ",") {
+		shape = strings.TrimSpace(shape)
+		switch shape {
+		case "plane", "cylinder", "sphere":
+			config.Types = append(config.Types, shape)
+		case "all":
+			config.Types = []string{"plane", "cylinder", "sphere"}
+		}
+	}
+
+	if len(config.Types) == 0 {
+		return nil
+	}
+
+	tolerance, err := strconv.ParseFloat(options.ShapeTolerance, 64)
+	if err == nil && tolerance > 0 {
+		config.Tolerance = tolerance
+	}
+
+	minSupport, err := strconv.Atoi(options.ShapeMinSupport)
+	if err == nil && minSupport >= 3 {
+		config.MinSupport = minSupport
+	}
+
+	deviation, err := strconv.ParseFloat(options.ShapeNormalDeviation, 64)
+	if err == nil && deviation > 0 && deviation < 90 {
+		config.NormalDeviation = deviation
+	}
+
+	k, err := strconv.Atoi(options.NormalK)
+	if err == nil && k >= 3 {
+		config.NormalK = k
+	}
+
+	config.Seed, _ = strconv.ParseInt(options.Seed, 10, 64)
+
+	return config
+}
+
+// Shape is a detected primitive in the point layout: x, elevation, north.
+// Point is a plane's centroid, a cylinder's axis point or a sphere's centre,
+// and Direction a plane's normal or a cylinder's axis.
+type Shape struct {
+	Type string
+	Label string
+	Point [3]float64
+	Direction [3]float64
+	Radius float64
+	Length float64
+	Rms float64
+	Inliers []int
+	// cells are the connectivity voxels holding the inliers, kept
+	// to tell whether shapes found in different batches touch.
+	cells map[[3]int]bool
+}
+
+// residual returns a point's signed distance from the shape and the shape's
+// normal nearest to it. It reports false on a sphere's centre or a
+// cylinder's axis, where the normal is undefined.
+func (s *Shape) residual(p [3]float64) (float64, [3]float64, bool) {
+	v := sub(p, s.Point)
+
+	switch s.Type {
+	case "plane":
+		return dot(v, s.Direction), s.Direction, true
+	case "cylinder":
+		v = sub(v, scale(s.Direction, dot(v, s.Direction)))
+	}
+
+	l := length(v)
+	if l == 0 {
+		return 0, v, false
+	}
+
+	return l - s.Radius, scale(v, 1 / l), true
+}
+
+// detector holds the points and normals shared by every round of detection.
+type detector struct {
+	config *Config
+	points []float64
+	normals [][3]float64
+	tree *kdtree.KDTreeNode
+	active []bool
+	cosine float64
+	maxRadius float64
+}
+
+func (d *detector) position(i int) [3]float64 {
+	return [3]float64{d.points[i * pointOffset], d.points[i * pointOffset + 1], d.points[i * pointOffset + 2]}
+}
+
+func (d *detector) supports(s *Shape, i int) bool {
+	distance, normal, ok := s.residual(d.position(i))
+	return ok && math.Abs(distance) <= d.config.Tolerance && math.Abs(dot(normal, d.normals[i])) >= d.cosine
+}
+
+// Detect finds shapes one at a time, following efficient RANSAC: each round
+// draws candidates from small neighbourhoods, scores them on a sample of the
+// remaining points and keeps the best if its largest connected patch of
+// supporting points is big enough. Its points are then removed. Detection
+// stops after ShapeMaxFailures rounds in a row find nothing. Normals are in
+// the point layout, and are estimated when nil.
+func (config *Config) Detect(points []float64, pointNormals [][3]float64) []Shape {
+	n := len(points) / pointOffset
+	shapes := []Shape{}
+	if n < config.MinSupport {
+		return shapes
+	}
+
+	payloads := make([]interface{}, n)
+	for i := range payloads {
+		payloads[i] = i
+	}
+
+	d := &detector{
+		config: config,
+		points: points,
+		tree: kdtree.ConstructTreeWithPayloads(points, payloads),
+		active: make([]bool, n),
+		cosine: math.Cos(config.NormalDeviation * math.Pi / 180),
+		normals: pointNormals,
+	}
+	if d.normals == nil {
+		d.normals, _ = normals.Estimate(points, nil, config.NormalK)
+	}
+
+	low, high := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}, [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for i := 0; i < n; i++ {
+		d.active[i] = true
+		p := d.position(i)
+		for j := 0; j < 3; j++ {
+			low[j] = math.Min(low[j], p[j])
+			high[j] = math.Max(high[j], p[j])
+		}
+	}
+
+	// Spheres and cylinders larger than the cloud are planes fitted badly.
+	d.maxRadius = length(sub(high, low)) / 2
+	middle := (low[1] + high[1]) / 2
+
+	rng := rand.New(rand.NewSource(config.Seed))
+	remaining := make([]int, n)
+	for i := range remaining {
+		remaining[i] = i
+	}
+
+	for failures := 0; failures < c.ShapeMaxFailures && len(remaining) >= config.MinSupport; {
+		shape := d.round(rng, remaining)
+		if shape == nil {
+			failures++
+			continue
+		}
+
+		failures = 0
+		for _, i := range shape.Inliers {
+			d.active[i] = false
+		}
+
+		kept := remaining[:0]
+		for _, i := range remaining {
+			if d.active[i] {
+				kept = append(kept, i)
+			}
+		}
+		remaining = kept
+
+		shapes = append(shapes, *shape)
+	}
+
+	config.label(shapes, middle)
+
+	return shapes
+}
+
+// label names planes by their slope, and horizontal ones by whether they lie
+// below or above the elevation middle.
+func (config *Config) label(shapes []Shape, middle float64) {
+	cosine := math.Cos(config.NormalDeviation * math.Pi / 180)
+
+	for i := range shapes {
+		shape := &shapes[i]
+		shape.Label = shape.Type
+		if shape.Type != "plane" {
+			continue
+		}
+
+		switch {
+		case math.Abs(shape.Direction[1]) >= cosine && shape.Point[1] < middle:
+			shape.Label = "floor"
+		case math.Abs(shape.Direction[1]) >= cosine:
+			shape.Label = "ceiling"
+		case math.Abs(shape.Direction[1]) <= math.Sqrt(1 - cosine * cosine):
+			shape.Label = "wall"
+		}
+	}
+}
+
+// round draws and scores one batch of candidates, returning the best as a
+// finished shape or nil if it has too little support.
+func (d *detector) round(rng *rand.Rand, remaining []int) *Shape {
+	sample := remaining
+	if len(sample) > c.ShapeScoreSample {
+		sample = make([]int, c.ShapeScoreSample)
+		for i := range sample {
+			sample[i] = remaining[rng.Intn(len(remaining))]
+		}
+	}
+
+	candidates := []*Shape{}
+	for i := 0; i < c.ShapeCandidates; i++ {
+		candidate := d.candidate(rng, remaining, d.config.Types[i % len(d.config.Types)])
+		if candidate != nil {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	scores := make([]int, len(candidates))
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, runtime.NumCPU())
+
+	for k, candidate := range candidates {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(k int, candidate *Shape) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			for _, i := range sample {
+				if d.supports(candidate, i) {
+					scores[k]++
+				}
+			}
+		}(k, candidate)
+	}
+
+	wg.Wait()
+
+	best := 0
+	for k := range scores {
+		if scores[k] > scores[best] {
+			best = k
+		}
+	}
+
+	shape := candidates[best]
+	inliers := d.inliers(shape, remaining)
+
+	// Shapes are refitted to their support, which is far less noisy than the
+	// few points they were drawn from, and gathers more support in turn.
+	for k := 0; k < c.ShapeRefits && d.refit(shape, inliers); k++ {
+		inliers = d.inliers(shape, remaining)
+	}
+
+	inliers = d.largestPatch(inliers)
+	if len(inliers) < d.config.MinSupport {
+		return nil
+	}
+
+	shape.Inliers = inliers
+	d.finish(shape)
+
+	return shape
+}
+
+// candidate fits a shape of a type to a random point and its neighbours,
+// returning nil when they are degenerate or their normals disagree with it.
+func (d *detector) candidate(rng *rand.Rand, remaining []int, shape string) *Shape {
+	seed := remaining[rng.Intn(len(remaining))]
+	p := d.points[seed * pointOffset : (seed + 1) * pointOffset]
+
+	others := []int{}
+	for _, neighbour := range d.tree.KNearest(p, c.ShapeSampleNeighbours) {
+		i := neighbour.Payload.(int)
+		if i != seed && d.active[i] {
+			others = append(others, i)
+		}
+	}
+
+	needed := 1
+	if shape == "plane" {
+		needed = 2
+	}
+	if len(others) < needed {
+		return nil
+	}
+
+	rng.Shuffle(len(others), func(i, j int) {
+		others[i], others[j] = others[j], others[i]
+	})
+	chosen := append([]int{seed}, others[:needed]...)
+
+	var candidate *Shape
+	switch shape {
+	case "plane":
+		candidate = d.plane(chosen)
+	case "sphere":
+		candidate = d.sphere(chosen)
+	case "cylinder":
+		candidate = d.cylinder(chosen)
+	}
+
+	if candidate == nil {
+		return nil
+	}
+
+	for _, i := range chosen {
+		if !d.supports(candidate, i) {
+			return nil
+		}
+	}
+
+	return candidate
+}
+
+func (d *detector) plane(chosen []int) *Shape {
+	a, b, e := d.position(chosen[0]), d.position(chosen[1]), d.position(chosen[2])
+	normal := cross(sub(b, a), sub(e, a))
+	l := length(normal)
+	if l < 1e-12 {
+		return nil
+	}
+
+	return &Shape{
+		Type: "plane",
+		Point: a,
+		Direction: scale(normal, 1 / l),
+	}
+}
+
+// sphere centres a sphere where the normal lines of two points pass closest.
+func (d *detector) sphere(chosen []int) *Shape {
+	a, b := d.position(chosen[0]), d.position(chosen[1])
+	centre, ok := closest(a, d.normals[chosen[0]], b, d.normals[chosen[1]])
+	if !ok {
+		return nil
+	}
+
+	ra, rb := length(sub(a, centre)), length(sub(b, centre))
+	if math.Abs(ra - rb) > d.config.Tolerance || (ra + rb) / 2 > d.maxRadius {
+		return nil
+	}
+
+	return &Shape{
+		Type: "sphere",
+		Point: centre,
+		Radius: (ra + rb) / 2,
+	}
+}
+
+// cylinder takes its axis across two points' normals, and centres it where
+// their normal lines cross once projected along the axis.
+func (d *detector) cylinder(chosen []int) *Shape {
+	na, nb := d.normals[chosen[0]], d.normals[chosen[1]]
+	axis := cross(na, nb)
+	l := length(axis)
+	if l < 1e-3 {
+		return nil
+	}
+	axis = scale(axis, 1 / l)
+
+	a, b := d.position(chosen[0]), d.position(chosen[1])
+	a = sub(a, scale(axis, dot(a, axis)))
+	b = sub(b, scale(axis, dot(b, axis)))
+
+	centre, ok := closest(a, na, b, nb)
+	if !ok {
+		return nil
+	}
+
+	ra, rb := length(sub(a, centre)), length(sub(b, centre))
+	if math.Abs(ra - rb) > d.config.Tolerance || (ra + rb) / 2 > d.maxRadius {
+		return nil
+	}
+
+	return &Shape{
+		Type: "cylinder",
+		Point: centre,
+		Direction: axis,
+		Radius: (ra + rb) / 2,
+	}
+}
+
+// refit fits a shape to its inliers by least squares, keeping its type. It
+// reports false, leaving the shape as it was, when the inliers are too few
+// or degenerate.
+func (d *detector) refit(s *Shape, inliers []int) bool {
+	if len(inliers) < 4 {
+		return false
+	}
+
+	buf := make([]float64, 0, len(inliers) * pointOffset)
+	for _, i := range inliers {
+		buf = append(buf, d.points[i * pointOffset : (i + 1) * pointOffset]...)
+	}
+	mean, cov := geometry.Covariance(buf)
+
+	switch s.Type {
+	case "plane":
+		_, vectors := geometry.SymmetricEigen(cov)
+		s.Point, s.Direction = mean, vectors[0]
+	case "sphere":
+		// |p|^2 = 2 p.c + k, with k = r^2 - |c|^2, is linear in c and k.
+		m := make([][]float64, 4)
+		for i := range m {
+			m[i] = make([]float64, 4)
+		}
+		r := make([]float64, 4)
+
+		for _, i := range inliers {
+			p := sub(d.position(i), mean)
+			row := []float64{2 * p[0], 2 * p[1], 2 * p[2], 1}
+			for a := 0; a < 4; a++ {
+				for b := 0; b < 4; b++ {
+					m[a][b] += row[a] * row[b]
+				}
+				r[a] += row[a] * dot(p, p)
+			}
+		}
+
+		x, ok := solve(m, r)
+		if !ok {
+			return false
+		}
+
+		centre := [3]float64{x[0], x[1], x[2]}
+		radius := math.Sqrt(math.Max(x[3] + dot(centre, centre), 0))
+		if radius == 0 || radius > d.maxRadius {
+			return false
+		}
+
+		s.Point, s.Radius = add(centre, mean), radius
+	case "cylinder":
+		// The axis is the direction the surface normals vary least along.
+		var spread [3][3]float64
+		for _, i := range inliers {
+			n := d.normals[i]
+			for a := 0; a < 3; a++ {
+				for b := 0; b < 3; b++ {
+					spread[a][b] += n[a] * n[b]
+				}
+			}
+		}
+		_, vectors := geometry.SymmetricEigen(spread)
+		axis := vectors[0]
+
+		// The circle across the axis is fitted like the sphere, in two
+		// dimensions.
+		u := cross(axis, [3]float64{1, 0, 0})
+		if length(u) < 0.5 {
+			u = cross(axis, [3]float64{0, 0, 1})
+		}
+		u = scale(u, 1 / length(u))
+		v := cross(axis, u)
+
+		m := [][]float64{{0, 0, 0}, {0, 0, 0}, {0, 0, 0}}
+		r := make([]float64, 3)
+		for _, i := range inliers {
+			p := sub(d.position(i), mean)
+			x, y := dot(p, u), dot(p, v)
+			row := []float64{2 * x, 2 * y, 1}
+			for a := 0; a < 3; a++ {
+				for b := 0; b < 3; b++ {
+					m[a][b] += row[a] * row[b]
+				}
+				r[a] += row[a] * (x * x + y * y)
+			}
+		}
+
+		x, ok := solve(m, r)
+		if !ok {
+			return false
+		}
+
+		radius := math.Sqrt(math.Max(x[2] + x[0] * x[0] + x[1] * x[1], 0))
+		if radius == 0 || radius > d.maxRadius {
+			return false
+		}
+
+		s.Point = add(mean, add(scale(u, x[0]), scale(v, x[1])))
+		s.Direction, s.Radius = axis, radius
+	}
+
+	return true
+}
+
+// solve applies Gaussian elimination with partial pivoting to a small system.
+// m and r are overwritten.
+func solve(m [][]float64, r []float64) ([]float64, bool) {
+	n := len(r)
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		r[col], r[pivot] = r[pivot], r[col]
+
+		for row := col + 1; row < n; row++ {
+			f := m[row][col] / m[col][col]
+			for k := col; k < n; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+			r[row] -= f * r[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := r[row]
+		for k := row + 1; k < n; k++ {
+			sum -= m[row][k] * x[k]
+		}
+		x[row] = sum / m[row][row]
+	}
+
+	return x, true
+}
+
+func (d *detector) inliers(s *Shape, remaining []int) []int {
+	res := []int{}
+	for _, i := range remaining {
+		if d.supports(s, i) {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
+
+// largestPatch keeps the biggest group of points joined through occupied
+// ShapeConnectivity sized voxels, so that separate surfaces lying on one
+// shape, such as two walls in line, become separate segments.
+func (d *detector) largestPatch(inliers []int) []int {
+	size := d.config.connectivity()
+	voxels := map[[3]int][]int{}
+	for _, i := range inliers {
+		key := cell(d.position(i), size)
+		voxels[key] = append(voxels[key], i)
+	}
+
+	seen := map[[3]int]bool{}
+	best := []int{}
+
+	for start := range voxels {
+		if seen[start] {
+			continue
+		}
+		seen[start] = true
+
+		patch := []int{}
+		queue := [][3]int{start}
+		for len(queue) > 0 {
+			key := queue[len(queue) - 1]
+			queue = queue[:len(queue) - 1]
+			patch = append(patch, voxels[key]...)
+
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					for dz := -1; dz <= 1; dz++ {
+						next := [3]int{key[0] + dx, key[1] + dy, key[2] + dz}
+						if _, ok := voxels[next]; ok && !seen[next] {
+							seen[next] = true
+							queue = append(queue, next)
+						}
+					}
+				}
+			}
+		}
+
+		if len(patch) > len(best) {
+			best = patch
+		}
+	}
+
+	return best
+}
+
+// finish settles a shape's reference point and direction, and measures its
+// fit. Directions are signed so their largest component is positive, which
+// points horizontal planes up, so results don't depend on the order points
+// were drawn in.
+func (d *detector) finish(s *Shape) {
+	s.Direction = orient(s.Direction)
+
+	sum := 0.0
+	low, high := math.Inf(1), math.Inf(-1)
+	centroid := [3]float64{}
+	s.cells = map[[3]int]bool{}
+
+	for _, i := range s.Inliers {
+		p := d.position(i)
+		s.cells[cell(p, d.config.connectivity())] = true
+		distance, _, _ := s.residual(p)
+		sum += distance * distance
+		centroid = add(centroid, p)
+
+		along := dot(sub(p, s.Point), s.Direction)
+		low = math.Min(low, along)
+		high = math.Max(high, along)
+	}
+
+	count := float64(len(s.Inliers))
+	s.Rms = math.Sqrt(sum / count)
+
+	switch s.Type {
+	case "plane":
+		s.Point = scale(centroid, 1 / count)
+	case "cylinder":
+		s.Point = add(s.Point, scale(s.Direction, (low + high) / 2))
+		s.Length = high - low
+	}
+}
+
+// orient signs a direction so its largest component is positive.
+func orient(v [3]float64) [3]float64 {
+	largest := 0
+	for i := 1; i < 3; i++ {
+		if math.Abs(v[i]) > math.Abs(v[largest]) {
+			largest = i
+		}
+	}
+	if v[largest] < 0 {
+		return scale(v, -1)
+	}
+
+	return v
+}
+
+// connectivity is the side of the voxels through which points join a patch.
+func (config *Config) connectivity() float64 {
+	return math.Max(c.ShapeConnectivity, 2 * config.Tolerance)
+}
+
+func cell(p [3]float64, size float64) [3]int {
+	return [3]int{int(math.Floor(p[0] / size)), int(math.Floor(p[1] / size)), int(math.Floor(p[2] / size))}
+}
+
+// closest returns the midpoint of the closest approach of the lines through
+// a along u and through b along v, reporting false for parallel lines.
+func closest(a, u, b, v [3]float64) ([3]float64, bool) {
+	w := sub(a, b)
+	uv, uw, vw := dot(u, v), dot(u, w), dot(v, w)
+	uu, vv := dot(u, u), dot(v, v)
+
+	denominator := uu * vv - uv * uv
+	if denominator < 1e-9 {
+		return [3]float64{}, false
+	}
+
+	t := (uv * vw - vv * uw) / denominator
+	s := (uu * vw - uv * uw) / denominator
+
+	return scale(add(add(a, scale(u, t)), add(b, scale(v, s))), 0.5), true
+}
+
+func add(a, b [3]float64) [3]float64 {
+	return [3]float64{a[0] + b[0], a[1] + b[1], a[2] + b[2]}
+}
+
+func sub(a, b [3]float64) [3]float64 {
+	return [3]float64{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func scale(a [3]float64, k float64) [3]float64 {
+	return [3]float64{a[0] * k, a[1] * k, a[2] * k}
+}
+
+func dot(a, b [3]float64) float64 {
+	return a[0] * b[0] + a[1] * b[1] + a[2] * b[2]
+}
+
+func cross(a, b [3]float64) [3]float64 {
+	return [3]float64{a[1] * b[2] - a[2] * b[1], a[2] * b[0] - a[0] * b[2], a[0] * b[1] - a[1] * b[0]}
+}
+
+func length(a [3]float64) float64 {
+	return math.Sqrt(dot(a, a))
+}
+
+// Segments places shapes in real-world coordinates: easting, northing and
+// elevation.
+func Segments(shapes []Shape, headers *structs.LASHeaders) []structs.ShapeSegment {
+	origin := [3]float64{headers.Offset[0], headers.Offset[2], headers.Offset[1]}
+	swap := func(v [3]float64) []float64 {
+		return []float64{v[0], v[2], v[1]}
+	}
+
+	segments := make([]structs.ShapeSegment, len(shapes))
+	for i, s := range shapes {
+		segments[i] = segment(i, s, origin, swap)
+	}
+
+	return segments
+}
+
+func segment(id int, s Shape, origin [3]float64, axes func(v [3]float64) []float64) structs.ShapeSegment {
+	res := structs.ShapeSegment{
+		Id: id,
+		Type: s.Type,
+		Label: s.Label,
+		Centre: axes(add(s.Point, origin)),
+		Radius: s.Radius,
+		Length: s.Length,
+		Rms: s.Rms,
+		Inliers: s.Inliers,
+	}
+
+	switch s.Type {
+	case "plane":
+		res.Normal = axes(s.Direction)
+	case "cylinder":
+		res.Axis = axes(s.Direction)
+	}
+
+	return res
+}
+
+// Send streams each shape to the client in its coordinate space, one event
+// per shape since inlier lists can be long.
+func Send(socket *structs.ConcurrentSocket, shapes []Shape, m *structs.LASMetaData) {
+	origin := [3]float64{m.OffsetX, m.OffsetZ, m.OffsetY}
+	same := func(v [3]float64) []float64 {
+		return v[:]
+	}
+
+	socket.Lock.Lock()
+	defer socket.Lock.Unlock()
+
+	for i, s := range shapes {
+		socket.Conn.WriteJSON(structs.ShapeEvent{
+			Event: "shape",
+			Segment: segment(i, s, origin, same),
+			Index: i,
+			Total: len(shapes),
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package shapes
+
+import (
+	"math"
+	"testing"
+
+	"lidar/octree"
+)
+
+func config() *Config {
+	return &Config{
+		Types: []string{"plane"},
+		Tolerance: 0.05,
+		MinSupport: 200,
+		NormalDeviation: 20,
+		NormalK: 10,
+	}
+}
+
+// room is a floor at elevation 1 with a wall standing across it at north 8.
+func room() *octree.Octree {
+	o := octree.GenerateOctree(&octree.OctreeDimensions{
+		X1: 0, X2: 16,
+		Y1: 0, Y2: 16,
+		Z1: 0, Z2: 16,
+		Granularity: 3,
+	})
+
+	for x := 0.125; x < 16; x += 0.25 {
+		for z := 0.125; z < 16; z += 0.25 {
+			octree.AddPoint(x, 1, z, 0, 0, 0, 0, 0, 0, o.Granularity, o.Root, o)
+		}
+		for y := 1.375; y < 9; y += 0.25 {
+			octree.AddPoint(x, y, 8.01, 0, 0, 0, 0, 0, 0, o.Granularity, o.Root, o)
+		}
+	}
+
+	return o
+}
+
+func TestDetectTreeFindsFloorAndWall(t *testing.T) {
+	o := room()
+	c := config()
+	found := c.DetectTree(o, nil)
+
+	// Inlier IDs index the leaves' points in order.
+	points := []float64{}
+	for _, leaf := range o.Leaves {
+		leafPoints, _ := o.ReadPoints(leaf)
+		points = append(points, leafPoints...)
+	}
+
+	labels := map[string]int{}
+	for _, s := range found {
+		labels[s.Label]++
+
+		for _, i := range s.Inliers {
+			p := [3]float64{points[i * pointOffset], points[i * pointOffset + 1], points[i * pointOffset + 2]}
+			distance, _, _ := s.residual(p)
+			if math.Abs(distance) > c.Tolerance {
+				t.Fatalf("%s inlier %d is %f from it", s.Label, i, distance)
+			}
+		}
+	}
+
+	if labels["floor"] != 1 || labels["wall"] != 1 {
+		t.Fatalf("found %v, want one floor and one wall", labels)
+	}
+}
+
+func TestMergeJoinsBatches(t *testing.T) {
+	c := config()
+	halves := [2][]float64{}
+	for x := 0.125; x < 16; x += 0.25 {
+		for z := 0.125; z < 16; z += 0.25 {
+			half := 0
+			if x > 8 {
+				half = 1
+			}
+			halves[half] = append(halves[half], x, 1, z, 0, 0, 0, 0, 0)
+		}
+	}
+
+	found := []Shape{}
+	for _, points := range halves {
+		found = append(found, c.Detect(points, nil)...)
+	}
+	if len(found) != 2 {
+		t.Fatalf("found %d shapes in the halves, want 2", len(found))
+	}
+
+	merged := c.merge(found)
+	if len(merged) != 1 {
+		t.Fatalf("merged into %d shapes, want 1", len(merged))
+	}
+	if len(merged[0].Inliers) != len(halves[0]) / pointOffset + len(halves[1]) / pointOffset {
+		t.Fatalf("merged shape has %d inliers", len(merged[0].Inliers))
+	}
+	if math.Abs(merged[0].Point[1] - 1) > 1e-9 || math.Abs(merged[0].Direction[1] - 1) > 1e-9 {
+		t.Fatalf("merged plane is at %v facing %v", merged[0].Point, merged[0].Direction)
+	}
+}
+
+func TestMergeKeepsSeparateSurfaces(t *testing.T) {
+	c := config()
+	points := []float64{}
+	for x := 0.125; x < 16; x += 0.25 {
+		for z := 0.125; z < 4; z += 0.25 {
+			points = append(points, x, 1, z, 0, 0, 0, 0, 0)
+			points = append(points, x, 1, z + 12, 0, 0, 0, 0, 0)
+		}
+	}
+
+	found := c.merge(c.Detect(points, nil))
+	if len(found) != 2 {
+		t.Fatalf("found %d shapes, want two apart on one plane", len(found))
+	}
+}
+
+func TestBatchesCoverLeaves(t *testing.T) {
+	o := room()
+	limit := 500
+	seen := map[*octree.OctreeNode]int{}
+
+	for _, batch := range batches(o, limit) {
+		count := 0
+		for _, leaf := range batch {
+			seen[leaf]++
+			count += o.PointCount(leaf)
+		}
+
+		if count > limit && len(batch) > 1 {
+			t.Fatalf("batch of %d leaves holds %d points", len(batch), count)
+		}
+	}
+
+	for _, leaf := range o.Leaves {
+		if seen[leaf] != 1 {
+			t.Fatalf("leaf %s is in %d batches", leaf.Id, seen[leaf])
+		}
+	}
+}
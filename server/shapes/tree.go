@@ -0,0 +1,253 @@
+package shapes
+
+import (
+	"fmt"
+	"math"
+
+	c "lidar/constants"
+	"lidar/dimensions"
+	"lidar/normals"
+	"lidar/octree"
+)
+
+// DetectTree finds shapes among the octree's leaves one batch at a time, so
+// the cloud is never gathered in one slice. A batch is the leaves under the
+// highest node holding no more than ShapeBatchPoints points. Normals come
+// from the leaves' cached normal dimensions when the job computes them, and
+// are estimated otherwise. Shapes cut by a batch's edge are merged back
+// together, and inlier IDs index the points in the order the leaves were
+// streamed.
+func (config *Config) DetectTree(o *octree.Octree, cache *dimensions.Cache) []Shape {
+	starts := map[*octree.OctreeNode]int{}
+	next := 0
+	for _, leaf := range o.Leaves {
+		starts[leaf] = next
+		next += o.PointCount(leaf)
+	}
+
+	found := []Shape{}
+	low, high := math.Inf(1), math.Inf(-1)
+
+	for _, batch := range batches(o, c.ShapeBatchPoints) {
+		points := []float64{}
+		ids := []int{}
+		pointNormals := [][3]float64{}
+		cached := true
+
+		for _, leaf := range batch {
+			leafPoints, err := o.ReadPoints(leaf)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			n := len(leafPoints) / pointOffset
+			leafNormals, ok := cachedNormals(cache, leaf, n)
+			cached = cached && ok
+			pointNormals = append(pointNormals, leafNormals...)
+
+			for i := 0; i < n; i++ {
+				ids = append(ids, starts[leaf] + i)
+				low = math.Min(low, leafPoints[i * pointOffset + 1])
+				high = math.Max(high, leafPoints[i * pointOffset + 1])
+			}
+
+			points = append(points, leafPoints...)
+		}
+
+		if !cached {
+			pointNormals = nil
+		}
+
+		shapes := config.Detect(points, pointNormals)
+		for k := range shapes {
+			for j, i := range shapes[k].Inliers {
+				shapes[k].Inliers[j] = ids[i]
+			}
+		}
+
+		found = append(found, shapes...)
+	}
+
+	found = config.merge(found)
+	config.label(found, (low + high) / 2)
+
+	return found
+}
+
+// cachedNormals returns a leaf's normals, in the point layout, from its
+// cached dimensions.
+func cachedNormals(cache *dimensions.Cache, leaf *octree.OctreeNode, n int) ([][3]float64, bool) {
+	if cache == nil {
+		return nil, false
+	}
+
+	values, ok := cache.Load("leaf", leaf.Id)
+	if !ok || len(values[normals.NormalX]) != n || len(values[normals.NormalY]) != n || len(values[normals.NormalZ]) != n {
+		return nil, false
+	}
+
+	res := make([][3]float64, n)
+	for i := range res {
+		res[i] = [3]float64{values[normals.NormalX][i], values[normals.NormalZ][i], values[normals.NormalY][i]}
+	}
+
+	return res, true
+}
+
+// batches groups the leaves under the highest nodes holding no more than
+// limit points, so that each batch is a compact region. A single leaf over
+// the limit is a batch of its own.
+func batches(o *octree.Octree, limit int) [][]*octree.OctreeNode {
+	counts := map[*octree.OctreeNode]int{}
+	under := map[*octree.OctreeNode][]*octree.OctreeNode{}
+
+	for _, leaf := range o.Leaves {
+		count := o.PointCount(leaf)
+		for node := leaf; node != nil; node = node.Parent {
+			counts[node] += count
+			under[node] = append(under[node], leaf)
+		}
+	}
+
+	res := [][]*octree.OctreeNode{}
+
+	var visit func(node *octree.OctreeNode)
+	visit = func(node *octree.OctreeNode) {
+		if len(under[node]) == 0 {
+			return
+		}
+
+		if counts[node] <= limit || len(under[node]) == 1 {
+			res = append(res, under[node])
+			return
+		}
+
+		for _, child := range node.Children {
+			visit(child)
+		}
+	}
+
+	visit(o.Root)
+
+	return res
+}
+
+// merge joins shapes of one surface that were found in neighbouring
+// batches: shapes of a type whose parameters agree within Tolerance and
+// whose inliers touch.
+func (config *Config) merge(shapes []Shape) []Shape {
+	cosine := math.Cos(config.NormalDeviation * math.Pi / 180)
+
+	for merged := true; merged; {
+		merged = false
+
+		for i := 0; i < len(shapes) && !merged; i++ {
+			for j := i + 1; j < len(shapes); j++ {
+				if !config.agree(&shapes[i], &shapes[j], cosine) || !touch(&shapes[i], &shapes[j]) {
+					continue
+				}
+
+				shapes[i] = combine(shapes[i], shapes[j])
+				shapes = append(shapes[:j], shapes[j + 1:]...)
+				merged = true
+				break
+			}
+		}
+	}
+
+	return shapes
+}
+
+func (config *Config) agree(a, b *Shape, cosine float64) bool {
+	if a.Type != b.Type {
+		return false
+	}
+
+	switch a.Type {
+	case "plane":
+		return math.Abs(dot(a.Direction, b.Direction)) >= cosine &&
+			math.Abs(dot(sub(b.Point, a.Point), a.Direction)) <= config.Tolerance &&
+			math.Abs(dot(sub(a.Point, b.Point), b.Direction)) <= config.Tolerance
+	case "cylinder":
+		v := sub(b.Point, a.Point)
+		across := sub(v, scale(a.Direction, dot(v, a.Direction)))
+		return math.Abs(dot(a.Direction, b.Direction)) >= cosine &&
+			length(across) <= config.Tolerance &&
+			math.Abs(a.Radius - b.Radius) <= config.Tolerance
+	case "sphere":
+		return length(sub(a.Point, b.Point)) <= config.Tolerance && math.Abs(a.Radius - b.Radius) <= config.Tolerance
+	}
+
+	return false
+}
+
+// touch reports whether two shapes' inliers share or neighbour a voxel.
+func touch(a, b *Shape) bool {
+	small, large := a.cells, b.cells
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+
+	for key := range small {
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				for dz := -1; dz <= 1; dz++ {
+					if large[[3]int{key[0] + dx, key[1] + dy, key[2] + dz}] {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// combine averages two shapes' parameters weighted by their support. A
+// cylinder's length spans both.
+func combine(a, b Shape) Shape {
+	wa, wb := float64(len(a.Inliers)), float64(len(b.Inliers))
+	total := wa + wb
+
+	res := a
+	res.Inliers = append(append([]int{}, a.Inliers...), b.Inliers...)
+	res.Rms = math.Sqrt((wa * a.Rms * a.Rms + wb * b.Rms * b.Rms) / total)
+	res.Radius = (wa * a.Radius + wb * b.Radius) / total
+	res.Point = scale(add(scale(a.Point, wa), scale(b.Point, wb)), 1 / total)
+
+	res.cells = make(map[[3]int]bool, len(a.cells) + len(b.cells))
+	for key := range a.cells {
+		res.cells[key] = true
+	}
+	for key := range b.cells {
+		res.cells[key] = true
+	}
+
+	if a.Type == "sphere" {
+		return res
+	}
+
+	direction := b.Direction
+	if dot(a.Direction, direction) < 0 {
+		direction = scale(direction, -1)
+	}
+	sum := add(scale(a.Direction, wa), scale(direction, wb))
+	res.Direction = orient(scale(sum, 1 / length(sum)))
+
+	if a.Type == "cylinder" {
+		low, high := math.Inf(1), math.Inf(-1)
+		for _, s := range []Shape{a, b} {
+			for _, end := range []float64{-0.5, 0.5} {
+				along := dot(sub(add(s.Point, scale(s.Direction, end * s.Length)), a.Point), res.Direction)
+				low = math.Min(low, along)
+				high = math.Max(high, along)
+			}
+		}
+
+		res.Point = add(a.Point, scale(res.Direction, (low + high) / 2))
+		res.Length = high - low
+	}
+
+	return res
+}
@@ -0,0 +1,112 @@
+package spill
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Store keeps point buffers on disk, one file per key, so that octree nodes
+// can be flushed out of memory while a large file is being built.
+type Store struct {
+	Dir string
+}
+
+func NewStore(parent string) (*Store, error) {
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(parent, "octree-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		Dir: dir,
+	}, nil
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.Dir, key + ".bin")
+}
+
+func (s *Store) Append(key string, points []float64) error {
+	return s.write(key, points, os.O_CREATE | os.O_WRONLY | os.O_APPEND)
+}
+
+func (s *Store) Write(key string, points []float64) error {
+	return s.write(key, points, os.O_CREATE | os.O_WRONLY | os.O_TRUNC)
+}
+
+func (s *Store) write(key string, points []float64, flag int) error {
+	f, err := os.OpenFile(s.path(key), flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	err = WritePoints(w, points)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func (s *Store) Read(key string) ([]float64, error) {
+	buf, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodePoints(buf), nil
+}
+
+func (s *Store) Remove(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s *Store) Close() error {
+	return os.RemoveAll(s.Dir)
+}
+
+// WritePoints encodes points as little endian float64s.
+func WritePoints(w io.Writer, points []float64) error {
+	buf := make([]byte, 8 * 1024)
+
+	for i := 0; i < len(points); i += 1024 {
+		end := i + 1024
+		if end > len(points) {
+			end = len(points)
+		}
+
+		for j, point := range points[i:end] {
+			binary.LittleEndian.PutUint64(buf[j * 8:], math.Float64bits(point))
+		}
+
+		_, err := w.Write(buf[:(end - i) * 8])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func DecodePoints(buf []byte) []float64 {
+	points := make([]float64, len(buf) / 8)
+
+	for i := range points {
+		points[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[i * 8:]))
+	}
+
+	return points
+}
@@ -0,0 +1,464 @@
+package streaming
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"lidar/constants"
+	"lidar/datastore"
+	"lidar/dimensions"
+	utils "lidar/loader_utils"
+	"lidar/structs"
+)
+
+type node struct {
+	Id string
+	Label string
+	Count int
+	Min [3]float64
+	Max [3]float64
+	GeometricError float64
+	Parent *node
+	Children []*node
+}
+
+// Streamer sends the nodes of a stored dataset that a client's camera can
+// see, coarse nodes first, and cancels ones that have gone out of view.
+type Streamer struct {
+	socket *structs.ConcurrentSocket
+	dataset *datastore.Dataset
+	nodes map[string]*node
+	roots []*node
+	sent map[string]bool
+	camera *structs.CameraEvent
+	ranges []structs.DimensionRange
+	updates chan *structs.CameraEvent
+	filters chan []structs.DimensionRange
+	stop chan struct{}
+}
+
+// Listen reads client messages from a socket until it closes, starting a
+// streamer when the client asks to view a dataset.
+func Listen(socket *structs.ConcurrentSocket, datasets *datastore.Store) {
+	var streamer *Streamer
+
+	defer func() {
+		if streamer != nil {
+			streamer.Stop()
+		}
+	}()
+
+	for {
+		_, message, err := socket.Conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		event := structs.ClientEvent{}
+		err = json.Unmarshal(message, &event)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		switch event.Event {
+		case "stream":
+			dataset, err := datasets.Open(event.DatasetId)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if streamer != nil {
+				streamer.Stop()
+			}
+
+			streamer = NewStreamer(socket, dataset)
+			go streamer.Run()
+		case "camera":
+			camera := &structs.CameraEvent{}
+			err = json.Unmarshal(message, camera)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if streamer != nil {
+				streamer.Update(camera)
+			}
+		case "filter":
+			filter := &structs.FilterEvent{}
+			err = json.Unmarshal(message, filter)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if streamer != nil {
+				streamer.Filter(filter.Ranges)
+			}
+		}
+	}
+}
+
+func NewStreamer(socket *structs.ConcurrentSocket, dataset *datastore.Dataset) *Streamer {
+	s := &Streamer{
+		socket: socket,
+		dataset: dataset,
+		nodes: map[string]*node{},
+		roots: []*node{},
+		sent: map[string]bool{},
+		updates: make(chan *structs.CameraEvent, 1),
+		filters: make(chan []structs.DimensionRange, 1),
+		stop: make(chan struct{}),
+	}
+
+	s.buildHierarchy()
+
+	return s
+}
+
+// buildHierarchy links every stored node to its closest stored ancestor, in
+// the client's coordinate space. Node IDs are octree paths, so an ancestor's
+// ID is always a prefix of its descendants'.
+func (s *Streamer) buildHierarchy() {
+	m := s.dataset.Info.Metadata
+	bounds := map[string]datastore.Node{}
+	for _, n := range s.dataset.Info.Nodes {
+		bounds[n.Id] = n
+	}
+
+	for _, level := range s.dataset.Info.Levels {
+		// The raw points share the leaves' node IDs but are never streamed.
+		if level.Label == "raw" {
+			continue
+		}
+
+		for _, id := range level.Order {
+			if _, exists := s.nodes[id]; exists {
+				continue
+			}
+
+			b := bounds[id]
+			n := &node{
+				Id: id,
+				Label: level.Label,
+				Count: level.Segments[id].Length / constants.PointOffset,
+				Min: [3]float64{b.X1 + m.OffsetX, b.Y1 + m.OffsetZ, b.Z1 + m.OffsetY},
+				Max: [3]float64{b.X2 + m.OffsetX, b.Y2 + m.OffsetZ, b.Z2 + m.OffsetY},
+			}
+
+			// Levels can carry a configured error; otherwise estimate the point
+			// spacing from the node's size and count.
+			n.GeometricError = level.GeometricError
+			if n.GeometricError <= 0 {
+				dx, dy, dz := b.X2 - b.X1, b.Y2 - b.Y1, b.Z2 - b.Z1
+				n.GeometricError = math.Sqrt(dx * dx + dy * dy + dz * dz) / math.Cbrt(math.Max(float64(n.Count), 1))
+			}
+
+			s.nodes[id] = n
+		}
+	}
+
+	for id, n := range s.nodes {
+		for i := len(id) - 1; i > 0; i-- {
+			parent, ok := s.nodes[id[:i]]
+			if ok {
+				n.Parent = parent
+				parent.Children = append(parent.Children, n)
+				break
+			}
+		}
+
+		if n.Parent == nil {
+			s.roots = append(s.roots, n)
+		}
+	}
+}
+
+// Update queues the latest camera, replacing any the streamer has not yet seen.
+func (s *Streamer) Update(camera *structs.CameraEvent) {
+	select {
+	case <-s.updates:
+	default:
+	}
+
+	s.updates <- camera
+}
+
+// Filter replaces the dimension ranges that streamed points must fall within.
+// Nodes already sent are resent under the new filter.
+func (s *Streamer) Filter(ranges []structs.DimensionRange) {
+	select {
+	case <-s.filters:
+	default:
+	}
+
+	s.filters <- ranges
+}
+
+func (s *Streamer) Stop() {
+	close(s.stop)
+}
+
+func (s *Streamer) Run() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case camera := <-s.updates:
+			s.camera = camera
+			s.stream(camera)
+		case ranges := <-s.filters:
+			s.ranges = ranges
+			s.resend()
+		}
+	}
+}
+
+// stream brings the client's nodes in line with a camera. Nodes that left the
+// view are cancelled, then missing nodes are sent in order of screen-space
+// error until a newer camera arrives.
+func (s *Streamer) stream(camera *structs.CameraEvent) {
+	cut := s.selectNodes(camera)
+
+	keep := map[string]bool{}
+	pending := []*node{}
+	for _, n := range cut {
+		keep[n.Id] = true
+		if !s.sent[n.Id] {
+			pending = append(pending, n)
+		}
+	}
+
+	// Coarser nodes stay on the client until their replacements have arrived.
+	for _, n := range pending {
+		for p := n.Parent; p != nil; p = p.Parent {
+			keep[p.Id] = true
+		}
+	}
+
+	cancelled := []string{}
+	for id := range s.sent {
+		if !keep[id] {
+			cancelled = append(cancelled, id)
+			delete(s.sent, id)
+		}
+	}
+
+	if len(cancelled) > 0 {
+		s.socket.Lock.Lock()
+		s.socket.Conn.WriteJSON(structs.NodeCancelEvent{
+			Event: "node-cancel",
+			NodeIds: cancelled,
+		})
+		s.socket.Lock.Unlock()
+	}
+
+	for _, n := range pending {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if len(s.updates) > 0 {
+			return
+		}
+
+		s.sendNode(n)
+	}
+}
+
+// resend cancels every node on the client and streams the current view
+// again.
+func (s *Streamer) resend() {
+	cancelled := []string{}
+	for id := range s.sent {
+		cancelled = append(cancelled, id)
+	}
+	s.sent = map[string]bool{}
+
+	if len(cancelled) > 0 {
+		s.socket.Lock.Lock()
+		s.socket.Conn.WriteJSON(structs.NodeCancelEvent{
+			Event: "node-cancel",
+			NodeIds: cancelled,
+		})
+		s.socket.Lock.Unlock()
+	}
+
+	if s.camera != nil {
+		s.stream(s.camera)
+	}
+}
+
+// selectNodes picks the visible nodes to show for a camera, refining the node
+// with the largest screen-space error first while the point budget allows.
+func (s *Streamer) selectNodes(camera *structs.CameraEvent) []*node {
+	budget := camera.PointBudget
+	if budget <= 0 {
+		budget = constants.StreamPointBudget
+	}
+
+	queue := &nodeQueue{}
+	total := 0
+
+	for _, root := range s.roots {
+		if visible(root, camera) {
+			heap.Push(queue, &queuedNode{node: root, error: screenSpaceError(root, camera)})
+			total += root.Count
+		}
+	}
+
+	cut := []*node{}
+
+	for queue.Len() > 0 {
+		q := heap.Pop(queue).(*queuedNode)
+
+		children := []*node{}
+		childCount := 0
+		for _, child := range q.node.Children {
+			if visible(child, camera) {
+				children = append(children, child)
+				childCount += child.Count
+			}
+		}
+
+		if q.error <= constants.ScreenSpaceErrorThreshold || len(q.node.Children) == 0 || total - q.node.Count + childCount > budget {
+			cut = append(cut, q.node)
+			continue
+		}
+
+		total += childCount - q.node.Count
+		for _, child := range children {
+			heap.Push(queue, &queuedNode{node: child, error: screenSpaceError(child, camera)})
+		}
+	}
+
+	// Refinement order puts coarse, high error nodes first.
+	queue = &nodeQueue{}
+	for _, n := range cut {
+		heap.Push(queue, &queuedNode{node: n, error: screenSpaceError(n, camera)})
+	}
+
+	ordered := make([]*node, 0, len(cut))
+	for queue.Len() > 0 {
+		ordered = append(ordered, heap.Pop(queue).(*queuedNode).node)
+	}
+
+	return ordered
+}
+
+func (s *Streamer) sendNode(n *node) {
+	points, err := s.dataset.ReadSegment(n.Label, n.Id)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	values, err := s.dataset.ReadDimensions(n.Label, n.Id)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	points, values = dimensions.Filter(points, values, s.ranges)
+
+	totalChunks := int(math.Ceil(float64(len(points)) / float64(constants.SocketChunkSize)))
+
+	for i, chunk := 0, 0; i < len(points); i, chunk = i + constants.SocketChunkSize, chunk + 1 {
+		end := i + constants.SocketChunkSize
+		if end > len(points) {
+			end = len(points)
+		}
+
+		s.socket.Lock.Lock()
+		s.socket.Conn.WriteJSON(structs.NodeChunk{
+			Event: "node-points",
+			NodeId: n.Id,
+			Label: n.Label,
+			GeometricError: n.GeometricError,
+			Points: utils.OffsetPoints(points[i:end], &s.dataset.Info.Metadata),
+			Dimensions: dimensions.Slice(values, i / constants.PointOffset, end / constants.PointOffset),
+			Chunk: chunk,
+			TotalChunks: totalChunks,
+		})
+		s.socket.Lock.Unlock()
+	}
+
+	s.sent[n.Id] = true
+}
+
+// visible tests a node's box against the camera frustum, whose planes point
+// inwards. Without a frustum every node is visible.
+func visible(n *node, camera *structs.CameraEvent) bool {
+	for _, plane := range camera.Frustum {
+		if len(plane) < 4 {
+			continue
+		}
+
+		// The box corner furthest along the plane normal.
+		x, y, z := n.Min[0], n.Min[1], n.Min[2]
+		if plane[0] >= 0 {
+			x = n.Max[0]
+		}
+		if plane[1] >= 0 {
+			y = n.Max[1]
+		}
+		if plane[2] >= 0 {
+			z = n.Max[2]
+		}
+
+		if plane[0] * x + plane[1] * y + plane[2] * z + plane[3] < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func screenSpaceError(n *node, camera *structs.CameraEvent) float64 {
+	if len(camera.Position) < 3 {
+		return 0
+	}
+
+	distance := 0.0
+	for i := 0; i < 3; i++ {
+		d := math.Max(n.Min[i] - camera.Position[i], math.Max(0, camera.Position[i] - n.Max[i]))
+		distance += d * d
+	}
+	distance = math.Max(math.Sqrt(distance), 1e-6)
+
+	fov := camera.Fov
+	if fov <= 0 {
+		fov = 75
+	}
+
+	return n.GeometricError * camera.ScreenHeight / (2 * distance * math.Tan(fov * math.Pi / 360))
+}
+
+type queuedNode struct {
+	node *node
+	error float64
+}
+
+type nodeQueue []*queuedNode
+
+func (q nodeQueue) Len() int { return len(q) }
+func (q nodeQueue) Less(i, j int) bool { return q[i].error > q[j].error }
+func (q nodeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *nodeQueue) Push(x interface{}) {
+	*q = append(*q, x.(*queuedNode))
+}
+
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n - 1]
+	*q = old[:n - 1]
+	return item
+}
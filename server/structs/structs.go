@@ -23,11 +23,68 @@ type ProcessingOptions struct {
 	Subsample string
 	Lod string
 	Density string
+	OutOfCore string
+	MemoryBudget string
+	LodLevels string
+	LodPoints string
+	LodDistances string
+	LodErrors string
+	Reducer string
+	VoxelSize string
+	SampleRate string
+	PoissonRadius string
+	PointBudget string
+	BudgetWeighting string
+	Seed string
+	KMeansInit string
+	KSelection string
+	MaxK string
+	TargetDensity string
+	ClusterWorkers string
+	MiniBatchThreshold string
+	ClusterByClass string
+	ColourWeight string
+	IntensityWeight string
+	Metrics string
+	Outliers string
+	OutlierK string
+	OutlierStdDev string
+	OutlierRadius string
+	OutlierMinNeighbours string
+	OutlierAction string
+	OutlierStage string
+	Ground string
+	GroundCellSize string
+	GroundSlope string
+	GroundMaxWindow string
+	GroundThreshold string
+	GroundMaxThreshold string
+	GroundOverwrite string
+	HeightAboveGround string
+	Rasters string
+	RasterFormats string
+	RasterResolution string
+	Export string
+	Contours string
+	ContourInterval string
+	ContourIndex string
+	ContourSmoothing string
+	ContourFormats string
+	KeepRaw string
+	Normals string
+	NormalK string
+	NormalOrientation string
+	NormalScanner string
+	Shapes string
+	ShapeTolerance string
+	ShapeMinSupport string
+	ShapeNormalDeviation string
 }
 
 type PointChunk struct {
 	Event string
 	Points []float64
+	Dimensions map[string][]float64 `json:",omitempty"`
 	TotalChunks int
 }
 
@@ -39,11 +96,51 @@ type FileReadyEvent struct {
 type LODChunk struct {
 	Event string
 	Points []float64
+	Dimensions map[string][]float64 `json:",omitempty"`
+	Sequence int
 	TotalChunks int
 	RenderDistance float64
+	GeometricError float64
+	Depth int
 	Label string
 }
 
+type LODDoneEvent struct {
+	Event string
+	Label string
+	RenderDistance float64
+	TotalChunks int
+	PointCount int
+}
+
+type DatasetEvent struct {
+	Event string
+	DatasetId string
+}
+
+type ArtifactEvent struct {
+	Event string
+	DatasetId string
+	Name string
+	Url string
+}
+
+// ContourLine is a contour in the client's coordinate space, with Points
+// holding x, y and z for each vertex.
+type ContourLine struct {
+	Elevation float64
+	Index bool
+	Closed bool
+	Points []float64
+}
+
+type ContourChunk struct {
+	Event string
+	Lines []ContourLine
+	Chunk int
+	TotalChunks int
+}
+
 type DoneEvent struct {
 	Event string
 }
@@ -86,4 +183,204 @@ type LASHeaders struct {
 	Offset []float64
 	MaximumBounds []float64
 	MinimumBounds []float64
-}
\ No newline at end of file
+	GeoKeys []uint16 `json:",omitempty"`
+	GeoDoubleParams []float64 `json:",omitempty"`
+	GeoAsciiParams string `json:",omitempty"`
+}
+type HistogramBucket struct {
+	Min int
+	Max int
+	Count int
+}
+
+type StageReport struct {
+	Name string
+	PointsIn int
+	PointsOut int
+	Milliseconds int64
+	Counts map[string]int `json:",omitempty"`
+}
+
+type OctreeReport struct {
+	Depth int
+	NodesPerLevel []int
+	LeafCount int
+	LeafOccupancy []HistogramBucket
+	MinPointsPerLeaf int
+	MedianPointsPerLeaf int
+	MaxPointsPerLeaf int
+	EmptySpaceRatio float64
+}
+
+// ErrorMetrics measures how far a reduced cloud strays from its original.
+// Forward distances run from each original point to the nearest reduced
+// one; backward distances from each reduced point to the nearest original.
+// Mean and RMS distances are forward.
+type ErrorMetrics struct {
+	PointsIn int
+	PointsOut int
+	ReductionRatio float64
+	HausdorffForward float64
+	HausdorffBackward float64
+	Hausdorff float64
+	MeanDistance float64
+	RmsDistance float64
+}
+
+type NodeError struct {
+	NodeId string
+	ErrorMetrics
+}
+
+type LevelError struct {
+	Label string
+	ErrorMetrics
+}
+
+type SimplificationReport struct {
+	Job ErrorMetrics
+	Leaves []NodeError
+	Levels []LevelError
+}
+
+type DiagnosticsReport struct {
+	Event string
+	DatasetId string
+	Octree *OctreeReport
+	Stages []StageReport
+	ClusteringTimings map[string]int64
+	Simplification *SimplificationReport `json:",omitempty"`
+}
+
+type ClientEvent struct {
+	Event string
+	DatasetId string
+}
+
+// DimensionRange keeps points whose value of a dimension lies between Min
+// and Max inclusive.
+type DimensionRange struct {
+	Dimension string
+	Min float64
+	Max float64
+}
+
+type FilterEvent struct {
+	Event string
+	Ranges []DimensionRange
+}
+
+type CameraEvent struct {
+	Event string
+	Position []float64
+	Frustum [][]float64
+	ScreenHeight float64
+	Fov float64
+	PointBudget int
+}
+
+type NodeChunk struct {
+	Event string
+	NodeId string
+	Label string
+	GeometricError float64
+	Points []float64
+	Dimensions map[string][]float64 `json:",omitempty"`
+	Chunk int
+	TotalChunks int
+}
+
+type NodeCancelEvent struct {
+	Event string
+	NodeIds []string
+}
+
+// VolumeRequest measures the material inside a polygon, given as vertices
+// in the client's coordinate space. Base is "fitted" for a plane fitted to
+// the surface along the boundary, "fixed" for a real-world Elevation,
+// "dataset" for the surface of BaseDatasetId, or "dtm" for the ground of
+// BaseDatasetId, or of the dataset itself when that is empty.
+type VolumeRequest struct {
+	Vertices [][]float64
+	Base string
+	Elevation float64
+	BaseDatasetId string
+	CellSize float64
+}
+
+// VolumeReport gives volumes in cubic units. Cut is material above the base
+// and Fill is space below it, so a stockpile over its base is all cut.
+// Uncertainty is one standard deviation of Net.
+type VolumeReport struct {
+	Base string
+	Level string
+	CellSize float64
+	Area float64
+	Cells int
+	InterpolatedCells int
+	Points int
+	Cut float64
+	Fill float64
+	Net float64
+	Uncertainty float64
+	Plane []float64 `json:",omitempty"`
+}
+
+// ProfileRequest extracts the points within Width / 2 either side of a
+// polyline, given as vertices in the client's coordinate space.
+type ProfileRequest struct {
+	Vertices [][]float64
+	Width float64
+}
+
+// ProfilePoint is a point along a profile. Station is the distance along the
+// polyline, Offset the distance from it with left positive, and Easting,
+// Northing and Elevation its real-world position.
+type ProfilePoint struct {
+	Station float64
+	Offset float64
+	Elevation float64
+	Easting float64
+	Northing float64
+	Intensity float64
+	Classification float64
+}
+
+// ProfileReport holds a profile's points in order of station. Stations are
+// the stations of the polyline's vertices.
+type ProfileReport struct {
+	Level string
+	Width float64
+	Length float64
+	Stations []float64
+	Points []ProfilePoint
+}
+
+// ShapeSegment is a primitive found in the clustered points. Type is
+// "plane", "cylinder" or "sphere", and Label names what a plane looks like:
+// "wall", "floor", "ceiling" or "plane" when it is inclined. Planes have a
+// unit Normal and Centre, the centroid of their inliers. Cylinders have a
+// Centre on their axis, midway along their inliers, a unit Axis, a Radius
+// and a Length. Spheres have a Centre and Radius. Inliers are point IDs,
+// each the index of a point in the order the clustered leaves were
+// streamed, and Rms is their RMS distance from the shape.
+type ShapeSegment struct {
+	Id int
+	Type string
+	Label string
+	Centre []float64
+	Normal []float64 `json:",omitempty"`
+	Axis []float64 `json:",omitempty"`
+	Radius float64 `json:",omitempty"`
+	Length float64 `json:",omitempty"`
+	Rms float64
+	Inliers []int
+}
+
+// ShapeEvent sends one segment, in the client's coordinate space.
+type ShapeEvent struct {
+	Event string
+	Segment ShapeSegment
+	Index int
+	Total int
+}
@@ -0,0 +1,351 @@
+package vector
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Polyline is a 3D line in real-world coordinates: easting, northing and
+// elevation. Properties holds the numeric attributes named by its
+// collection's Fields.
+type Polyline struct {
+	Layer string
+	Points [][3]float64
+	Closed bool
+	Properties map[string]float64
+}
+
+// Point is a single 3D position, written as a DXF POINT or a GeoJSON Point.
+// Shapefiles only hold a collection's lines.
+type Point struct {
+	Layer string
+	Position [3]float64
+}
+
+type Collection struct {
+	Fields []string
+	Lines []Polyline
+	Points []Point
+}
+
+type geoJSONGeometry struct {
+	Type string `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type string `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry geoJSONGeometry `json:"geometry"`
+}
+
+type geoJSONCollection struct {
+	Type string `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// WriteGeoJSON writes each line as a LineString feature, repeating the first
+// point at the end of closed lines.
+func WriteGeoJSON(w io.Writer, collection *Collection) error {
+	doc := geoJSONCollection{
+		Type: "FeatureCollection",
+		Features: []geoJSONFeature{},
+	}
+
+	for _, line := range collection.Lines {
+		properties := map[string]interface{}{}
+		for _, field := range collection.Fields {
+			properties[field] = line.Properties[field]
+		}
+		if line.Layer != "" {
+			properties["layer"] = line.Layer
+		}
+
+		doc.Features = append(doc.Features, geoJSONFeature{
+			Type: "Feature",
+			Properties: properties,
+			Geometry: geoJSONGeometry{
+				Type: "LineString",
+				Coordinates: closedPoints(line),
+			},
+		})
+	}
+
+	for _, point := range collection.Points {
+		doc.Features = append(doc.Features, geoJSONFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"layer": point.Layer,
+			},
+			Geometry: geoJSONGeometry{
+				Type: "Point",
+				Coordinates: point.Position,
+			},
+		})
+	}
+
+	return json.NewEncoder(w).Encode(doc)
+}
+
+func closedPoints(line Polyline) [][3]float64 {
+	if !line.Closed || len(line.Points) == 0 {
+		return line.Points
+	}
+
+	points := make([][3]float64, len(line.Points), len(line.Points) + 1)
+	copy(points, line.Points)
+
+	return append(points, line.Points[0])
+}
+
+// WriteDXF writes an ASCII DXF with each line as a 3D POLYLINE entity and
+// each point as a POINT entity on its layer.
+func WriteDXF(w io.Writer, collection *Collection) error {
+	bw := bufio.NewWriter(w)
+
+	pair := func(code int, value string) {
+		fmt.Fprintf(bw, "%d\n%s\n", code, value)
+	}
+	number := func(code int, value float64) {
+		pair(code, fmt.Sprintf("%.6f", value))
+	}
+
+	pair(0, "SECTION")
+	pair(2, "ENTITIES")
+
+	for _, line := range collection.Lines {
+		layer := line.Layer
+		if layer == "" {
+			layer = "0"
+		}
+
+		// Flag 8 marks a 3D polyline, 1 a closed one.
+		flags := 8
+		if line.Closed {
+			flags |= 1
+		}
+
+		pair(0, "POLYLINE")
+		pair(8, layer)
+		pair(66, "1")
+		number(10, 0)
+		number(20, 0)
+		number(30, 0)
+		pair(70, fmt.Sprint(flags))
+
+		for _, p := range line.Points {
+			pair(0, "VERTEX")
+			pair(8, layer)
+			number(10, p[0])
+			number(20, p[1])
+			number(30, p[2])
+			pair(70, "32")
+		}
+
+		pair(0, "SEQEND")
+		pair(8, layer)
+	}
+
+	for _, point := range collection.Points {
+		layer := point.Layer
+		if layer == "" {
+			layer = "0"
+		}
+
+		pair(0, "POINT")
+		pair(8, layer)
+		number(10, point.Position[0])
+		number(20, point.Position[1])
+		number(30, point.Position[2])
+	}
+
+	pair(0, "ENDSEC")
+	pair(0, "EOF")
+
+	return bw.Flush()
+}
+
+// Shapefile shape type for polylines with elevations.
+const polyLineZ int32 = 13
+
+// WriteShapefile writes a zip holding the .shp, .shx and .dbf files of a
+// PolyLineZ shapefile named name, with a numeric column for each field.
+func WriteShapefile(w io.Writer, name string, collection *Collection) error {
+	shp, shx := shapes(collection)
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{name + ".shp", shp},
+		{name + ".shx", shx},
+		{name + ".dbf", table(collection)},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(file.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func shapes(collection *Collection) ([]byte, []byte) {
+	le, be := binary.LittleEndian, binary.BigEndian
+
+	min := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for _, line := range collection.Lines {
+		for _, p := range line.Points {
+			for i := 0; i < 3; i++ {
+				min[i] = math.Min(min[i], p[i])
+				max[i] = math.Max(max[i], p[i])
+			}
+		}
+	}
+	if math.IsInf(min[0], 1) {
+		min, max = [3]float64{}, [3]float64{}
+	}
+
+	header := func(length int) []byte {
+		buf := make([]byte, 100)
+		be.PutUint32(buf[0:], 9994)
+		be.PutUint32(buf[24:], uint32(length / 2))
+		le.PutUint32(buf[28:], 1000)
+		le.PutUint32(buf[32:], uint32(polyLineZ))
+		le.PutUint64(buf[36:], math.Float64bits(min[0]))
+		le.PutUint64(buf[44:], math.Float64bits(min[1]))
+		le.PutUint64(buf[52:], math.Float64bits(max[0]))
+		le.PutUint64(buf[60:], math.Float64bits(max[1]))
+		le.PutUint64(buf[68:], math.Float64bits(min[2]))
+		le.PutUint64(buf[76:], math.Float64bits(max[2]))
+		return buf
+	}
+
+	records := bytes.Buffer{}
+	index := bytes.Buffer{}
+	offset := 100
+
+	for i, line := range collection.Lines {
+		points := closedPoints(line)
+		n := len(points)
+
+		content := make([]byte, 44 + 4 + n * 16 + 16 + n * 8 + 16 + n * 8)
+		le.PutUint32(content[0:], uint32(polyLineZ))
+
+		lineMin := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+		lineMax := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+		for _, p := range points {
+			for j := 0; j < 3; j++ {
+				lineMin[j] = math.Min(lineMin[j], p[j])
+				lineMax[j] = math.Max(lineMax[j], p[j])
+			}
+		}
+
+		le.PutUint64(content[4:], math.Float64bits(lineMin[0]))
+		le.PutUint64(content[12:], math.Float64bits(lineMin[1]))
+		le.PutUint64(content[20:], math.Float64bits(lineMax[0]))
+		le.PutUint64(content[28:], math.Float64bits(lineMax[1]))
+		le.PutUint32(content[36:], 1)
+		le.PutUint32(content[40:], uint32(n))
+		le.PutUint32(content[44:], 0)
+
+		at := 48
+		for _, p := range points {
+			le.PutUint64(content[at:], math.Float64bits(p[0]))
+			le.PutUint64(content[at + 8:], math.Float64bits(p[1]))
+			at += 16
+		}
+
+		le.PutUint64(content[at:], math.Float64bits(lineMin[2]))
+		le.PutUint64(content[at + 8:], math.Float64bits(lineMax[2]))
+		at += 16
+		for _, p := range points {
+			le.PutUint64(content[at:], math.Float64bits(p[2]))
+			at += 8
+		}
+
+		// Measures are not used, so their range and values are left as zero.
+
+		record := make([]byte, 8)
+		be.PutUint32(record[0:], uint32(i + 1))
+		be.PutUint32(record[4:], uint32(len(content) / 2))
+		records.Write(record)
+		records.Write(content)
+
+		entry := make([]byte, 8)
+		be.PutUint32(entry[0:], uint32(offset / 2))
+		be.PutUint32(entry[4:], uint32(len(content) / 2))
+		index.Write(entry)
+
+		offset += 8 + len(content)
+	}
+
+	shp := append(header(100 + records.Len()), records.Bytes()...)
+	shx := append(header(100 + index.Len()), index.Bytes()...)
+
+	return shp, shx
+}
+
+// table writes a dBASE III file with a numeric column for each field.
+func table(collection *Collection) []byte {
+	le := binary.LittleEndian
+	const width = 18
+	const decimals = 6
+
+	recordLength := 1 + width * len(collection.Fields)
+	headerLength := 32 + 32 * len(collection.Fields) + 1
+
+	buf := bytes.Buffer{}
+
+	header := make([]byte, 32)
+	header[0] = 3
+	header[1], header[2], header[3] = 95, 7, 26
+	le.PutUint32(header[4:], uint32(len(collection.Lines)))
+	le.PutUint16(header[8:], uint16(headerLength))
+	le.PutUint16(header[10:], uint16(recordLength))
+	buf.Write(header)
+
+	for _, field := range collection.Fields {
+		descriptor := make([]byte, 32)
+		name := strings.ToUpper(field)
+		if len(name) > 10 {
+			name = name[:10]
+		}
+		copy(descriptor, name)
+		descriptor[11] = 'N'
+		descriptor[16] = width
+		descriptor[17] = decimals
+		buf.Write(descriptor)
+	}
+	buf.WriteByte(0x0D)
+
+	for _, line := range collection.Lines {
+		buf.WriteByte(' ')
+		for _, field := range collection.Fields {
+			value := fmt.Sprintf("%*.*f", width, decimals, line.Properties[field])
+			if len(value) > width {
+				value = value[:width]
+			}
+			buf.WriteString(value)
+		}
+	}
+	buf.WriteByte(0x1A)
+
+	return buf.Bytes()
+}
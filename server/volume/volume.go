@@ -0,0 +1,369 @@
+package volume
+
+import (
+	"errors"
+	"math"
+
+	c "lidar/constants"
+	"lidar/datastore"
+	"lidar/raster"
+	"lidar/structs"
+)
+
+var pointOffset int = c.PointOffset
+
+const (
+	groundClass float64 = 2
+	noiseClass float64 = 7
+)
+
+// surface averages point elevations in each cell of a grid. Grids here are
+// in real-world coordinates, so datasets with different offsets line up.
+type surface struct {
+	grid *raster.Grid
+	sums []float64
+	squares []float64
+	counts []int
+	points int
+}
+
+func newSurface(template *raster.Grid) *surface {
+	cells := len(template.Values)
+	grid := *template
+	grid.Values = make([]float64, cells)
+	copy(grid.Values, template.Values)
+
+	return &surface{
+		grid: &grid,
+		sums: make([]float64, cells),
+		squares: make([]float64, cells),
+		counts: make([]int, cells),
+	}
+}
+
+// collect adds a dataset's points that keep accepts, reading the full
+// resolution points when the dataset kept them and its leaves otherwise,
+// and only the nodes that reach the grid.
+// It returns the level read.
+func (s *surface) collect(dataset *datastore.Dataset, keep func(class float64) bool) (string, error) {
+	label := "raw"
+	if dataset.Level(label) == nil {
+		label = "leaf"
+	}
+
+	offset := dataset.Info.Headers.Offset
+	g := s.grid
+	maxX := g.MinX + float64(g.Columns) * g.CellSize
+	maxZ := g.MinZ + float64(g.Rows) * g.CellSize
+
+	min, max := [2]float64{g.MinX, g.MinZ}, [2]float64{maxX, maxZ}
+	err := dataset.EachSegmentWithin(label, min, max, func(nodeId string, points []float64) {
+		for i := 0; i < len(points); i += pointOffset {
+			x, north, elevation := points[i] + offset[0], points[i + 2] + offset[1], points[i + 1] + offset[2]
+			if x < g.MinX || x >= maxX || north < g.MinZ || north >= maxZ || !keep(points[i + pointOffset - 1]) {
+				continue
+			}
+
+			j := g.Index(x, north)
+			s.sums[j] += elevation
+			s.squares[j] += elevation * elevation
+			s.counts[j]++
+			s.points++
+		}
+	})
+
+	return label, err
+}
+
+// finish sets each cell to its mean elevation and fills empty cells from
+// their neighbours. It returns each cell's standard error and whether it
+// was filled. Cells with fewer than two points take the spread pooled over
+// all cells.
+func (s *surface) finish() ([]float64, []bool, error) {
+	within, freedom := 0.0, 0
+
+	for j, count := range s.counts {
+		if count == 0 {
+			continue
+		}
+
+		mean := s.sums[j] / float64(count)
+		s.grid.Values[j] = mean
+		within += math.Max(s.squares[j] - float64(count) * mean * mean, 0)
+		freedom += count - 1
+	}
+
+	pooled := 0.0
+	if freedom > 0 {
+		pooled = math.Sqrt(within / float64(freedom))
+	}
+
+	sigma := make([]float64, len(s.counts))
+	filled := make([]bool, len(s.counts))
+
+	for j, count := range s.counts {
+		switch {
+		case count == 0:
+			sigma[j] = pooled
+			filled[j] = true
+		case count == 1:
+			sigma[j] = pooled
+		default:
+			mean := s.grid.Values[j]
+			variance := math.Max(s.squares[j] / float64(count) - mean * mean, 0) * float64(count) / float64(count - 1)
+			sigma[j] = math.Sqrt(variance / float64(count))
+		}
+	}
+
+	if raster.FillIDW(s.grid) < 0 {
+		return nil, nil, errors.New("no points inside the boundary")
+	}
+
+	return sigma, filled, nil
+}
+
+// Compute measures the volume between a dataset's surface and the requested
+// base inside the request's polygon. base is the dataset compared against
+// for "dataset" and "dtm" bases, and may be nil for a DTM of the dataset
+// itself.
+func Compute(dataset, base *datastore.Dataset, request *structs.VolumeRequest) (*structs.VolumeReport, error) {
+	if len(request.Vertices) < 3 {
+		return nil, errors.New("a boundary needs at least three vertices")
+	}
+
+	polygon, err := dataset.ToRealWorld(request.Vertices)
+	if err != nil {
+		return nil, err
+	}
+
+	cellSize := request.CellSize
+	if cellSize <= 0 {
+		cellSize = c.VolumeCellSize
+	}
+
+	minX, minZ, maxX, maxZ := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range polygon {
+		minX, maxX = math.Min(minX, p[0]), math.Max(maxX, p[0])
+		minZ, maxZ = math.Min(minZ, p[1]), math.Max(maxZ, p[1])
+	}
+
+	// The margin gives a DTM ground around the boundary to interpolate from.
+	margin := float64(c.VolumeMargin) * cellSize
+	template := raster.NewGrid(minX - margin, minZ - margin, maxX + margin, maxZ + margin, cellSize)
+
+	top := newSurface(template)
+	level, err := top.collect(dataset, func(class float64) bool {
+		return class != noiseClass
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	topSigma, topFilled, err := top.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &structs.VolumeReport{
+		Base: request.Base,
+		Level: level,
+		CellSize: cellSize,
+		Points: top.points,
+	}
+
+	baseValues := make([]float64, len(template.Values))
+	baseSigma := make([]float64, len(template.Values))
+	systematic := 0.0
+
+	switch request.Base {
+	case "", "fitted":
+		report.Base = "fitted"
+		plane, rms, samples := fitBoundary(top.grid, polygon)
+		if samples < 3 {
+			return nil, errors.New("boundary too small to fit a base plane")
+		}
+		report.Plane = plane[:]
+
+		for j := range baseValues {
+			x, z := template.Centre(j % template.Columns, j / template.Columns)
+			baseValues[j] = plane[0] + plane[1] * x + plane[2] * z
+		}
+
+		// The plane moves as one, so its error is systematic over the area.
+		systematic = rms / math.Sqrt(float64(samples))
+	case "fixed":
+		for j := range baseValues {
+			baseValues[j] = request.Elevation
+		}
+	case "dataset", "dtm":
+		other := base
+		if other == nil {
+			if request.Base == "dataset" {
+				return nil, errors.New("a base dataset is required")
+			}
+			other = dataset
+		}
+
+		keep := func(class float64) bool {
+			return class != noiseClass
+		}
+		if request.Base == "dtm" {
+			keep = func(class float64) bool {
+				return class == groundClass
+			}
+		}
+
+		bottom := newSurface(template)
+		_, err = bottom.collect(other, keep)
+		if err != nil {
+			return nil, err
+		}
+
+		baseSigma, _, err = bottom.finish()
+		if err != nil {
+			return nil, errors.New("base has no points near the boundary")
+		}
+
+		copy(baseValues, bottom.grid.Values)
+	default:
+		return nil, errors.New("unknown base " + request.Base)
+	}
+
+	cellArea := cellSize * cellSize
+	variance := 0.0
+
+	for j := range template.Values {
+		col, row := j % template.Columns, j / template.Columns
+		x, z := template.Centre(col, row)
+		if !inside(polygon, x, z) {
+			continue
+		}
+
+		report.Cells++
+		if topFilled[j] {
+			report.InterpolatedCells++
+		}
+
+		d := (top.grid.Values[j] - baseValues[j]) * cellArea
+		if d > 0 {
+			report.Cut += d
+		} else {
+			report.Fill -= d
+		}
+
+		variance += cellArea * cellArea * (topSigma[j] * topSigma[j] + baseSigma[j] * baseSigma[j])
+	}
+
+	if report.Cells == 0 {
+		return nil, errors.New("boundary is smaller than a cell")
+	}
+
+	report.Area = float64(report.Cells) * cellArea
+	report.Net = report.Cut - report.Fill
+	report.Uncertainty = math.Sqrt(variance) + report.Area * systematic
+
+	return report, nil
+}
+
+// inside tests a point against a polygon by counting edge crossings.
+func inside(polygon [][2]float64, x, z float64) bool {
+	in := false
+	for i, j := 0, len(polygon) - 1; i < len(polygon); j, i = i, i + 1 {
+		a, b := polygon[i], polygon[j]
+		if (a[1] > z) != (b[1] > z) && x < (b[0] - a[0]) * (z - a[1]) / (b[1] - a[1]) + a[0] {
+			in = !in
+		}
+	}
+
+	return in
+}
+
+// fitBoundary fits a plane, elevation = p0 + p1 x + p2 z, by least squares to
+// the surface sampled every half cell along the boundary. It returns the
+// plane, the RMS residual and the number of samples.
+func fitBoundary(g *raster.Grid, polygon [][2]float64) ([3]float64, float64, int) {
+	samples := [][3]float64{}
+	step := g.CellSize / 2
+
+	for i := range polygon {
+		a, b := polygon[i], polygon[(i + 1) % len(polygon)]
+		length := math.Hypot(b[0] - a[0], b[1] - a[1])
+		n := int(math.Ceil(length / step))
+
+		for k := 0; k < n; k++ {
+			t := float64(k) / float64(n)
+			x, z := a[0] + t * (b[0] - a[0]), a[1] + t * (b[1] - a[1])
+			v := g.Sample(x, z)
+			if !math.IsNaN(v) {
+				samples = append(samples, [3]float64{x, z, v})
+			}
+		}
+	}
+
+	plane := [3]float64{}
+	if len(samples) < 3 {
+		return plane, 0, len(samples)
+	}
+
+	// Centre the samples so the normal equations stay well conditioned.
+	cx, cz := 0.0, 0.0
+	for _, s := range samples {
+		cx += s[0]
+		cz += s[1]
+	}
+	cx /= float64(len(samples))
+	cz /= float64(len(samples))
+
+	var m [3][3]float64
+	var r [3]float64
+	for _, s := range samples {
+		row := [3]float64{1, s[0] - cx, s[1] - cz}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				m[i][j] += row[i] * row[j]
+			}
+			r[i] += row[i] * s[2]
+		}
+	}
+
+	p, ok := solve(m, r)
+	if !ok {
+		// Collinear samples only fix the level, not the tilt.
+		p = [3]float64{r[0] / m[0][0], 0, 0}
+	}
+
+	plane = [3]float64{p[0] - p[1] * cx - p[2] * cz, p[1], p[2]}
+
+	sum := 0.0
+	for _, s := range samples {
+		d := s[2] - (plane[0] + plane[1] * s[0] + plane[2] * s[1])
+		sum += d * d
+	}
+
+	return plane, math.Sqrt(sum / float64(len(samples))), len(samples)
+}
+
+// solve applies Cramer's rule to a 3x3 system.
+func solve(m [3][3]float64, r [3]float64) ([3]float64, bool) {
+	det := func(a [3][3]float64) float64 {
+		return a[0][0] * (a[1][1] * a[2][2] - a[1][2] * a[2][1]) -
+			a[0][1] * (a[1][0] * a[2][2] - a[1][2] * a[2][0]) +
+			a[0][2] * (a[1][0] * a[2][1] - a[1][1] * a[2][0])
+	}
+
+	d := det(m)
+	if math.Abs(d) < 1e-12 {
+		return [3]float64{}, false
+	}
+
+	res := [3]float64{}
+	for k := 0; k < 3; k++ {
+		a := m
+		for i := 0; i < 3; i++ {
+			a[i][k] = r[i]
+		}
+		res[k] = det(a) / d
+	}
+
+	return res, true
+}
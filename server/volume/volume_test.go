@@ -0,0 +1,110 @@
+package volume
+
+import (
+	"math"
+	"testing"
+
+	"lidar/datastore"
+	"lidar/octree"
+	"lidar/structs"
+)
+
+// stockpile is flat ground at elevation 0 with a 4 by 4 block, 2 high and
+// classed as a building, standing on it between 10 and 14 in x and north.
+func stockpile(t *testing.T) *datastore.Dataset {
+	store, err := datastore.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := &structs.LASHeaders{Offset: []float64{0, 0, 0}}
+	dataset, err := store.Create("stockpile", headers, &structs.LASMetaData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := octree.GenerateOctree(&octree.OctreeDimensions{
+		X1: 0, X2: 32,
+		Y1: 0, Y2: 32,
+		Z1: 0, Z2: 32,
+		Granularity: 3,
+	})
+
+	for x := 0.125; x < 24; x += 0.25 {
+		for z := 0.125; z < 24; z += 0.25 {
+			y, class := 0.0, groundClass
+			if x > 10 && x < 14 && z > 10 && z < 14 {
+				y, class = 2, 6
+			}
+			octree.AddPoint(x, y, z, 0, 0, 0, 0, class, 0, o.Granularity, o.Root, o)
+		}
+	}
+
+	err = dataset.WriteLevel("leaf", 0, 0, o.Leaves, o.ReadPoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dataset
+}
+
+// square is a boundary from 8 to 16 in x and north, in client coordinates.
+var square = [][]float64{{8, 0, 8}, {16, 0, 8}, {16, 0, 16}, {8, 0, 16}}
+
+func TestComputeMeasuresStockpile(t *testing.T) {
+	dataset := stockpile(t)
+
+	for _, base := range []string{"fixed", "fitted", "dtm"} {
+		report, err := Compute(dataset, nil, &structs.VolumeRequest{
+			Vertices: square,
+			Base: base,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", base, err)
+		}
+
+		if report.Cells != 256 || report.Area != 64 {
+			t.Fatalf("%s: measured %d cells over %f, want 256 over 64", base, report.Cells, report.Area)
+		}
+		if math.Abs(report.Cut - 32) > 1e-6 || math.Abs(report.Fill) > 1e-6 {
+			t.Fatalf("%s: cut %f and fill %f, want 32 and 0", base, report.Cut, report.Fill)
+		}
+		if report.Level != "leaf" || report.Points == 0 {
+			t.Fatalf("%s: read %d points from %q", base, report.Points, report.Level)
+		}
+	}
+}
+
+func TestComputeAgainstRaisedBase(t *testing.T) {
+	report, err := Compute(stockpile(t), nil, &structs.VolumeRequest{
+		Vertices: square,
+		Base: "fixed",
+		Elevation: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The block is 1 above the base over 16 units, and the ground 1 below
+	// it over the other 48.
+	if math.Abs(report.Cut - 16) > 1e-6 || math.Abs(report.Fill - 48) > 1e-6 || math.Abs(report.Net + 32) > 1e-6 {
+		t.Fatalf("cut %f, fill %f and net %f, want 16, 48 and -32", report.Cut, report.Fill, report.Net)
+	}
+}
+
+func TestComputeRejectsBadRequests(t *testing.T) {
+	dataset := stockpile(t)
+
+	requests := []*structs.VolumeRequest{
+		{Vertices: square[:2], Base: "fixed"},
+		{Vertices: square, Base: "dataset"},
+		{Vertices: square, Base: "unknown"},
+	}
+
+	for _, request := range requests {
+		_, err := Compute(dataset, nil, request)
+		if err == nil {
+			t.Fatalf("expected an error for %d vertices and base %q", len(request.Vertices), request.Base)
+		}
+	}
+}